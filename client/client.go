@@ -7,9 +7,14 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"path"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/teirm/go_ftp/common"
 )
@@ -20,20 +25,44 @@ const (
 )
 
 type ClientConfig struct {
-	ip      string
-	port    string
-	account string
-	op      string
-	file    string
+	ip           string
+	port         string
+	account      string
+	op           string
+	file         string
+	ifMatch      string
+	ifNoneMatch  string
+	version      string
+	trashID      string
+	snapshot     string
+	newName      string
+	token        string
+	owner        string
+	grantee      string
+	access       string
+	maxBytes     string
+	maxFiles     string
+	auditAccount string
+	auditOp      string
+	since        string
+	until        string
+	limit        string
+	destination  string
+	truncate     bool
+	// history file of the shell
+	history string
 }
 
 type ClientState struct {
-	conn      net.Conn
+	ip        string
+	port      string
 	diskWrite chan common.ResponseData
 	diskRead  chan common.ClientData
 	send      chan common.ClientData
 	read      chan net.Conn
 	wg        sync.WaitGroup
+	// whether an operation failed or was refused
+	failed atomic.Bool
 }
 
 // create conection to server
@@ -42,68 +71,260 @@ func connect(ip string, port string) (net.Conn, error) {
 	return net.Dial("tcp", address)
 }
 
-// performOperation
+// Start the operation of a configuration, its response is
+// handled once the client is waited for
 func performOperation(config ClientConfig, client *ClientState) error {
 
 	account := config.account
 	fileName := config.file
+	params := requestParams(config)
 	switch config.op {
 	case "CREATE":
-		doCreate(account, client)
+		return doCreate(account, client)
 	case "READ":
-		doRead(account, fileName, client)
+		return doRead(account, fileName, params, client)
 	case "WRITE":
-		doWrite(account, fileName, client)
+		return doWrite(account, fileName, params, client)
 	case "DELETE":
-		doDelete(account, fileName, client)
+		return doDelete(account, fileName, params, client)
 	case "LIST":
-		doList(account, client)
+		return doList(account, fileName, params, client)
+	case "STAT":
+		return doStat(account, fileName, params, client)
+	case "VERSIONS":
+		return doVersions(account, fileName, client)
+	case "RESTORE":
+		return doRestore(account, fileName, params, client)
+	case "TRASH":
+		return doTrash(account, client)
+	case "UNDELETE":
+		return doUndelete(account, fileName, params, client)
+	case "PURGE":
+		return doPurge(account, fileName, params, client)
+	case "USAGE":
+		return doUsage(account, params, client)
+	case "GC":
+		return doGarbageCollect(account, params, client)
+	case "PING":
+		return doPing(account, client)
+	case "SNAPSHOT", "LIST-SNAPSHOTS", "RESTORE-SNAPSHOT", "DELETE-SNAPSHOT":
+		return doSnapshot(config.op, account, params, client)
+	case "DELETE-ACCOUNT", "RENAME-ACCOUNT", "LIST-ACCOUNTS", "SET-QUOTA", "SERVER-STATS", "AUDIT", "S3-KEY":
+		return doAccountAdmin(config.op, account, params, client)
+	case "GRANT", "REVOKE", "LIST-GRANTS":
+		return doGrant(config.op, account, fileName, params, client)
+	case "MKDIR", "RMDIR", "MOVE", "COPY":
+		return doTree(config.op, account, fileName, params, client)
+	default:
+		return fmt.Errorf("invalid operation: %s", config.op)
+	}
+}
+
+// build the request parameters from the config
+func requestParams(config ClientConfig) url.Values {
+	params := url.Values{}
+	if config.ifMatch != "" {
+		params.Set(common.ParamIfMatch, config.ifMatch)
+	}
+	if config.ifNoneMatch != "" {
+		params.Set(common.ParamIfNoneMatch, config.ifNoneMatch)
+	}
+	if config.version != "" {
+		params.Set(common.ParamVersion, config.version)
+	}
+	if config.destination != "" {
+		params.Set(common.ParamDestination, config.destination)
+	}
+	if config.truncate == true {
+		params.Set(common.ParamTruncate, "true")
+	}
+	if config.trashID != "" {
+		params.Set(common.ParamTrashID, config.trashID)
+	}
+	if config.snapshot != "" {
+		params.Set(common.ParamSnapshot, config.snapshot)
+	}
+	if config.newName != "" {
+		params.Set(common.ParamNewName, config.newName)
+	}
+	if config.token != "" {
+		params.Set(common.ParamToken, config.token)
+	}
+	if config.owner != "" {
+		params.Set(common.ParamOwner, config.owner)
 	}
+	if config.grantee != "" {
+		params.Set(common.ParamGrantee, config.grantee)
+	}
+	if config.access != "" {
+		params.Set(common.ParamAccess, config.access)
+	}
+	if config.maxBytes != "" {
+		params.Set(common.ParamMaxBytes, config.maxBytes)
+	}
+	if config.maxFiles != "" {
+		params.Set(common.ParamMaxFiles, config.maxFiles)
+	}
+	if config.auditAccount != "" {
+		params.Set(common.ParamAuditAccount, config.auditAccount)
+	}
+	if config.auditOp != "" {
+		params.Set(common.ParamAuditOp, config.auditOp)
+	}
+	if config.since != "" {
+		params.Set(common.ParamSince, config.since)
+	}
+	if config.until != "" {
+		params.Set(common.ParamUntil, config.until)
+	}
+	if config.limit != "" {
+		params.Set(common.ParamLimit, config.limit)
+	}
+	return params
+}
+
+// send a request without a body on a new connection and
+// read the response
+func doRequest(header common.Header, client *ClientState) error {
+	conn, err := connect(client.ip, client.port)
+	if err != nil {
+		return err
+	}
+	client.wg.Add(2)
+	client.send <- common.ClientData{Header: header, Conn: conn}
+	client.read <- conn
 	return nil
 }
 
 // do a create operation for a new account
-func doCreate(account string, client *ClientState) {
-	header := common.Header{"CREATE", account, "", 0}
-	client.wg.Add(2)
-	client.send <- common.ClientData{header, nil, client.conn}
-	client.read <- client.conn
+func doCreate(account string, client *ClientState) error {
+	return doRequest(common.Header{Operation: "CREATE", Info: account}, client)
 }
 
 // do a read operation
-func doRead(account string, fileName string, client *ClientState) {
-	header := common.Header{"READ", account, fileName, 0}
-	client.wg.Add(2)
-	client.send <- common.ClientData{header, nil, client.conn}
-	client.read <- client.conn
+func doRead(account string, fileName string, params url.Values, client *ClientState) error {
+	return doRequest(common.Header{Operation: "READ", Info: account, FileName: fileName, Params: params}, client)
 }
 
 // do a write operation
-func doWrite(account string, fileName string, client *ClientState) {
-	header := common.Header{"WRITE", account, fileName, 0}
+func doWrite(account string, fileName string, params url.Values, client *ClientState) error {
+	conn, err := connect(client.ip, client.port)
+	if err != nil {
+		return err
+	}
+	header := common.Header{Operation: "WRITE", Info: account, FileName: fileName, Params: params}
 	client.wg.Add(1)
-	client.diskRead <- common.ClientData{header, nil, client.conn}
+	client.diskRead <- common.ClientData{Header: header, Conn: conn}
+	return nil
 }
 
 // do a delete operation
-func doDelete(account string, fileName string, client *ClientState) {
-	header := common.Header{"DELETE", account, fileName, 0}
-	client.wg.Add(2)
-	client.send <- common.ClientData{header, nil, client.conn}
-	client.read <- client.conn
+func doDelete(account string, fileName string, params url.Values, client *ClientState) error {
+	return doRequest(common.Header{Operation: "DELETE", Info: account, FileName: fileName, Params: params}, client)
 }
 
-// do a list operation
-func doList(account string, client *ClientState) {
-	header := common.Header{"LIST", account, "", 0}
-	client.wg.Add(2)
-	client.send <- common.ClientData{header, nil, client.conn}
-	client.read <- client.conn
+// do a list operation on a directory, or the account if no
+// directory is given
+func doList(account string, dirName string, params url.Values, client *ClientState) error {
+	return doRequest(common.Header{Operation: "LIST", Info: account, FileName: dirName, Params: params}, client)
+}
+
+// do a stat operation
+func doStat(account string, fileName string, params url.Values, client *ClientState) error {
+	return doRequest(common.Header{Operation: "STAT", Info: account, FileName: fileName, Params: params}, client)
+}
+
+// do a versions operation listing previous versions of a file
+func doVersions(account string, fileName string, client *ClientState) error {
+	return doRequest(common.Header{Operation: "VERSIONS", Info: account, FileName: fileName}, client)
+}
+
+// do a restore operation to a previous version of a file
+func doRestore(account string, fileName string, params url.Values, client *ClientState) error {
+	return doRequest(common.Header{Operation: "RESTORE", Info: account, FileName: fileName, Params: params}, client)
+}
+
+// do a trash operation listing deleted files
+func doTrash(account string, client *ClientState) error {
+	return doRequest(common.Header{Operation: "TRASH", Info: account}, client)
+}
+
+// do an undelete operation moving a file out of the trash
+func doUndelete(account string, fileName string, params url.Values, client *ClientState) error {
+	return doRequest(common.Header{Operation: "UNDELETE", Info: account, FileName: fileName, Params: params}, client)
+}
+
+// do a purge operation permanently removing files from the trash
+func doPurge(account string, fileName string, params url.Values, client *ClientState) error {
+	return doRequest(common.Header{Operation: "PURGE", Info: account, FileName: fileName, Params: params}, client)
+}
+
+// do a usage operation reporting storage used by the account
+func doUsage(account string, params url.Values, client *ClientState) error {
+	return doRequest(common.Header{Operation: "USAGE", Info: account, Params: params}, client)
+}
+
+// do one of the snapshot operations on an account
+func doSnapshot(op string, account string, params url.Values, client *ClientState) error {
+	return doRequest(common.Header{Operation: op, Info: account, Params: params}, client)
+}
+
+// do one of the administrative operations
+func doAccountAdmin(op string, account string, params url.Values, client *ClientState) error {
+	return doRequest(common.Header{Operation: op, Info: account, Params: params}, client)
+}
+
+// do one of the grant operations sharing files with another account
+func doGrant(op string, account string, fileName string, params url.Values, client *ClientState) error {
+	return doRequest(common.Header{Operation: op, Info: account, FileName: fileName, Params: params}, client)
+}
+
+// do one of the operations creating, removing, moving or
+// copying files and directories
+func doTree(op string, account string, fileName string, params url.Values, client *ClientState) error {
+	return doRequest(common.Header{Operation: op, Info: account, FileName: fileName, Params: params}, client)
+}
+
+// do a gc operation removing unreferenced file contents
+func doGarbageCollect(account string, params url.Values, client *ClientState) error {
+	return doRequest(common.Header{Operation: "GC", Info: account, Params: params}, client)
+}
+
+// check that the server is responding
+func doPing(account string, client *ClientState) error {
+	return doRequest(common.Header{Operation: "PING", Info: account}, client)
+}
+
+// Operations that do not act on an account
+var accountlessOps = map[string]bool{
+	"PING":          true,
+	"LIST-ACCOUNTS": true,
+	"SERVER-STATS":  true,
+	"GC":            true,
+	"AUDIT":         true,
+}
+
+// Operations that act on a file or directory
+var fileOps = map[string]bool{
+	"READ":     true,
+	"WRITE":    true,
+	"DELETE":   true,
+	"STAT":     true,
+	"MKDIR":    true,
+	"RMDIR":    true,
+	"MOVE":     true,
+	"COPY":     true,
+	"VERSIONS": true,
+	"RESTORE":  true,
+	"UNDELETE": true,
 }
 
 // Basic sanity checking on configuration
+//
+// Checks the operation and the account, file and parameters
+// it needs before anything is sent to the server
 func validateConfig(config *ClientConfig) error {
-	if config.account == "" {
+	if config.account == "" && accountlessOps[config.op] == false {
 		return fmt.Errorf("invalid account name")
 	}
 
@@ -111,6 +332,51 @@ func validateConfig(config *ClientConfig) error {
 		return err
 	}
 
+	if config.file == "" && fileOps[config.op] == true {
+		return fmt.Errorf("missing file name")
+	}
+
+	switch config.op {
+	case "MOVE", "COPY":
+		if config.destination == "" {
+			return fmt.Errorf("missing destination")
+		}
+	case "RESTORE":
+		if config.version == "" {
+			return fmt.Errorf("missing version")
+		}
+	case "SNAPSHOT", "RESTORE-SNAPSHOT", "DELETE-SNAPSHOT":
+		if config.snapshot == "" {
+			return fmt.Errorf("missing snapshot name")
+		}
+	case "RENAME-ACCOUNT":
+		if config.newName == "" {
+			return fmt.Errorf("invalid new account name")
+		}
+	case "GRANT", "REVOKE":
+		if config.grantee == "" {
+			return fmt.Errorf("missing grantee")
+		}
+		if config.op == "GRANT" && config.access != common.AccessRead && config.access != common.AccessReadWrite {
+			return fmt.Errorf("invalid access: %q", config.access)
+		}
+	case "SET-QUOTA":
+		for _, limit := range [][2]string{{"max-bytes", config.maxBytes}, {"max-files", config.maxFiles}} {
+			if n, err := strconv.ParseInt(limit[1], 10, 64); limit[1] != "" && (err != nil || n < 0) {
+				return fmt.Errorf("invalid %s: %q", limit[0], limit[1])
+			}
+		}
+	case "AUDIT":
+		if n, err := strconv.Atoi(config.limit); config.limit != "" && (err != nil || n <= 0) {
+			return fmt.Errorf("invalid limit: %q", config.limit)
+		}
+		for _, bound := range [][2]string{{"since", config.since}, {"until", config.until}} {
+			if _, err := time.Parse(time.RFC3339, bound[1]); bound[1] != "" && err != nil {
+				return fmt.Errorf("invalid %s: %q", bound[0], bound[1])
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -134,9 +400,9 @@ func doDiskRead(data *common.ClientData) error {
 	return nil
 }
 
-// Perform disk IO
+// Perform disk IO, replacing any local file of the same name
 func doDiskWrite(data *common.ResponseData) error {
-	flags := os.O_APPEND | os.O_WRONLY | os.O_CREATE
+	flags := os.O_TRUNC | os.O_WRONLY | os.O_CREATE
 	perms := os.FileMode(0644)
 	fileName := data.Header.FileName
 	err := common.WriteFile(fileName, flags, perms, data.DataList)
@@ -169,31 +435,66 @@ func handleResponse(response common.ResponseData, cli *ClientState) {
 	common.DebugLog("response header: %v", header)
 	switch header.Operation {
 	case "READ":
+		cli.wg.Add(1)
 		cli.diskWrite <- response
-	case "LIST":
-		dataList := response.DataList
-		for iter := dataList.Front(); iter != nil; iter = iter.Next() {
-			data := iter.Value.(common.Data)
-			log.Printf("%s", string(data.Buffer))
+	case "LIST", "VERSIONS", "TRASH", "LIST-SNAPSHOTS", "LIST-ACCOUNTS", "LIST-GRANTS", "AUDIT":
+		log.Printf("header info: %s\n", header.Info)
+		fmt.Print(string(common.JoinDataList(response.DataList)))
+	case "STAT":
+		log.Printf("%s: %s, size %s, modified %s, version %s\n", header.FileName,
+			header.Params.Get(common.ParamType),
+			header.Params.Get(common.ParamSize),
+			header.Params.Get(common.ParamModTime),
+			header.Params.Get(common.ParamVersion))
+	case "USAGE":
+		log.Printf("%s: %s of %s bytes, %s of %s files (0 is unlimited)\n", header.Info,
+			header.Params.Get(common.ParamBytes),
+			header.Params.Get(common.ParamMaxBytes),
+			header.Params.Get(common.ParamFiles),
+			header.Params.Get(common.ParamMaxFiles))
+	case "SERVER-STATS":
+		for _, key := range sortedKeys(header.Params) {
+			log.Printf("%s: %s\n", key, header.Params.Get(key))
+		}
+	case "S3-KEY":
+		log.Printf("access key: %s\n", header.Params.Get(common.ParamAccessKey))
+		log.Printf("secret key: %s\n", header.Params.Get(common.ParamSecretKey))
+	case "GC":
+		log.Printf("removed %s blobs freeing %s bytes, %s blobs with %s references remain\n",
+			header.Params.Get(common.ParamRemoved),
+			header.Params.Get(common.ParamFreed),
+			header.Params.Get(common.ParamBlobs),
+			header.Params.Get(common.ParamReferences))
+	case "ERROR":
+		cli.failed.Store(true)
+		log.Printf("error: %s (%s)\n", header.Info, header.Params.Get(common.ParamCode))
+		if retryAfter := header.Params.Get(common.ParamRetryAfter); retryAfter != "" {
+			log.Printf("retry after: %s\n", retryAfter)
 		}
 	default:
 		log.Printf("header info: %s\n", header.Info)
 	}
+	if version := header.Params.Get(common.ParamVersion); version != "" && header.Operation != "STAT" {
+		log.Printf("version: %s\n", version)
+	}
 }
 
-// initialize and start client
-func startClient(ip string, port string) (*ClientState, error) {
-	var client ClientState
-	var err error
-
-	// TODO: connecting so early might be problematic
-	// if disk is slow. Maybe connect closer to when
-	// doing network IO
-	client.conn, err = connect(ip, port)
-	if err != nil {
-		log.Printf("unable to connect to server: %v\n", err)
-		return nil, err
+// Sorted keys of the parameters of a response
+func sortedKeys(params url.Values) []string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
+	return keys
+}
+
+// initialize and start client
+//
+// The server answers one request per connection, so each
+// operation connects when it is performed
+func startClient(ip string, port string) *ClientState {
+	client := ClientState{ip: ip, port: port}
 
 	// default to non-interactive worker count
 	netWorkers := 1
@@ -212,6 +513,7 @@ func startClient(ip string, port string) (*ClientState, error) {
 				common.DebugLog("%v\n", data)
 				err := sendMessage(data)
 				if err != nil {
+					cli.failed.Store(true)
 					log.Printf("unable to send message: %v\n", err)
 				}
 				cli.wg.Done()
@@ -224,7 +526,11 @@ func startClient(ip string, port string) (*ClientState, error) {
 			for data := range cli.diskRead {
 				err := doDiskRead(&data)
 				if err != nil {
+					cli.failed.Store(true)
 					log.Printf("unable to perform disk io: %v\n", err)
+					data.Conn.Close()
+					cli.wg.Done()
+					continue
 				}
 				cli.wg.Add(2)
 				cli.send <- data
@@ -239,6 +545,7 @@ func startClient(ip string, port string) (*ClientState, error) {
 			for data := range cli.diskWrite {
 				err := doDiskWrite(&data)
 				if err != nil {
+					cli.failed.Store(true)
 					log.Printf("unable to perform disk write: %v\n", err)
 				}
 				cli.wg.Done()
@@ -252,7 +559,9 @@ func startClient(ip string, port string) (*ClientState, error) {
 			for data := range cli.read {
 				common.DebugLog("Received data to read\n")
 				response, err := readResponse(data)
+				data.Close()
 				if err != nil {
+					cli.failed.Store(true)
 					log.Printf("unable to read response: %v\n", err)
 				} else {
 					handleResponse(response, cli)
@@ -262,31 +571,17 @@ func startClient(ip string, port string) (*ClientState, error) {
 		}(&client)
 	}
 
-	return &client, nil
+	return &client
 }
 
 func main() {
-	var config ClientConfig
-	flag.StringVar(&config.ip, "address", defaultAddress, "address to connect to")
-	flag.StringVar(&config.port, "port", defaultPort, "port to connect to")
-	flag.StringVar(&config.account, "account", "", "account to access")
-	flag.StringVar(&config.op, "op", "NOOP", "operation to perform")
-	flag.StringVar(&config.file, "file-name", "", "file to read or write into")
 	common.AddCommonFlags()
-
+	flag.Usage = func() { printUsage(flag.CommandLine.Output()) }
 	flag.Parse()
 
-	cli, err := startClient(config.ip, config.port)
-	if err != nil {
-		os.Exit(1)
-	}
-
-	err = performOperation(config, cli)
-
-	cli.wg.Wait()
-	if err != nil {
-		os.Exit(1)
-	} else {
-		os.Exit(0)
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
 	}
+	os.Exit(runCommand(flag.Arg(0), flag.Args()[1:]))
 }
@@ -11,20 +11,31 @@ func TestValidateConfig(t *testing.T) {
 		config ClientConfig
 		want   error
 	}{
-		{ClientConfig{"127.0.0.1", "9999", "test", "CREATE", ""}, nil},
-		{ClientConfig{"127.0.0.1", "9999", "", "CREATE", ""}, fmt.Errorf("invalid account name")},
-		{ClientConfig{"127.0.0.1", "9999", "test", "WOO", ""}, fmt.Errorf("invalid operation: WOO")},
+		{ClientConfig{ip: "127.0.0.1", port: "9999", account: "test", op: "CREATE"}, nil},
+		{ClientConfig{ip: "127.0.0.1", port: "9999", op: "CREATE"}, fmt.Errorf("invalid account name")},
+		{ClientConfig{ip: "127.0.0.1", port: "9999", account: "test", op: "WOO"}, fmt.Errorf("invalid operation: WOO")},
+		{ClientConfig{ip: "127.0.0.1", port: "9999", op: "PING"}, nil},
+		{ClientConfig{ip: "127.0.0.1", port: "9999", account: "test", op: "NOOP"}, fmt.Errorf("invalid operation: NOOP")},
+		{ClientConfig{ip: "127.0.0.1", port: "9999", op: "SERVER-STATS", token: "secret"}, nil},
+		{ClientConfig{ip: "127.0.0.1", port: "9999", account: "test", op: "READ"}, fmt.Errorf("missing file name")},
+		{ClientConfig{ip: "127.0.0.1", port: "9999", account: "test", op: "COPY", file: "a"}, fmt.Errorf("missing destination")},
+		{ClientConfig{ip: "127.0.0.1", port: "9999", account: "test", op: "RESTORE", file: "a"}, fmt.Errorf("missing version")},
+		{ClientConfig{ip: "127.0.0.1", port: "9999", account: "test", op: "SNAPSHOT"}, fmt.Errorf("missing snapshot name")},
+		{ClientConfig{ip: "127.0.0.1", port: "9999", account: "test", op: "GRANT", grantee: "b", access: "write"}, fmt.Errorf(`invalid access: "write"`)},
+		{ClientConfig{ip: "127.0.0.1", port: "9999", account: "test", op: "GRANT", grantee: "b", access: "read"}, nil},
+		{ClientConfig{ip: "127.0.0.1", port: "9999", op: "AUDIT", limit: "0"}, fmt.Errorf(`invalid limit: "0"`)},
+		{ClientConfig{ip: "127.0.0.1", port: "9999", op: "AUDIT", since: "yesterday"}, fmt.Errorf(`invalid since: "yesterday"`)},
 	}
 
 	for _, test := range tests {
 		result := validateConfig(&test.config)
 		if test.want == nil && result != nil {
-			t.Errorf("ValidateConfig(%q) = %v", test.config, result)
+			t.Errorf("ValidateConfig(%+v) = %v", test.config, result)
 		}
 
 		if test.want != nil {
-			if result.Error() != test.want.Error() {
-				t.Errorf("ValidateConfig(%q) = %v", test.config, result)
+			if result == nil || result.Error() != test.want.Error() {
+				t.Errorf("ValidateConfig(%+v) = %v", test.config, result)
 			}
 		}
 	}
@@ -0,0 +1,331 @@
+// Commands of the client
+//
+// Each command performs one operation, or runs the shell, and
+// has its own flags:
+//
+//	client [-debug] command [flags] [arguments]
+//
+// Commands taking files perform their operation once for each
+// file given, on a connection of its own.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Add flags of a command setting fields of the configuration
+type flagAdder func(fs *flag.FlagSet, config *ClientConfig)
+
+// Expand the arguments of a command into the configuration
+// of each operation to perform
+type argsExpander func(config ClientConfig, args []string) []ClientConfig
+
+// A command of the client
+type clientCommand struct {
+	// operation performed, empty for commands that run
+	// without a request of their own
+	op    string
+	usage string
+	help  string
+	// fewest and most arguments, a negative most is unlimited
+	minArgs int
+	maxArgs int
+	// how the arguments become operations, each argument is a
+	// file if nil
+	args  argsExpander
+	flags []flagAdder
+	// run the command instead of performing an operation
+	run func(config ClientConfig) error
+}
+
+var clientCommands map[string]clientCommand
+
+// name the client was started with, shown in usage messages
+var programName = filepath.Base(os.Args[0])
+
+func init() {
+	fileFlags := []flagAdder{ownerFlag}
+	clientCommands = map[string]clientCommand{
+		"put": {op: "WRITE", usage: "local...", help: "upload files, named after their local base name",
+			minArgs: 1, maxArgs: -1, flags: []flagAdder{ownerFlag, conditionFlags, truncateFlag}},
+		"get": {op: "READ", usage: "file...", help: "download files, replacing local files of the same name",
+			minArgs: 1, maxArgs: -1, flags: []flagAdder{ownerFlag, versionFlag, snapshotFlag}},
+		"ls": {op: "LIST", usage: "[dir...]", help: "list directories, the account if none is given",
+			minArgs: 0, maxArgs: -1, flags: []flagAdder{ownerFlag, snapshotFlag}},
+		"rm": {op: "DELETE", usage: "file...", help: "delete files, moving them to the trash",
+			minArgs: 1, maxArgs: -1, flags: []flagAdder{ownerFlag, conditionFlags}},
+		"stat": {op: "STAT", usage: "file...", help: "describe files or directories",
+			minArgs: 1, maxArgs: -1, flags: []flagAdder{ownerFlag, snapshotFlag}},
+		"mkdir": {op: "MKDIR", usage: "dir...", help: "create directories",
+			minArgs: 1, maxArgs: -1, flags: fileFlags},
+		"rmdir": {op: "RMDIR", usage: "dir...", help: "remove directories",
+			minArgs: 1, maxArgs: -1, flags: fileFlags},
+		"mv": {op: "MOVE", usage: "file destination", help: "move a file or directory",
+			minArgs: 2, maxArgs: 2, args: fileAndDestination, flags: fileFlags},
+		"cp": {op: "COPY", usage: "file destination", help: "copy a file or directory",
+			minArgs: 2, maxArgs: 2, args: fileAndDestination, flags: fileFlags},
+		"versions": {op: "VERSIONS", usage: "file...", help: "list the previous versions of files",
+			minArgs: 1, maxArgs: -1, flags: fileFlags},
+		"restore": {op: "RESTORE", usage: "file version", help: "restore a previous version of a file",
+			minArgs: 2, maxArgs: 2, args: fileAndVersion, flags: fileFlags},
+		"trash": {op: "TRASH", help: "list deleted files",
+			args: noArgs},
+		"undelete": {op: "UNDELETE", usage: "file...", help: "move deleted files out of the trash",
+			minArgs: 1, maxArgs: -1, flags: []flagAdder{trashIDFlag}},
+		"purge": {op: "PURGE", usage: "[file...]", help: "remove deleted files for good, the whole trash if none is given",
+			minArgs: 0, maxArgs: -1, flags: []flagAdder{trashIDFlag}},
+		"usage": {op: "USAGE", help: "show the storage used by the account and its quota",
+			args: noArgs},
+		"snapshot": {op: "SNAPSHOT", usage: "name", help: "copy the whole account into a snapshot, counted toward its quota",
+			minArgs: 1, maxArgs: 1, args: snapshotArg},
+		"snapshots": {op: "LIST-SNAPSHOTS", help: "list the snapshots of the account",
+			args: noArgs},
+		"restore-snapshot": {op: "RESTORE-SNAPSHOT", usage: "name", help: "restore the account to a snapshot",
+			minArgs: 1, maxArgs: 1, args: snapshotArg},
+		"rm-snapshot": {op: "DELETE-SNAPSHOT", usage: "name", help: "delete a snapshot",
+			minArgs: 1, maxArgs: 1, args: snapshotArg},
+		"grant": {op: "GRANT", usage: "[file...]", help: "share files, or the whole account, with another account",
+			minArgs: 0, maxArgs: -1, flags: []flagAdder{granteeFlag, accessFlag}},
+		"revoke": {op: "REVOKE", usage: "[file...]", help: "stop sharing files, or the whole account, with another account",
+			minArgs: 0, maxArgs: -1, flags: []flagAdder{granteeFlag}},
+		"grants": {op: "LIST-GRANTS", help: "list the grants given by the account",
+			args: noArgs},
+		"mkaccount": {op: "CREATE", help: "create the account",
+			args: noArgs},
+		"rmaccount": {op: "DELETE-ACCOUNT", help: "delete the account and everything it holds",
+			args: noArgs},
+		"mvaccount": {op: "RENAME-ACCOUNT", usage: "new-name", help: "rename the account",
+			minArgs: 1, maxArgs: 1, args: newNameArg},
+		"accounts": {op: "LIST-ACCOUNTS", help: "list the accounts",
+			args: noArgs},
+		"quota": {op: "SET-QUOTA", help: "set the quota of the account, the default quota if no limit is given",
+			args: noArgs, flags: []flagAdder{quotaFlags}},
+		"s3-key": {op: "S3-KEY", help: "create an S3 access key for the account",
+			args: noArgs},
+		"stats": {op: "SERVER-STATS", help: "show the statistics of the server",
+			args: noArgs},
+		"audit": {op: "AUDIT", help: "query the audit log",
+			args: noArgs, flags: []flagAdder{auditFlags}},
+		"gc": {op: "GC", help: "remove file contents no longer referenced",
+			args: noArgs},
+		"ping": {op: "PING", help: "check that the server is responding",
+			args: noArgs},
+		"shell": {help: "run commands from an interactive shell",
+			args: noArgs, flags: []flagAdder{ownerFlag, historyFlag}, run: startShell},
+	}
+}
+
+// Arguments naming a file and where to move or copy it
+func fileAndDestination(config ClientConfig, args []string) []ClientConfig {
+	config.file, config.destination = args[0], args[1]
+	return []ClientConfig{config}
+}
+
+// Arguments naming a file and the version to restore
+func fileAndVersion(config ClientConfig, args []string) []ClientConfig {
+	config.file, config.version = args[0], args[1]
+	return []ClientConfig{config}
+}
+
+func snapshotArg(config ClientConfig, args []string) []ClientConfig {
+	config.snapshot = args[0]
+	return []ClientConfig{config}
+}
+
+func newNameArg(config ClientConfig, args []string) []ClientConfig {
+	config.newName = args[0]
+	return []ClientConfig{config}
+}
+
+func noArgs(config ClientConfig, args []string) []ClientConfig {
+	return []ClientConfig{config}
+}
+
+// One operation for each file, or on no file if none is given
+func eachFile(config ClientConfig, args []string) []ClientConfig {
+	if len(args) == 0 {
+		return []ClientConfig{config}
+	}
+	configs := make([]ClientConfig, 0, len(args))
+	for _, file := range args {
+		config.file = file
+		configs = append(configs, config)
+	}
+	return configs
+}
+
+// Flags of every command
+func connectionFlags(fs *flag.FlagSet, config *ClientConfig) {
+	fs.StringVar(&config.ip, "address", defaultAddress, "address to connect to")
+	fs.StringVar(&config.port, "port", defaultPort, "port to connect to")
+	fs.StringVar(&config.account, "account", "", "account to access")
+	fs.StringVar(&config.token, "token", "", "administrator token")
+}
+
+func ownerFlag(fs *flag.FlagSet, config *ClientConfig) {
+	fs.StringVar(&config.owner, "owner", "", "account owning the files when using a grant")
+}
+
+func conditionFlags(fs *flag.FlagSet, config *ClientConfig) {
+	fs.StringVar(&config.ifMatch, "if-match", "", "only write or delete if the file has this version (* for any)")
+	fs.StringVar(&config.ifNoneMatch, "if-none-match", "", "only write or delete if the file does not have this version (* for none)")
+}
+
+func truncateFlag(fs *flag.FlagSet, config *ClientConfig) {
+	fs.BoolVar(&config.truncate, "truncate", false, "replace the contents of the files instead of appending to them")
+}
+
+func versionFlag(fs *flag.FlagSet, config *ClientConfig) {
+	fs.StringVar(&config.version, "version", "", "previous version to read")
+}
+
+func snapshotFlag(fs *flag.FlagSet, config *ClientConfig) {
+	fs.StringVar(&config.snapshot, "snapshot", "", "snapshot to browse instead of the current files")
+}
+
+func trashIDFlag(fs *flag.FlagSet, config *ClientConfig) {
+	fs.StringVar(&config.trashID, "trash-id", "", "deleted copy of the file to undelete or purge")
+}
+
+func granteeFlag(fs *flag.FlagSet, config *ClientConfig) {
+	fs.StringVar(&config.grantee, "grantee", "", "account to grant or revoke access")
+}
+
+func accessFlag(fs *flag.FlagSet, config *ClientConfig) {
+	fs.StringVar(&config.access, "access", "read", "access to grant: read or read-write")
+}
+
+func quotaFlags(fs *flag.FlagSet, config *ClientConfig) {
+	fs.StringVar(&config.maxBytes, "max-bytes", "", "byte quota to set for the account")
+	fs.StringVar(&config.maxFiles, "max-files", "", "file quota to set for the account")
+}
+
+func auditFlags(fs *flag.FlagSet, config *ClientConfig) {
+	fs.StringVar(&config.auditAccount, "audit-account", "", "account whose audit entries to query")
+	fs.StringVar(&config.auditOp, "audit-op", "", "operation whose audit entries to query")
+	fs.StringVar(&config.since, "since", "", "earliest audit entries to query (RFC 3339)")
+	fs.StringVar(&config.until, "until", "", "time before which to query audit entries (RFC 3339)")
+	fs.StringVar(&config.limit, "limit", "", "most recent audit entries to query")
+}
+
+func historyFlag(fs *flag.FlagSet, config *ClientConfig) {
+	fs.StringVar(&config.history, "history", defaultHistoryPath(), "file keeping the history of the shell (empty keeps none)")
+}
+
+// Run the interactive shell
+func startShell(config ClientConfig) error {
+	if config.account == "" {
+		return fmt.Errorf("invalid account name")
+	}
+	return runShell(config, config.history)
+}
+
+// Show the commands of the client
+func printUsage(out io.Writer) {
+	fmt.Fprintf(out, "usage: %s [-debug] command [flags] [arguments]\n\ncommands:\n", programName)
+	names := make([]string, 0, len(clientCommands))
+	for name := range clientCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-18s %s\n", name, clientCommands[name].help)
+	}
+	fmt.Fprintf(out, "\nRun %s command -h for the flags of a command.\n", programName)
+}
+
+// Parse the flags and arguments of a command into the
+// configuration of each operation it performs, checking each
+// with validateConfig
+//
+// Usage messages and flag errors are written to out.
+// flag.ErrHelp is returned if help was asked for
+func parseCommand(name string, args []string, out io.Writer) (clientCommand, []ClientConfig, error) {
+	command, ok := clientCommands[name]
+	if ok == false {
+		return clientCommand{}, nil, fmt.Errorf("unknown command %q, run %s -h for the commands", name, programName)
+	}
+
+	var config ClientConfig
+	fs := flag.NewFlagSet(programName+" "+name, flag.ContinueOnError)
+	fs.SetOutput(out)
+	connectionFlags(fs, &config)
+	for _, add := range command.flags {
+		add(fs, &config)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(out, "usage: %s %s [flags] %s\n\n%s\n\nflags:\n", programName, name, command.usage, command.help)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return clientCommand{}, nil, err
+	}
+
+	args = fs.Args()
+	if len(args) < command.minArgs || (command.maxArgs >= 0 && len(args) > command.maxArgs) {
+		fs.Usage()
+		return clientCommand{}, nil, fmt.Errorf("%s: wrong number of arguments", name)
+	}
+	if command.run != nil {
+		return command, []ClientConfig{config}, nil
+	}
+
+	config.op = command.op
+	expand := command.args
+	if expand == nil {
+		expand = eachFile
+	}
+	configs := expand(config, args)
+	for i := range configs {
+		if err := validateConfig(&configs[i]); err != nil {
+			return clientCommand{}, nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return command, configs, nil
+}
+
+// Run a command, returning the exit status of the client
+func runCommand(name string, args []string) int {
+	if name == "help" {
+		if len(args) == 0 {
+			printUsage(os.Stdout)
+			return 0
+		}
+		name, args = args[0], []string{"-h"}
+	}
+
+	command, configs, err := parseCommand(name, args, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if command.run != nil {
+		if err := command.run(configs[0]); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			return 1
+		}
+		return 0
+	}
+
+	cli := startClient(configs[0].ip, configs[0].port)
+	for _, config := range configs {
+		if err := performOperation(config, cli); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+			cli.failed.Store(true)
+		}
+	}
+	cli.wg.Wait()
+	if cli.failed.Load() == true {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	var tests = []struct {
+		name  string
+		args  []string
+		ops   string
+		files string
+		err   string
+	}{
+		{"put", []string{"-account", "a", "-truncate", "x.txt", "dir/y.txt"}, "WRITE,WRITE", "x.txt,dir/y.txt", ""},
+		{"get", []string{"-account", "a", "x.txt"}, "READ", "x.txt", ""},
+		{"ls", []string{"-account", "a"}, "LIST", "", ""},
+		{"ls", []string{"-account", "a", "one", "two"}, "LIST,LIST", "one,two", ""},
+		{"mv", []string{"-account", "a", "x.txt", "y.txt"}, "MOVE", "x.txt", ""},
+		{"mkaccount", []string{"-account", "a"}, "CREATE", "", ""},
+		{"ping", nil, "PING", "", ""},
+		{"accounts", []string{"-token", "secret"}, "LIST-ACCOUNTS", "", ""},
+		{"noop", []string{"-account", "a"}, "", "", `unknown command "noop"`},
+		{"put", []string{"-account", "a"}, "", "", "put: wrong number of arguments"},
+		{"mv", []string{"-account", "a", "x.txt"}, "", "", "mv: wrong number of arguments"},
+		{"rm", []string{"x.txt"}, "", "", "rm: invalid account name"},
+		{"grant", []string{"-account", "a", "x.txt"}, "", "", "grant: missing grantee"},
+		{"quota", []string{"-account", "a", "-max-files", "-1"}, "", "", `quota: invalid max-files: "-1"`},
+		{"get", []string{"-account", "a", "-bogus", "x.txt"}, "", "", "flag provided but not defined: -bogus"},
+	}
+
+	for _, test := range tests {
+		_, configs, err := parseCommand(test.name, test.args, io.Discard)
+		if test.err != "" {
+			if err == nil || strings.Contains(err.Error(), test.err) == false {
+				t.Errorf("parseCommand(%s, %v) = %v, expected %q", test.name, test.args, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseCommand(%s, %v) = %v", test.name, test.args, err)
+			continue
+		}
+		var ops, files []string
+		for _, config := range configs {
+			ops = append(ops, config.op)
+			files = append(files, config.file)
+		}
+		if strings.Join(ops, ",") != test.ops || strings.Join(files, ",") != test.files {
+			t.Errorf("parseCommand(%s, %v) = %v on %v, expected %s on %s", test.name, test.args, ops, files, test.ops, test.files)
+		}
+	}
+
+	_, configs, _ := parseCommand("mv", []string{"-account", "a", "-owner", "b", "x.txt", "y.txt"}, io.Discard)
+	if len(configs) != 1 || configs[0].destination != "y.txt" || configs[0].owner != "b" {
+		t.Errorf("parseCommand(mv) = %+v", configs)
+	}
+	if _, _, err := parseCommand("put", []string{"-h"}, io.Discard); errors.Is(err, flag.ErrHelp) == false {
+		t.Errorf("parseCommand(put -h) = %v", err)
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	address, requests := fakeServer(t, map[string]string{"kept.txt": "kept"})
+	host, port, _ := net.SplitHostPort(address)
+	dir := t.TempDir()
+	var locals []string
+	for _, name := range []string{"one.txt", "two.txt"} {
+		local := filepath.Join(dir, name)
+		os.WriteFile(local, []byte(name), 0644)
+		locals = append(locals, local)
+	}
+	connection := []string{"-address", host, "-port", port, "-account", "cli"}
+
+	if status := runCommand("put", append(connection, locals...)); status != 0 {
+		t.Errorf("put exited with %d", status)
+	}
+	// get writes to the working directory, replacing what is there
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	for i := 0; i < 2; i++ {
+		if status := runCommand("get", append(connection, "kept.txt")); status != 0 {
+			t.Errorf("get exited with %d", status)
+		}
+	}
+	os.Chdir(wd)
+	if contents, err := os.ReadFile(filepath.Join(dir, "kept.txt")); err != nil || string(contents) != "kept" {
+		t.Errorf("get twice wrote %q, %v", contents, err)
+	}
+	if status := runCommand("rm", append(connection, "kept.txt", "missing.txt")); status != 1 {
+		t.Errorf("rm of a missing file exited with %d", status)
+	}
+	if status := runCommand("put", append(connection, filepath.Join(dir, "absent.txt"))); status != 1 {
+		t.Errorf("put of a missing local file exited with %d", status)
+	}
+	if status := runCommand("rm", connection); status != 2 {
+		t.Errorf("rm without files exited with %d", status)
+	}
+
+	var sent []string
+	for _, header := range *requests {
+		sent = append(sent, header.Operation+" "+header.FileName)
+	}
+	if strings.Join(sent, ",") != "WRITE one.txt,WRITE two.txt,READ kept.txt,READ kept.txt,DELETE kept.txt,DELETE missing.txt" {
+		t.Errorf("requests = %v", sent)
+	}
+}
@@ -0,0 +1,479 @@
+// Interactive shell
+//
+// The shell holds a session across commands: the server,
+// account, owner and token given by flags, a working
+// directory within the account and the command history. The
+// server answers one request per connection, so each command
+// connects again. Directories listed to complete a line are
+// kept until the next command runs, so repeated completions
+// do not list them again. File names containing spaces are
+// listed but cannot be typed.
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+// lines of history kept in the history file
+const maxHistory int = 1000
+
+// A command of the shell
+type shellCommand struct {
+	usage string
+	help  string
+	run   func(s *shell, args []string) error
+	// complete the arguments with local rather than remote
+	// file names
+	local bool
+}
+
+var shellCommands map[string]shellCommand
+
+func init() {
+	shellCommands = map[string]shellCommand{
+		"ls":      {"ls [dir]", "list a directory", (*shell).list, false},
+		"cd":      {"cd [dir]", "change the working directory, to the account if none is given", (*shell).changeDir, false},
+		"pwd":     {"pwd", "show the working directory", (*shell).printDir, false},
+		"get":     {"get file [local]", "download a file", (*shell).get, false},
+		"put":     {"put local [file]", "upload a file, replacing it", (*shell).put, true},
+		"rm":      {"rm file...", "delete files", (*shell).remove, false},
+		"stat":    {"stat file...", "describe files", (*shell).stat, false},
+		"mkdir":   {"mkdir dir", "create a directory", (*shell).makeDir, false},
+		"history": {"history", "show the commands entered", (*shell).printHistory, false},
+		"help":    {"help", "show the commands", (*shell).help, false},
+		"exit":    {"exit", "leave the shell", nil, false},
+	}
+}
+
+// State of an interactive session
+type shell struct {
+	config ClientConfig
+	// working directory within the account, "" at its root
+	cwd         string
+	editor      *lineEditor
+	out         io.Writer
+	historyPath string
+	// names in the directories listed for completion since
+	// the last command
+	listings map[string][]string
+}
+
+func newShell(config ClientConfig, in io.Reader, out io.Writer) *shell {
+	s := &shell{config: config, out: out}
+	s.editor = newLineEditor(in, out, s.completeLine)
+	return s
+}
+
+// Path of a file named in a command within the account
+func (s *shell) resolve(name string) string {
+	if path.IsAbs(name) == false {
+		name = path.Join("/", s.cwd, name)
+	}
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// Send a request to the server and read its response,
+// returning ERROR responses as errors
+func (s *shell) request(op string, fileName string, params url.Values, dataList *list.List) (common.ResponseData, error) {
+	conn, err := connect(s.config.ip, s.config.port)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	defer conn.Close()
+
+	header := common.Header{Operation: op, Info: s.config.account, FileName: fileName, Params: requestParams(s.config)}
+	for key, values := range params {
+		header.Params[key] = values
+	}
+	if dataList != nil {
+		for iter := dataList.Front(); iter != nil; iter = iter.Next() {
+			header.Size += uint64(iter.Value.(common.Data).Size)
+		}
+	}
+	if err := sendMessage(common.ClientData{Header: header, DataList: dataList, Conn: conn}); err != nil {
+		return common.ResponseData{}, err
+	}
+	response, err := readResponse(conn)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	if response.Header.Operation == "ERROR" {
+		if code := response.Header.Params.Get(common.ParamCode); code != "" {
+			return common.ResponseData{}, fmt.Errorf("%s (%s)", response.Header.Info, code)
+		}
+		return common.ResponseData{}, errors.New(response.Header.Info)
+	}
+	return response, nil
+}
+
+// Names in a directory of the account
+func (s *shell) remoteNames(dir string) ([]string, error) {
+	response, err := s.request("LIST", s.resolve(dir), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, name := range strings.Split(string(common.JoinDataList(response.DataList)), "\n") {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Names in a directory of the account for completion, listing
+// each directory once between commands
+func (s *shell) completionNames(dir string) ([]string, error) {
+	resolved := s.resolve(dir)
+	names, ok := s.listings[resolved]
+	if ok == false {
+		var err error
+		if names, err = s.remoteNames(dir); err != nil {
+			return nil, err
+		}
+		if s.listings == nil {
+			s.listings = make(map[string][]string)
+		}
+		s.listings[resolved] = names
+	}
+	return append([]string(nil), names...), nil
+}
+
+// Whether a file of the account is a directory
+func (s *shell) isRemoteDir(name string) bool {
+	response, err := s.request("STAT", s.resolve(name), nil, nil)
+	return err == nil && response.Header.Params.Get(common.ParamType) == common.TypeDirectory
+}
+
+// Run commands until exit or the end of the input
+func (s *shell) run() error {
+	s.loadHistory()
+	for {
+		line, err := s.editor.readLine(fmt.Sprintf("%s:/%s> ", s.config.account, s.cwd))
+		if errors.Is(err, errInterrupted) {
+			continue
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.editor.remember(line)
+		s.saveHistory(line)
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		command, ok := shellCommands[fields[0]]
+		switch {
+		case fields[0] == "exit" || fields[0] == "quit":
+			return nil
+		case ok == false:
+			fmt.Fprintf(s.out, "unknown command %q, try help\n", fields[0])
+		default:
+			// the command may change the directories listed
+			s.listings = nil
+			if err := command.run(s, fields[1:]); err != nil {
+				fmt.Fprintf(s.out, "%s: %v\n", fields[0], err)
+			}
+		}
+	}
+}
+
+// Read the history file into the history of the editor
+func (s *shell) loadHistory() {
+	if s.historyPath == "" {
+		return
+	}
+	file, err := os.Open(s.historyPath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		s.editor.remember(scanner.Text())
+	}
+	if len(s.editor.history) > maxHistory {
+		s.editor.history = s.editor.history[len(s.editor.history)-maxHistory:]
+	}
+}
+
+// Append a line to the history file
+func (s *shell) saveHistory(line string) {
+	if s.historyPath == "" || strings.TrimSpace(line) == "" {
+		return
+	}
+	file, err := os.OpenFile(s.historyPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, os.FileMode(0600))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	fmt.Fprintln(file, line)
+}
+
+// Longest prefix shared by a list of names
+func commonPrefix(names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	prefix := names[0]
+	for _, name := range names[1:] {
+		for strings.HasPrefix(name, prefix) == false {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// Complete the command name, or the file name being typed,
+// of a line
+func (s *shell) completeLine(line string) (string, []string) {
+	start := strings.LastIndex(line, " ") + 1
+	word := line[start:]
+
+	var names []string
+	var isDir func(string) bool
+	if start == 0 {
+		for name := range shellCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		isDir = func(string) bool { return false }
+	} else {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			return line, nil
+		}
+		command, ok := shellCommands[fields[0]]
+		if ok == false {
+			return line, nil
+		}
+		dir, _ := path.Split(word)
+		// put takes a local file as its first argument
+		if command.local == true && len(strings.Fields(line[:start])) == 1 {
+			names = localNames(dir)
+			isDir = func(name string) bool {
+				info, err := os.Stat(filepath.FromSlash(name))
+				return err == nil && info.IsDir()
+			}
+		} else {
+			remote, err := s.completionNames(dir)
+			if err != nil {
+				return line, nil
+			}
+			names = remote
+			isDir = s.isRemoteDir
+		}
+		for i := range names {
+			names[i] = dir + names[i]
+		}
+	}
+
+	var matches []string
+	for _, name := range names {
+		if strings.HasPrefix(name, word) {
+			matches = append(matches, name)
+		}
+	}
+	if len(matches) == 0 {
+		return line, nil
+	}
+	completed := line[:start] + commonPrefix(matches)
+	if len(matches) == 1 {
+		if isDir(matches[0]) {
+			return completed + "/", nil
+		}
+		return completed + " ", nil
+	}
+	if len(completed) > len(line) {
+		return completed, nil
+	}
+	return completed, matches
+}
+
+// Names in a local directory
+func localNames(dir string) []string {
+	local := dir
+	if local == "" {
+		local = "."
+	}
+	entries, err := os.ReadDir(filepath.FromSlash(local))
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func (s *shell) list(args []string) error {
+	dir := ""
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	names, err := s.remoteNames(dir)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Fprintln(s.out, name)
+	}
+	return nil
+}
+
+func (s *shell) changeDir(args []string) error {
+	if len(args) == 0 {
+		s.cwd = ""
+		return nil
+	}
+	dir := s.resolve(args[0])
+	if dir != "" && s.isRemoteDir(args[0]) == false {
+		return fmt.Errorf("%s is not a directory", args[0])
+	}
+	s.cwd = dir
+	return nil
+}
+
+func (s *shell) printDir(args []string) error {
+	fmt.Fprintf(s.out, "/%s\n", s.cwd)
+	return nil
+}
+
+func (s *shell) get(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("usage: %s", shellCommands["get"].usage)
+	}
+	local := path.Base(args[0])
+	if len(args) == 2 {
+		local = args[1]
+	}
+	response, err := s.request("READ", s.resolve(args[0]), nil, nil)
+	if err != nil {
+		return err
+	}
+	flags := os.O_TRUNC | os.O_WRONLY | os.O_CREATE
+	if err := common.WriteFile(local, flags, os.FileMode(0644), response.DataList); err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "%s: %d bytes\n", local, response.Header.Size)
+	return nil
+}
+
+func (s *shell) put(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("usage: %s", shellCommands["put"].usage)
+	}
+	remote := filepath.Base(args[0])
+	if len(args) == 2 {
+		remote = args[1]
+	}
+	dataList := list.New()
+	size, err := common.ReadFile(args[0], os.O_RDONLY, os.FileMode(0644), dataList)
+	if err != nil {
+		return err
+	}
+	params := url.Values{common.ParamTruncate: {"true"}}
+	if _, err := s.request("WRITE", s.resolve(remote), params, dataList); err != nil {
+		return err
+	}
+	fmt.Fprintf(s.out, "%s: %d bytes\n", s.resolve(remote), size)
+	return nil
+}
+
+func (s *shell) remove(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s", shellCommands["rm"].usage)
+	}
+	for _, name := range args {
+		if _, err := s.request("DELETE", s.resolve(name), nil, nil); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (s *shell) stat(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: %s", shellCommands["stat"].usage)
+	}
+	for _, name := range args {
+		response, err := s.request("STAT", s.resolve(name), nil, nil)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		params := response.Header.Params
+		fmt.Fprintf(s.out, "%s: %s, size %s, modified %s, version %s\n", name,
+			params.Get(common.ParamType),
+			params.Get(common.ParamSize),
+			params.Get(common.ParamModTime),
+			params.Get(common.ParamVersion))
+	}
+	return nil
+}
+
+func (s *shell) makeDir(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: %s", shellCommands["mkdir"].usage)
+	}
+	_, err := s.request("MKDIR", s.resolve(args[0]), nil, nil)
+	return err
+}
+
+func (s *shell) printHistory(args []string) error {
+	for i, line := range s.editor.history {
+		fmt.Fprintf(s.out, "%5d  %s\n", i+1, line)
+	}
+	return nil
+}
+
+func (s *shell) help(args []string) error {
+	var names []string
+	for name := range shellCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(s.out, "  %-18s %s\n", shellCommands[name].usage, shellCommands[name].help)
+	}
+	return nil
+}
+
+// Run the shell on stdin and stdout, editing lines on a
+// terminal
+func runShell(config ClientConfig, historyPath string) error {
+	s := newShell(config, os.Stdin, os.Stdout)
+	s.historyPath = historyPath
+	if restore, err := enterRawMode(); err == nil {
+		defer restore()
+		s.editor.raw = true
+	}
+	return s.run()
+}
+
+// History file in the home directory, or none if there is no
+// home directory
+func defaultHistoryPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".go_ftp_history")
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"container/list"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+// Server answering requests from a fixed tree of files, with
+// directories ending in a slash
+func fakeServer(t *testing.T, files map[string]string) (string, *[]common.Header) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen = %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var requests []common.Header
+
+	answer := func(conn net.Conn) {
+		defer conn.Close()
+		header, err := common.ReadHeader(conn)
+		if err != nil {
+			return
+		}
+		body := list.New()
+		common.ReadMessage(body, header.Size, conn)
+		requests = append(requests, header)
+
+		res := common.Header{Operation: header.Operation, Info: "ok", FileName: header.FileName, Params: url.Values{}}
+		data := list.New()
+		contents, isFile := files[header.FileName]
+		_, isDir := files[header.FileName+"/"]
+		switch {
+		case header.Operation == "LIST":
+			prefix := header.FileName + "/"
+			if header.FileName == "" {
+				prefix = ""
+			}
+			for name := range files {
+				rest, ok := strings.CutPrefix(name, prefix)
+				if ok && rest != "" && strings.Contains(strings.TrimSuffix(rest, "/"), "/") == false {
+					rest = strings.TrimSuffix(rest, "/") + "\n"
+					data.PushBack(common.Data{Size: len(rest), Buffer: []byte(rest)})
+				}
+			}
+		case header.Operation == "STAT" && isDir:
+			res.Params.Set(common.ParamType, common.TypeDirectory)
+		case header.Operation == "STAT" && isFile:
+			res.Params.Set(common.ParamType, common.TypeFile)
+		case header.Operation == "READ" && isFile:
+			data.PushBack(common.Data{Size: len(contents), Buffer: []byte(contents)})
+		case header.Operation == "WRITE", header.Operation == "DELETE" && isFile:
+		default:
+			res = common.Header{Operation: "ERROR", Info: "no such file", Params: url.Values{common.ParamCode: {common.CodeNotFound}}}
+		}
+		res.Size = uint64(len(common.JoinDataList(data)))
+		common.SendMessage(common.SerializeHeader(res), data, conn)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			answer(conn)
+		}
+	}()
+	return listener.Addr().String(), &requests
+}
+
+func TestShell(t *testing.T) {
+	address, requests := fakeServer(t, map[string]string{
+		"notes/":        "",
+		"notes/a.txt":   "alpha",
+		"notes/ab.txt":  "alphabet",
+		"photos/":       "",
+		"readme.md":     "read me",
+		"notes/deeper/": "",
+		"notes/to do":   "",
+	})
+	host, port, _ := net.SplitHostPort(address)
+	dir := t.TempDir()
+	local := filepath.Join(dir, "upload.txt")
+	os.WriteFile(local, []byte("upload"), 0644)
+
+	input := strings.Join([]string{
+		"cd notes",
+		"pwd",
+		"ls",
+		"get a.txt " + filepath.Join(dir, "a.txt"),
+		"cd readme.md",
+		"cd ..",
+		"put " + local + " notes/up.txt",
+		"rm notes/a.txt missing.txt",
+		"bogus",
+		"exit",
+		"ls",
+	}, "\n")
+	var out strings.Builder
+	s := newShell(ClientConfig{ip: host, port: port, account: "shell"}, strings.NewReader(input), &out)
+	s.historyPath = filepath.Join(dir, "history")
+	if err := s.run(); err != nil {
+		t.Fatalf("run = %v", err)
+	}
+
+	for _, want := range []string{
+		"/notes\n",
+		"a.txt\nab.txt\ndeeper\nto do\n",
+		"cd: readme.md is not a directory",
+		"notes/up.txt: 6 bytes",
+		"rm: missing.txt: no such file (not-found)",
+		`unknown command "bogus"`,
+	} {
+		if strings.Contains(out.String(), want) == false {
+			t.Errorf("output %q lacks %q", out.String(), want)
+		}
+	}
+	if contents, err := os.ReadFile(filepath.Join(dir, "a.txt")); err != nil || string(contents) != "alpha" {
+		t.Errorf("get wrote %q, %v", contents, err)
+	}
+	var ops []string
+	for _, header := range *requests {
+		ops = append(ops, header.Operation+" "+header.FileName)
+		if header.Info != "shell" {
+			t.Errorf("%s sent for account %q", header.Operation, header.Info)
+		}
+	}
+	if strings.Contains(strings.Join(ops, ","), "WRITE notes/up.txt,DELETE notes/a.txt,DELETE missing.txt") == false {
+		t.Errorf("requests = %v", ops)
+	}
+	if history, _ := os.ReadFile(s.historyPath); strings.Count(string(history), "\n") != 10 {
+		t.Errorf("history file = %q", history)
+	}
+
+	listed := len(*requests)
+	var completions = []struct {
+		line       string
+		want       string
+		candidates int
+	}{
+		{"st", "stat ", 0},
+		{"cd no", "cd notes/", 0},
+		{"get notes/a", "get notes/a", 2},
+		{"get notes/ab", "get notes/ab.txt ", 0},
+		{"get notes/d", "get notes/deeper/", 0},
+		{"ls x", "ls x", 0},
+		{"put " + filepath.Join(dir, "up"), "put " + local + " ", 0},
+	}
+	for _, test := range completions {
+		got, candidates := s.completeLine(test.line)
+		if got != test.want || len(candidates) != test.candidates {
+			t.Errorf("completeLine(%q) = %q, %v, expected %q with %d candidates",
+				test.line, got, candidates, test.want, test.candidates)
+		}
+	}
+	// each directory is listed once until the next command
+	var lists []string
+	for _, header := range (*requests)[listed:] {
+		if header.Operation == "LIST" {
+			lists = append(lists, header.FileName)
+		}
+	}
+	if strings.Join(lists, ",") != ",notes" {
+		t.Errorf("completion listed %q", lists)
+	}
+}
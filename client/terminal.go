@@ -0,0 +1,163 @@
+// Line editing for the interactive shell
+//
+// The terminal is put in character mode with stty so that
+// tab completion and history work without a readline library.
+// When stdin is not a terminal lines are read as they come.
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// errInterrupted is returned when the line being edited is
+// abandoned with ctrl-c
+var errInterrupted = errors.New("interrupted")
+
+// Complete the line being edited, returning the completed
+// line and, if it is ambiguous, the candidates to show
+type completer func(line string) (string, []string)
+
+// Editor of the lines read by the shell
+type lineEditor struct {
+	in  *bufio.Reader
+	out io.Writer
+	// whether the input is a terminal in character mode
+	raw      bool
+	history  []string
+	complete completer
+}
+
+func newLineEditor(in io.Reader, out io.Writer, complete completer) *lineEditor {
+	return &lineEditor{in: bufio.NewReader(in), out: out, complete: complete}
+}
+
+// Run stty on the terminal of stdin
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// Put the terminal of stdin in character mode without echo,
+// returning a function restoring its previous mode
+func enterRawMode() (func(), error) {
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return nil, fmt.Errorf("stdin is not a terminal")
+	}
+	state, err := stty("-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty("-icanon", "-echo", "-isig", "min", "1"); err != nil {
+		return nil, err
+	}
+	return func() { stty(state) }, nil
+}
+
+// Add a line to the history, skipping blank lines and
+// repeats of the previous line
+func (e *lineEditor) remember(line string) {
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	if len(e.history) > 0 && e.history[len(e.history)-1] == line {
+		return
+	}
+	e.history = append(e.history, line)
+}
+
+// Read a line after showing the prompt
+//
+// io.EOF is returned at the end of the input, or for ctrl-d
+// on an empty line
+func (e *lineEditor) readLine(prompt string) (string, error) {
+	fmt.Fprint(e.out, prompt)
+	if e.raw == false {
+		line, err := e.in.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	var line []rune
+	// position in the history, len(history) is the new line
+	entry := len(e.history)
+	redraw := func() {
+		fmt.Fprintf(e.out, "\r\x1b[K%s%s", prompt, string(line))
+	}
+	for {
+		r, _, err := e.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(e.out, "\r\n")
+			return string(line), nil
+		case 0x03: // ctrl-c
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case 0x04: // ctrl-d
+			if len(line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+		case 0x15: // ctrl-u
+			line = line[:0]
+			redraw()
+		case 0x7f, 0x08: // backspace
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				fmt.Fprint(e.out, "\b \b")
+			}
+		case '\t':
+			if e.complete == nil {
+				continue
+			}
+			completed, candidates := e.complete(string(line))
+			line = []rune(completed)
+			if len(candidates) > 0 {
+				fmt.Fprintf(e.out, "\r\n%s\r\n", strings.Join(candidates, "  "))
+			}
+			redraw()
+		case 0x1b: // escape sequence
+			if next, _, err := e.in.ReadRune(); err != nil || next != '[' {
+				continue
+			}
+			key, _, err := e.in.ReadRune()
+			if err != nil {
+				return "", err
+			}
+			switch {
+			case key == 'A' && entry > 0:
+				entry--
+			case key == 'B' && entry < len(e.history):
+				entry++
+			default:
+				continue
+			}
+			line = nil
+			if entry < len(e.history) {
+				line = []rune(e.history[entry])
+			}
+			redraw()
+		default:
+			if r >= 0x20 {
+				line = append(line, r)
+				fmt.Fprint(e.out, string(r))
+			}
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestLineEditor(t *testing.T) {
+	complete := func(line string) (string, []string) {
+		if line == "st" {
+			return "stat ", nil
+		}
+		return line, []string{"a", "b"}
+	}
+	input := "ls\r" + // plain line
+		"st\tx.txtt\x7f\r" + // completion and backspace
+		"\x1b[A\x1b[A\r" + // history
+		"junk\x15pwd\r" + // ctrl-u
+		"half\x03" + // ctrl-c
+		"\x04" // ctrl-d
+	var out strings.Builder
+	editor := newLineEditor(strings.NewReader(input), &out, complete)
+	editor.raw = true
+
+	for _, want := range []string{"ls", "stat x.txt", "ls", "pwd"} {
+		line, err := editor.readLine("> ")
+		if err != nil || line != want {
+			t.Errorf("readLine = %q, %v, expected %q", line, err, want)
+		}
+		editor.remember(line)
+	}
+	if _, err := editor.readLine("> "); errors.Is(err, errInterrupted) == false {
+		t.Errorf("readLine after ctrl-c = %v", err)
+	}
+	if _, err := editor.readLine("> "); err != io.EOF {
+		t.Errorf("readLine after ctrl-d = %v", err)
+	}
+	if strings.Join(editor.history, ",") != "ls,stat x.txt,ls,pwd" {
+		t.Errorf("history = %q", editor.history)
+	}
+}
+
+func TestLineEditorCooked(t *testing.T) {
+	editor := newLineEditor(strings.NewReader("ls\r\nstat a.txt"), io.Discard, nil)
+	for _, want := range []string{"ls", "stat a.txt"} {
+		if line, err := editor.readLine("> "); err != nil || line != want {
+			t.Errorf("readLine = %q, %v, expected %q", line, err, want)
+		}
+	}
+	if _, err := editor.readLine("> "); err != io.EOF {
+		t.Errorf("readLine at the end of the input = %v", err)
+	}
+}
@@ -4,24 +4,29 @@
 package common
 
 import (
-	"bufio"
 	"container/list"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 )
 
+// MaxHeaderSize is the longest header line accepted
+const MaxHeaderSize int = 64 * 1024
+
 // Header information describing client data
 type Header struct {
 	Operation string
 	Info      string
 	FileName  string
 	Size      uint64
+	Params    url.Values
 }
 
 type Data struct {
@@ -44,32 +49,213 @@ type ResponseData struct {
 }
 
 const (
-	headerFields         int = 4
-	responseHeaderFields int = 4
+	headerFields         int = 5
+	responseHeaderFields int = 5
+)
+
+// Header parameter names
+const (
+	// ParamIfMatch makes a request conditional on the file
+	// having the given version ("*" matches any version)
+	ParamIfMatch string = "if-match"
+	// ParamIfNoneMatch makes a request conditional on the file
+	// not having the given version ("*" requires no file)
+	ParamIfNoneMatch string = "if-none-match"
+	// ParamVersion carries the version of a file in a response,
+	// or selects a previous version in READ and RESTORE requests
+	ParamVersion string = "version"
+	// ParamTruncate makes a WRITE replace the contents of the
+	// file instead of appending to them
+	ParamTruncate string = "truncate"
+	// ParamSize carries the size of a file in a STAT response
+	ParamSize string = "size"
+	// ParamType carries whether a STAT response describes a
+	// file or a directory
+	ParamType string = "type"
+	// ParamDestination names the new path of a file in MOVE
+	// and COPY requests
+	ParamDestination string = "destination"
+	// ParamModTime carries the modification time of a file
+	// in a STAT response
+	ParamModTime string = "mtime"
+	// ParamTrashID selects a deleted copy of a file in
+	// UNDELETE and PURGE requests
+	ParamTrashID string = "trash-id"
+	// ParamBytes and ParamFiles carry the storage used by
+	// an account in a USAGE response
+	ParamBytes string = "bytes"
+	ParamFiles string = "files"
+	// ParamMaxBytes and ParamMaxFiles carry the quota of
+	// an account in USAGE and SET-QUOTA requests and responses
+	ParamMaxBytes string = "max-bytes"
+	ParamMaxFiles string = "max-files"
+	// ParamBlobs, ParamReferences, ParamRemoved and ParamFreed
+	// carry the results of a GC request
+	ParamBlobs      string = "blobs"
+	ParamReferences string = "references"
+	ParamRemoved    string = "removed"
+	ParamFreed      string = "freed"
+	// ParamSnapshot names the snapshot of an account to
+	// create, browse, restore or delete
+	ParamSnapshot string = "snapshot"
+	// ParamNewName carries the new name of an account
+	// in a RENAME-ACCOUNT request
+	ParamNewName string = "new-name"
+	// ParamToken carries the administrator token
+	ParamToken string = "token"
+	// ParamOwner names the account owning the file of a
+	// request made through a grant
+	ParamOwner string = "owner"
+	// ParamGrantee and ParamAccess name the account given
+	// access and the access given in GRANT and REVOKE requests
+	ParamGrantee string = "grantee"
+	ParamAccess  string = "access"
+	// Server state carried in a SERVER-STATS response
+	ParamUptime      string = "uptime"
+	ParamGoroutines  string = "goroutines"
+	ParamAccounts    string = "accounts"
+	ParamHandleQueue string = "handle-queue"
+	ParamIOQueue     string = "io-queue"
+	ParamRespQueue   string = "resp-queue"
+	ParamConnWorkers string = "conn-workers"
+	ParamIOWorkers   string = "io-workers"
+	ParamRespWorkers string = "resp-workers"
+	ParamDedup       string = "dedup"
+	ParamConnections string = "connections"
+	ParamRejected    string = "rejected"
+	ParamTimeouts    string = "timeouts"
+	// ParamAuditAccount, ParamAuditOp, ParamSince, ParamUntil
+	// and ParamLimit select the entries of an AUDIT query
+	ParamAuditAccount string = "audit-account"
+	ParamAuditOp      string = "audit-op"
+	ParamSince        string = "since"
+	ParamUntil        string = "until"
+	ParamLimit        string = "limit"
+	// ParamAccessKey and ParamSecretKey carry the S3 access
+	// key of an account in an S3-KEY response
+	ParamAccessKey string = "access-key"
+	ParamSecretKey string = "secret-key"
+	// ParamCode carries the error code of an ERROR response
+	ParamCode string = "code"
+	// ParamRetryAfter carries how long a throttled client
+	// should wait before retrying
+	ParamRetryAfter string = "retry-after"
+)
+
+// File types carried by the type parameter
+const (
+	TypeFile      string = "file"
+	TypeDirectory string = "directory"
+)
+
+// Access given to another account by the access parameter
+const (
+	AccessRead      string = "read"
+	AccessReadWrite string = "read-write"
+)
+
+// Error codes sent with ERROR responses
+const (
+	CodePreconditionFailed string = "precondition-failed"
+	CodeNotFound           string = "not-found"
+	CodeExists             string = "exists"
+	CodeQuotaExceeded      string = "quota-exceeded"
+	CodeReadOnly           string = "read-only"
+	CodePermissionDenied   string = "permission-denied"
+	CodeThrottled          string = "throttled"
+	CodeBusy               string = "busy"
+	CodeTimeout            string = "timeout"
+	CodeTooLarge           string = "too-large"
 )
 
-var isDebug bool
+var (
+	isDebug   bool
+	logLevel  string = "info"
+	logFormat string = "text"
+
+	// structured logger installed by SetupLogging
+	logger *slog.Logger
+)
 
 func AddCommonFlags() {
 	flag.BoolVar(&isDebug, "debug", false, "turn on debug messages")
 }
 
-func DebugLog(format string, v ...interface{}) {
+// AddLoggingFlags adds the flags selecting the level and
+// format of structured logs
+func AddLoggingFlags() {
+	flag.StringVar(&logLevel, "log-level", logLevel, "minimum level of logged messages: debug, info, warn or error")
+	flag.StringVar(&logFormat, "log-format", logFormat, "format of logged messages: text or json")
+}
+
+// SetupLogging installs a structured logger writing to w as
+// the default logger, configured by the logging flags
+//
+// The debug flag lowers the level to debug
+func SetupLogging(w io.Writer) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		return fmt.Errorf("invalid log level: %q", logLevel)
+	}
 	if isDebug == true {
-		log.Printf(format, v...)
+		level = slog.LevelDebug
 	}
+
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch logFormat {
+	case "text":
+		handler = slog.NewTextHandler(w, options)
+	case "json":
+		handler = slog.NewJSONHandler(w, options)
+	default:
+		return fmt.Errorf("invalid log format: %q", logFormat)
+	}
+
+	logger = slog.New(handler)
+	slog.SetDefault(logger)
+	return nil
 }
 
+// DebugLog logs a formatted message at debug level
+//
+// Without a structured logger the message is written with
+// the log package if the debug flag is set
+func DebugLog(format string, v ...interface{}) {
+	if logger == nil {
+		if isDebug == true {
+			log.Printf(format, v...)
+		}
+		return
+	}
+	logger.Debug(strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"))
+}
+
+// Escaping of the header delimiters within text fields,
+// such as error messages carried in the info field
+var (
+	fieldEscaper   = strings.NewReplacer("%", "%25", ":", "%3A", "\n", "%0A")
+	fieldUnescaper = strings.NewReplacer("%25", "%", "%3A", ":", "%0A", "\n")
+)
+
 // Serialize a header into a byte sequence
 func SerializeHeader(header Header) []byte {
 	DebugLog("Serializing Header: %v\n", header)
 	DebugLog("Serializing size: %d", header.Size)
 	sizeStr := strconv.FormatUint(header.Size, 10)
-	s := strings.Join([]string{header.Operation, header.Info, header.FileName, sizeStr}, ":")
+	paramStr := header.Params.Encode()
+	s := strings.Join([]string{
+		fieldEscaper.Replace(header.Operation),
+		fieldEscaper.Replace(header.Info),
+		fieldEscaper.Replace(header.FileName),
+		sizeStr, paramStr}, ":")
 	return []byte(s + "\n")
 }
 
 // Parse the header string into component fields
+//
+// The last field holds the already encoded params and
+// is not unescaped
 func parseHeader(header string, fieldCount int) ([]string, error) {
 	strippedHeader := strings.TrimSuffix(header, "\n")
 	fields := strings.Split(strippedHeader, ":")
@@ -77,6 +263,9 @@ func parseHeader(header string, fieldCount int) ([]string, error) {
 		err := fmt.Errorf("invalid response header: %s", header)
 		return []string{}, err
 	}
+	for i := range fields[:fieldCount-1] {
+		fields[i] = fieldUnescaper.Replace(fields[i])
+	}
 	return fields, nil
 }
 
@@ -85,17 +274,17 @@ func parseHeader(header string, fieldCount int) ([]string, error) {
 //
 // Header Format:
 //
-//   operation:account:filename:size
+//   operation:account:filename:size:params
 //
 //   operation	string
 //   account	string
 //	 fileName	string
 //   size		uint64
+//   params		url encoded key=value pairs
 //
 // Note: Size does not include the size of the header
 func ReadHeader(conn net.Conn) (Header, error) {
-	reader := bufio.NewReader(conn)
-	header, err := reader.ReadString('\n')
+	header, err := readHeaderLine(conn)
 	if err != nil {
 		return Header{}, err
 	}
@@ -112,13 +301,17 @@ func ReadHeader(conn net.Conn) (Header, error) {
 	if err != nil {
 		return Header{}, err
 	}
+	params, err := url.ParseQuery(fields[4])
+	if err != nil {
+		return Header{}, err
+	}
 
 	err = CheckOperation(operation)
 	if err != nil {
 		return Header{}, err
 	}
 
-	return Header{operation, account, fileName, size}, nil
+	return Header{Operation: operation, Info: account, FileName: fileName, Size: size, Params: params}, nil
 }
 
 // Check if the received operation is valid
@@ -134,6 +327,60 @@ func CheckOperation(operation string) error {
 		return nil
 	case "LIST":
 		return nil
+	case "STAT":
+		return nil
+	case "MKDIR":
+		return nil
+	case "RMDIR":
+		return nil
+	case "MOVE":
+		return nil
+	case "COPY":
+		return nil
+	case "VERSIONS":
+		return nil
+	case "RESTORE":
+		return nil
+	case "TRASH":
+		return nil
+	case "UNDELETE":
+		return nil
+	case "PURGE":
+		return nil
+	case "USAGE":
+		return nil
+	case "GC":
+		return nil
+	case "SNAPSHOT":
+		return nil
+	case "LIST-SNAPSHOTS":
+		return nil
+	case "RESTORE-SNAPSHOT":
+		return nil
+	case "DELETE-SNAPSHOT":
+		return nil
+	case "DELETE-ACCOUNT":
+		return nil
+	case "RENAME-ACCOUNT":
+		return nil
+	case "LIST-ACCOUNTS":
+		return nil
+	case "GRANT":
+		return nil
+	case "REVOKE":
+		return nil
+	case "LIST-GRANTS":
+		return nil
+	case "SET-QUOTA":
+		return nil
+	case "SERVER-STATS":
+		return nil
+	case "AUDIT":
+		return nil
+	case "S3-KEY":
+		return nil
+	case "PING":
+		return nil
 	case "ERROR":
 		return nil
 	default:
@@ -142,12 +389,13 @@ func CheckOperation(operation string) error {
 }
 
 func genWrite(buffer []byte, size int, writer io.Writer) error {
-	for size != 0 {
-		bytesWritten, err := writer.Write(buffer)
+	for size > 0 {
+		bytesWritten, err := writer.Write(buffer[:size])
 		DebugLog("bytes written: %d, size: %d\n", bytesWritten, size)
 		if err != nil && err != io.EOF {
 			return err
 		}
+		buffer = buffer[bytesWritten:]
 		size -= bytesWritten
 	}
 	return nil
@@ -157,12 +405,34 @@ func genRead(size uint, reader io.Reader) (Data, error) {
 	buffer := make([]byte, size)
 	bytesRead, err := reader.Read(buffer)
 	DebugLog("bytesRead: %d\n", bytesRead)
-	if err != nil {
-		return Data{}, err
-	}
 	return Data{bytesRead, buffer}, err
 }
 
+// Read the header line of a message
+//
+// The line is read a byte at a time so that no part of the
+// message body following it is consumed
+func readHeaderLine(reader io.Reader) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) < MaxHeaderSize {
+		n, err := reader.Read(b)
+		if n == 1 {
+			line = append(line, b[0])
+			if b[0] == '\n' {
+				return string(line), nil
+			}
+		}
+		if err == io.EOF && len(line) > 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("header exceeds %d bytes", MaxHeaderSize)
+}
+
 // Common function for Reading a file into a Data list
 func ReadFile(name string, flags int, perm os.FileMode, dataList *list.List) (uint64, error) {
 	stat, err := os.Stat(name)
@@ -174,19 +444,25 @@ func ReadFile(name string, flags int, perm os.FileMode, dataList *list.List) (ui
 	if err != nil {
 		return 0, err
 	}
+	defer file.Close()
 
 	bytesToRead := stat.Size()
 	for bytesToRead != 0 {
 		chunk := computeChunk(uint64(bytesToRead))
 		data, err := genRead(chunk, file)
+		if data.Size > 0 {
+			dataList.PushBack(data)
+			bytesToRead -= int64(data.Size)
+		}
+		if err == io.EOF && bytesToRead != 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
 		if err != nil && err != io.EOF {
-			break
+			return 0, err
 		}
-		dataList.PushBack(data)
-		bytesToRead -= int64(data.Size)
 	}
 
-	return uint64(stat.Size()), err
+	return uint64(stat.Size()), nil
 }
 
 // Common function for writing a file from a Data list
@@ -200,11 +476,11 @@ func WriteFile(name string, flags int, perm os.FileMode, dataList *list.List) er
 		fileData := iter.Value.(Data)
 		if err := genWrite(fileData.Buffer, fileData.Size, file); err != nil {
 			file.Close()
-			break
+			return err
 		}
 		DebugLog("In write file")
 	}
-	return err
+	return file.Close()
 }
 
 // Compute the read chunk size
@@ -218,16 +494,34 @@ func computeChunk(bytesToRead uint64) uint {
 	}
 }
 
+// Concatenate the buffers of a Data list
+func JoinDataList(dataList *list.List) []byte {
+	var buffer []byte
+	for iter := dataList.Front(); iter != nil; iter = iter.Next() {
+		data := iter.Value.(Data)
+		buffer = append(buffer, data.Buffer[:data.Size]...)
+	}
+	return buffer
+}
+
 // Common function for reading a message from a connection
+//
+// An error is returned if the connection fails or ends
+// before the whole message is read
 func ReadMessage(dataList *list.List, bytesToRead uint64, conn net.Conn) error {
 	for bytesToRead != 0 {
 		chunk := computeChunk(bytesToRead)
 		data, err := genRead(chunk, conn)
+		if data.Size > 0 {
+			dataList.PushBack(data)
+			bytesToRead -= uint64(data.Size)
+		}
+		if err == io.EOF && bytesToRead != 0 {
+			return io.ErrUnexpectedEOF
+		}
 		if err != nil && err != io.EOF {
-			break
+			return err
 		}
-		dataList.PushBack(data)
-		bytesToRead -= uint64(data.Size)
 	}
 	return nil
 }
@@ -1,7 +1,13 @@
 package common
 
 import (
+	"container/list"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
 	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -15,6 +21,29 @@ func TestCheckOperation(t *testing.T) {
 		{"WRITE", nil},
 		{"DELETE", nil},
 		{"LIST", nil},
+		{"STAT", nil},
+		{"VERSIONS", nil},
+		{"RESTORE", nil},
+		{"TRASH", nil},
+		{"UNDELETE", nil},
+		{"PURGE", nil},
+		{"USAGE", nil},
+		{"GC", nil},
+		{"SNAPSHOT", nil},
+		{"LIST-SNAPSHOTS", nil},
+		{"RESTORE-SNAPSHOT", nil},
+		{"DELETE-SNAPSHOT", nil},
+		{"DELETE-ACCOUNT", nil},
+		{"RENAME-ACCOUNT", nil},
+		{"LIST-ACCOUNTS", nil},
+		{"GRANT", nil},
+		{"REVOKE", nil},
+		{"LIST-GRANTS", nil},
+		{"SET-QUOTA", nil},
+		{"SERVER-STATS", nil},
+		{"AUDIT", nil},
+		{"S3-KEY", nil},
+		{"PING", nil},
 		{"ERROR", nil},
 	}
 
@@ -27,12 +56,15 @@ func TestCheckOperation(t *testing.T) {
 
 func TestSerializeHeader(t *testing.T) {
 	var headers = []Header{
-		{"CREATE", "foo", "", 0},
-		{"READ", "foo", "chicken", 0},
-		{"WRITE", "foo", "cows", 30},
-		{"DELETE", "foo", "chicken", 0},
-		{"LIST", "foo", "sheep", 0},
-		{"List", "Failure", "", 0},
+		{"CREATE", "foo", "", 0, nil},
+		{"READ", "foo", "chicken", 0, nil},
+		{"WRITE", "foo", "cows", 30, url.Values{ParamIfMatch: {"abc123"}}},
+		{"DELETE", "foo", "chicken", 0, url.Values{ParamIfNoneMatch: {"*"}}},
+		{"LIST", "foo", "sheep", 0, nil},
+		{"STAT", "foo", "sheep", 0, url.Values{ParamVersion: {"a:b"}}},
+		{"READ", "foo", "farm:barn%3A/pig", 0, nil},
+		{"ERROR", "precondition failed: version is \"\"", "", 0, url.Values{ParamCode: {CodePreconditionFailed}}},
+		{"List", "Failure", "", 0, nil},
 	}
 
 	for _, header := range headers {
@@ -63,5 +95,87 @@ func TestSerializeHeader(t *testing.T) {
 			t.Errorf("Serliazed header.Size does not match header: %v != %v", deserialization[3], header.Size)
 		}
 
+		params, err := url.ParseQuery(deserialization[4])
+		if err != nil {
+			t.Errorf("Serialized header.Params is not a query: %v", deserialization[4])
+		}
+		if params.Encode() != header.Params.Encode() {
+			t.Errorf("Serialized header.Params does not match header: %v != %v", params, header.Params)
+		}
+
+	}
+}
+
+func TestReadHeaderLeavesBody(t *testing.T) {
+	server, client := net.Pipe()
+	// the writer logs, so it must finish before other tests
+	// change the logging settings
+	sent := make(chan struct{})
+	defer func() {
+		server.Close()
+		<-sent
+	}()
+
+	header := Header{Operation: "WRITE", Info: "foo", FileName: "cows", Size: 4}
+	go func() {
+		defer close(sent)
+		SendMessage(append(SerializeHeader(header), "moo\n"...), nil, client)
+		client.Close()
+	}()
+
+	received, err := ReadHeader(server)
+	if err != nil || received.FileName != header.FileName {
+		t.Fatalf("ReadHeader() = %v, %v", received, err)
+	}
+	dataList := list.New()
+	if err := ReadMessage(dataList, received.Size, server); err != nil {
+		t.Fatalf("ReadMessage() = %v", err)
+	}
+	if body := string(JoinDataList(dataList)); body != "moo\n" {
+		t.Errorf("body after header = %q, expected %q", body, "moo\n")
+	}
+}
+
+func TestReadMessageTruncated(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		client.Write([]byte("short"))
+		client.Close()
+	}()
+
+	if err := ReadMessage(list.New(), 10, server); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadMessage() of a truncated message = %v, expected %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	defer func(level, format string, previous *slog.Logger, previousDefault *slog.Logger) {
+		logLevel = level
+		logFormat = format
+		logger = previous
+		slog.SetDefault(previousDefault)
+	}(logLevel, logFormat, logger, slog.Default())
+
+	var out strings.Builder
+	logLevel = "debug"
+	logFormat = "json"
+	if err := SetupLogging(&out); err != nil {
+		t.Fatalf("SetupLogging() = %v", err)
+	}
+	DebugLog("value: %d\n", 42)
+	if strings.Contains(out.String(), `"level":"DEBUG","msg":"value: 42"`) == false {
+		t.Errorf("debug message logged as %q", out.String())
+	}
+
+	logFormat = "xml"
+	if err := SetupLogging(&out); err == nil {
+		t.Errorf("SetupLogging() with format %q succeeded", logFormat)
+	}
+	logFormat = "text"
+	logLevel = "loud"
+	if err := SetupLogging(&out); err == nil {
+		t.Errorf("SetupLogging() with level %q succeeded", logLevel)
 	}
 }
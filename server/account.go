@@ -0,0 +1,200 @@
+// Account lifecycle: creation records, deletion, renaming
+// and enumeration
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+// Directory holding a record of every account
+func accountsDir() string {
+	return path.Join(stateDir(), "accounts")
+}
+
+// Directories holding the state of an account
+func accountDirs(account string) []string {
+	return []string{
+		path.Join(accountRoot, account),
+		path.Join(stateDir(), "versions", account),
+		trashDir(account),
+		snapshotsDir(account),
+		path.Join(grantsDir(), account),
+		path.Join(quotasDir(), account),
+		path.Join(accountsDir(), account),
+		path.Join(s3KeysDir(), account),
+	}
+}
+
+// Check that an account name is usable as a directory name
+func checkAccountName(account string) error {
+	if account == "" || strings.HasPrefix(account, ".") || strings.Contains(account, "/") {
+		return fmt.Errorf("invalid account name: %q", account)
+	}
+	return nil
+}
+
+// Record the creation of an account
+func recordAccount(account string) error {
+	if err := os.MkdirAll(accountsDir(), os.FileMode(0744)); err != nil {
+		return err
+	}
+	created := time.Now().UTC().Format(time.RFC3339) + "\n"
+	return ioutil.WriteFile(path.Join(accountsDir(), account), []byte(created), defaultPerms)
+}
+
+// Read the creation time of an account
+func accountCreated(account string) (time.Time, error) {
+	contents, err := ioutil.ReadFile(path.Join(accountsDir(), account))
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339, strings.TrimSpace(string(contents)))
+}
+
+// Remove an account and everything stored for it
+//
+// Requires the administrator token
+func deleteAccount(account string, conn net.Conn) (common.ResponseData, error) {
+	if err := checkAccountName(account); err != nil {
+		return common.ResponseData{}, err
+	}
+	exists, err := checkExistence(path.Join(accountRoot, account))
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	if exists == false {
+		return common.ResponseData{}, fmt.Errorf("account %s: %w", account, os.ErrNotExist)
+	}
+
+	for _, dir := range accountDirs(account) {
+		if err := os.RemoveAll(dir); err != nil {
+			return common.ResponseData{}, err
+		}
+	}
+	if err := renameGrantee(account, ""); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	resp := fmt.Sprintf("deleted account %s", account)
+	return createResponseData("DELETE-ACCOUNT", resp, "", 0, nil, conn), nil
+}
+
+// Rename an account to the name given by the new-name
+// parameter, keeping its history, trash, snapshots and
+// grants
+//
+// Nothing is moved if any state of the new name exists, and
+// directories already moved are moved back if the rename
+// fails partway.
+//
+// Requires the administrator token
+func renameAccount(account string, params url.Values, conn net.Conn) (common.ResponseData, error) {
+	newName := params.Get(common.ParamNewName)
+	if err := checkAccountName(account); err != nil {
+		return common.ResponseData{}, err
+	}
+	if err := checkAccountName(newName); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	exists, err := checkExistence(path.Join(accountRoot, account))
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	if exists == false {
+		return common.ResponseData{}, fmt.Errorf("account %s: %w", account, os.ErrNotExist)
+	}
+	src := accountDirs(account)
+	dst := accountDirs(newName)
+	for _, dir := range dst {
+		exists, err := checkExistence(dir)
+		if err != nil {
+			return common.ResponseData{}, err
+		}
+		if exists == true {
+			return common.ResponseData{}, fmt.Errorf("account %s: %w", newName, os.ErrExist)
+		}
+	}
+
+	var moved []int
+	for i := range src {
+		err := os.Rename(src[i], dst[i])
+		if os.IsNotExist(err) == true {
+			continue
+		}
+		if err != nil {
+			undoRenameAccount(src, dst, moved)
+			return common.ResponseData{}, err
+		}
+		moved = append(moved, i)
+	}
+	if err := renameGrantee(account, newName); err != nil {
+		if err := renameGrantee(newName, account); err != nil {
+			slog.Error("unable to restore grants", "account", account, "err", err)
+		}
+		undoRenameAccount(src, dst, moved)
+		return common.ResponseData{}, err
+	}
+
+	resp := fmt.Sprintf("renamed account %s to %s", account, newName)
+	return createResponseData("RENAME-ACCOUNT", resp, "", 0, nil, conn), nil
+}
+
+// Move the directories of a partly renamed account back to
+// their old names
+func undoRenameAccount(src []string, dst []string, moved []int) {
+	for i := len(moved) - 1; i >= 0; i-- {
+		if err := os.Rename(dst[moved[i]], src[moved[i]]); err != nil {
+			slog.Error("unable to restore account directory", "dir", src[moved[i]], "err", err)
+		}
+	}
+}
+
+// List every account with its usage and creation time
+//
+// Each account is sent as a line of the form:
+//
+//	name bytes files created
+//
+// Requires the administrator token
+func listAccounts(conn net.Conn) (common.ResponseData, error) {
+	records, err := ioutil.ReadDir(accountsDir())
+	if err != nil && os.IsNotExist(err) == false {
+		return common.ResponseData{}, err
+	}
+
+	var size int
+	dataList := list.New()
+	for _, record := range records {
+		account := record.Name()
+		u, err := accountUsage(account)
+		if os.IsNotExist(err) == true {
+			continue
+		}
+		if err != nil {
+			return common.ResponseData{}, err
+		}
+		created, err := accountCreated(account)
+		if err != nil {
+			return common.ResponseData{}, err
+		}
+
+		line := fmt.Sprintf("%s %d %d %s\n", account, u.bytes, u.files, created.Format(time.RFC3339))
+		dataList.PushBack(common.Data{Size: len(line), Buffer: []byte(line)})
+		size += len(line)
+	}
+
+	resp := fmt.Sprintf("%d accounts", dataList.Len())
+	return createResponseData("LIST-ACCOUNTS", resp, "", uint64(size), dataList, conn), nil
+}
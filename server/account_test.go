@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+func TestAccountLifecycle(t *testing.T) {
+	accountName := "lifecycle"
+	createTestAccount(accountName, t)
+	newName := "renamed"
+	defer func() {
+		for _, dir := range append(accountDirs(accountName), accountDirs(newName)...) {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	writeTestFile(accountName, "journal.txt", "first", t)
+	writeTestFile(accountName, "journal.txt", " and second", t)
+	if _, err := createSnapshot(accountName, url.Values{common.ParamSnapshot: {"snap"}}, nil); err != nil {
+		t.Fatalf("createSnapshot(%s) = %v", accountName, err)
+	}
+
+	resp, err := listAccounts(nil)
+	if err != nil {
+		t.Fatalf("listAccounts() = %v", err)
+	}
+	found := false
+	for _, line := range strings.Split(string(common.JoinDataList(resp.DataList)), "\n") {
+		// the file, its previous version and its snapshot
+		found = found || strings.HasPrefix(line, accountName+" 37 3 ")
+	}
+	if found == false {
+		t.Errorf("listAccounts() = %q, missing %s", common.JoinDataList(resp.DataList), accountName)
+	}
+
+	rename := url.Values{common.ParamNewName: {newName}}
+	if _, err := renameAccount(accountName, rename, nil); err != nil {
+		t.Fatalf("renameAccount(%s, %v) = %v", accountName, rename, err)
+	}
+	if _, err := readFile(newName, "journal.txt", nil, nil); err != nil {
+		t.Errorf("readFile after rename = %v", err)
+	}
+	if versions, err := listVersions(newName, "journal.txt"); err != nil || len(versions) != 1 {
+		t.Errorf("listVersions after rename = %v, %v", versions, err)
+	}
+	if _, err := readFile(newName, "journal.txt", url.Values{common.ParamSnapshot: {"snap"}}, nil); err != nil {
+		t.Errorf("readFile from snapshot after rename = %v", err)
+	}
+	if _, err := accountCreated(newName); err != nil {
+		t.Errorf("accountCreated after rename = %v", err)
+	}
+
+	createTestAccount(accountName, t)
+	_, err = renameAccount(newName, url.Values{common.ParamNewName: {accountName}}, nil)
+	if errors.Is(err, os.ErrExist) == false {
+		t.Errorf("renameAccount onto an existing account = %v, expected exists", err)
+	}
+	// state left under the new name stops the rename before anything moves
+	leftover := url.Values{common.ParamNewName: {"account_leftover"}}
+	quotaPath := path.Join(quotasDir(), "account_leftover")
+	os.MkdirAll(quotasDir(), os.FileMode(0744))
+	ioutil.WriteFile(quotaPath, []byte("10 1\n"), defaultPerms)
+	defer os.Remove(quotaPath)
+	_, err = renameAccount(newName, leftover, nil)
+	if errors.Is(err, os.ErrExist) == false {
+		t.Errorf("renameAccount onto leftover state = %v, expected exists", err)
+	}
+	if exists, _ := checkExistence(quotaPath); exists == false {
+		t.Errorf("renameAccount removed the leftover state of the new name")
+	}
+	if _, err := readFile(newName, "journal.txt", nil, nil); err != nil {
+		t.Errorf("readFile after refused rename = %v", err)
+	}
+
+	_, err = renameAccount(newName, url.Values{common.ParamNewName: {"../escape"}}, nil)
+	if err == nil {
+		t.Errorf("renameAccount to an invalid name succeeded")
+	}
+
+	if _, err := deleteAccount(newName, nil); err != nil {
+		t.Fatalf("deleteAccount(%s) = %v", newName, err)
+	}
+	for _, dir := range accountDirs(newName) {
+		if exists, _ := checkExistence(dir); exists == true {
+			t.Errorf("%s survived account deletion", dir)
+		}
+	}
+	if _, err := deleteAccount(newName, nil); errors.Is(err, os.ErrNotExist) == false {
+		t.Errorf("repeat deleteAccount(%s) = %v, expected not found", newName, err)
+	}
+	if _, err := os.Stat(path.Join(accountRoot, accountName)); err != nil {
+		t.Errorf("unrelated account removed: %v", err)
+	}
+}
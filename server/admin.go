@@ -0,0 +1,96 @@
+// Administrative authorization
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+// errPermissionDenied is returned when a request is not
+// authorized to perform an operation
+var errPermissionDenied = errors.New("permission denied")
+
+// environment variable holding the default administrator token
+// so it need not appear on the command line
+const adminTokenEnv string = "GO_FTP_ADMIN_TOKEN"
+
+var (
+	// token authorizing administrative operations,
+	// empty disables them
+	adminToken string
+
+	// time the server started
+	startTime = time.Now()
+)
+
+// Operations requiring the administrator token
+var adminOps = map[string]bool{
+	"DELETE-ACCOUNT": true,
+	"RENAME-ACCOUNT": true,
+	"LIST-ACCOUNTS":  true,
+	"SET-QUOTA":      true,
+	"SERVER-STATS":   true,
+	"GC":             true,
+	"AUDIT":          true,
+	"S3-KEY":         true,
+}
+
+// Administrative operations on the server rather than on an
+// account, which may be requested without an account name
+var serverOps = map[string]bool{
+	"LIST-ACCOUNTS": true,
+	"SERVER-STATS":  true,
+	"GC":            true,
+	"AUDIT":         true,
+}
+
+// Check whether a request carries the administrator token
+func isAdmin(params url.Values) bool {
+	token := params.Get(common.ParamToken)
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// Check that a request carries the administrator token
+func checkAdmin(op string, params url.Values) error {
+	if isAdmin(params) == false {
+		return fmt.Errorf("%w: %s requires an administrator", errPermissionDenied, op)
+	}
+	return nil
+}
+
+// Report the state of the server
+func serverStats(svr Server, conn net.Conn) (common.ResponseData, error) {
+	records, err := ioutil.ReadDir(accountsDir())
+	if err != nil && os.IsNotExist(err) == false {
+		return common.ResponseData{}, err
+	}
+
+	params := url.Values{}
+	params.Set(common.ParamUptime, time.Since(startTime).Round(time.Second).String())
+	params.Set(common.ParamGoroutines, strconv.Itoa(runtime.NumGoroutine()))
+	params.Set(common.ParamAccounts, strconv.Itoa(len(records)))
+	params.Set(common.ParamHandleQueue, strconv.Itoa(len(svr.handleChan)))
+	params.Set(common.ParamIOQueue, strconv.Itoa(len(svr.ioChan)))
+	params.Set(common.ParamRespQueue, strconv.Itoa(len(svr.respChan)))
+	params.Set(common.ParamConnWorkers, strconv.Itoa(svr.handlePool.workers()))
+	params.Set(common.ParamIOWorkers, strconv.Itoa(svr.ioPool.workers()))
+	params.Set(common.ParamRespWorkers, strconv.Itoa(svr.respPool.workers()))
+	params.Set(common.ParamDedup, strconv.FormatBool(dedup))
+	params.Set(common.ParamConnections, strconv.FormatInt(activeConnections.Load(), 10))
+	params.Set(common.ParamRejected, strconv.FormatInt(rejectedConnections.Load(), 10))
+	params.Set(common.ParamTimeouts, strconv.FormatInt(timedOutConnections.Load(), 10))
+
+	res := createResponseData("SERVER-STATS", "server stats", "", 0, nil, conn)
+	res.Header.Params = params
+	return res, nil
+}
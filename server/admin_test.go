@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+func TestCheckAdmin(t *testing.T) {
+	defer func(token string) { adminToken = token }(adminToken)
+
+	var tests = []struct {
+		configured string
+		given      string
+		allowed    bool
+	}{
+		{"", "", false},
+		{"", "guess", false},
+		{"secret", "", false},
+		{"secret", "guess", false},
+		{"secret", "secret", true},
+	}
+
+	for _, test := range tests {
+		adminToken = test.configured
+		err := checkAdmin("LIST-ACCOUNTS", url.Values{common.ParamToken: {test.given}})
+		if test.allowed != (err == nil) || (err != nil && errors.Is(err, errPermissionDenied) == false) {
+			t.Errorf("checkAdmin with token %q configured as %q = %v", test.given, test.configured, err)
+		}
+	}
+}
+
+func TestAdminAccess(t *testing.T) {
+	defer func(token string) { adminToken = token }(adminToken)
+	adminToken = "secret"
+
+	owner := "admin_owner"
+	createTestAccount(owner, t)
+	defer func() {
+		for _, dir := range accountDirs(owner) {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	header := common.Header{
+		Operation: "USAGE",
+		Info:      "operator",
+		Params:    url.Values{common.ParamOwner: {owner}, common.ParamToken: {"secret"}},
+	}
+	if account, err := resolveAccount(header); err != nil || account != owner {
+		t.Errorf("resolveAccount(%v) as administrator = %s, %v", header, account, err)
+	}
+
+	header.Params.Set(common.ParamToken, "guess")
+	if _, err := resolveAccount(header); errors.Is(err, errPermissionDenied) == false {
+		t.Errorf("resolveAccount(%v) without administrator = %v, expected permission denied", header, err)
+	}
+
+	svr := Server{
+		handleChan: make(chan net.Conn, 1),
+		ioChan:     make(chan common.ClientData, 1),
+		respChan:   make(chan common.ResponseData, 1),
+	}
+	// pools serving other queues so the queued request stays queued
+	handleQueue := make(chan net.Conn)
+	ioQueue := make(chan common.ClientData)
+	respQueue := make(chan common.ResponseData)
+	svr.handlePool = newWorkerPool("conn", handleQueue, func(net.Conn) {}, 1, 1)
+	svr.ioPool = newWorkerPool("io", ioQueue, func(common.ClientData) {}, 2, 2)
+	svr.respPool = newWorkerPool("response", respQueue, func(common.ResponseData) {}, 1, 1)
+	defer func() {
+		close(handleQueue)
+		close(ioQueue)
+		close(respQueue)
+	}()
+
+	svr.ioChan <- common.ClientData{}
+	resp, err := serverStats(svr, nil)
+	if err != nil {
+		t.Fatalf("serverStats() = %v", err)
+	}
+	if resp.Header.Params.Get(common.ParamIOQueue) != "1" || resp.Header.Params.Get(common.ParamAccounts) == "0" ||
+		resp.Header.Params.Get(common.ParamIOWorkers) != "2" {
+		t.Errorf("serverStats() = %v", resp.Header.Params)
+	}
+}
@@ -0,0 +1,210 @@
+// Admission of new connections
+//
+// Accepted connections wait in a bounded queue for a handler
+// worker. Connections beyond the connection limit, or arriving
+// while the queue is full, are rejected with a busy error
+// instead of waiting indefinitely.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+const (
+	defaultAcceptQueue int = 64
+
+	// time allowed to tell a client the server is busy
+	rejectTimeout time.Duration = time.Second
+
+	// bounds of the delay before accepting again after
+	// an accept error
+	minAcceptBackoff time.Duration = 5 * time.Millisecond
+	maxAcceptBackoff time.Duration = time.Second
+)
+
+// errServerBusy is returned to connections the server has
+// no capacity to handle
+var errServerBusy = errors.New("server busy")
+
+var (
+	// connections handled at once, zero is unlimited
+	maxConnections int
+	// connections waiting for a handler worker
+	acceptQueue int = defaultAcceptQueue
+
+	// connections admitted and not yet closed
+	activeConnections atomic.Int64
+	// connections rejected as the server was busy
+	rejectedConnections atomic.Int64
+)
+
+// Accept connections until the listener is closed
+//
+// Other accept errors, such as running out of file
+// descriptors, are retried with an increasing delay
+func acceptConnections(svr Server) error {
+	var backoff time.Duration
+	for {
+		conn, err := svr.listener.Accept()
+		if errors.Is(err, net.ErrClosed) == true {
+			return err
+		}
+		if err != nil {
+			backoff = min(max(2*backoff, minAcceptBackoff), maxAcceptBackoff)
+			slog.Error("failed to accept connection", "err", err, "retry", backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		conn = trackConnection(conn)
+		connLogger(conn).Info("accepted connection")
+		admitConnection(conn, svr)
+	}
+}
+
+// Take a place for a connection, failing if the server is
+// at its connection limit
+//
+// The place is given back with releaseConnection
+func acquireConnection(svr Server) error {
+	if svr.slots != nil {
+		select {
+		case svr.slots <- struct{}{}:
+		default:
+			return fmt.Errorf("%w: %d connections", errServerBusy, cap(svr.slots))
+		}
+	}
+	activeConnections.Add(1)
+	return nil
+}
+
+// Queue a connection for a handler worker, or reject it if
+// the server is at its connection limit or the queue is full
+func admitConnection(conn net.Conn, svr Server) {
+	if err := acquireConnection(svr); err != nil {
+		go rejectConnection(conn, err)
+		return
+	}
+
+	select {
+	case svr.handleChan <- conn:
+	default:
+		releaseConnection(svr)
+		go rejectConnection(conn, fmt.Errorf("%w: %d connections queued", errServerBusy, cap(svr.handleChan)))
+	}
+}
+
+// Release the capacity held by a closed connection
+func releaseConnection(svr Server) {
+	activeConnections.Add(-1)
+	if svr.slots != nil {
+		<-svr.slots
+	}
+}
+
+// Send a busy error to a connection and close it
+//
+// The request is drained after the response so closing the
+// connection does not reset it before the client reads it
+func rejectConnection(conn net.Conn, err error) {
+	rejectedConnections.Add(1)
+	logger := connLogger(conn)
+	logger.Warn("rejected connection", "err", err)
+
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	res := createErrorResponse(err, conn)
+	if err := common.SendMessage(common.SerializeHeader(res.Header), nil, conn); err != nil {
+		logger.Error("failed to send message", "err", err)
+	}
+	if closer, ok := conn.(interface{ CloseWrite() error }); ok == true {
+		closer.CloseWrite()
+	}
+	io.Copy(ioutil.Discard, conn)
+
+	if err := conn.Close(); err != nil {
+		logger.Error("unable to close connection", "err", err)
+	}
+}
+
+// Sessions of the front ends serving their clients outside
+// the pipeline, and the listeners accepting them
+type sessionGroup struct {
+	mu        sync.Mutex
+	wg        sync.WaitGroup
+	listeners []net.Listener
+	conns     map[net.Conn]bool
+}
+
+// sessions of the FTP and JSON-RPC front ends
+var sessions = sessionGroup{conns: make(map[net.Conn]bool)}
+
+// Close a listener when the sessions are closed
+func (g *sessionGroup) listen(listener net.Listener) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.listeners = append(g.listeners, listener)
+}
+
+// Serve a session with run in a new goroutine, or reject it
+// with reject if the server is at its connection limit or
+// shutting down
+func (g *sessionGroup) admit(conn net.Conn, svr Server, reject func(net.Conn, error), run func()) {
+	if err := acquireConnection(svr); err != nil {
+		rejectedConnections.Add(1)
+		connLogger(conn).Warn("rejected connection", "err", err)
+		go reject(conn, err)
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if shuttingDown.Load() == true {
+		releaseConnection(svr)
+		go reject(conn, fmt.Errorf("%w: shutting down", errServerBusy))
+		return
+	}
+	g.conns[conn] = true
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer releaseConnection(svr)
+		defer func() {
+			g.mu.Lock()
+			delete(g.conns, conn)
+			g.mu.Unlock()
+		}()
+		run()
+	}()
+}
+
+// Close the listeners and wake sessions waiting for their
+// clients, so each ends once its current request is done
+func (g *sessionGroup) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, listener := range g.listeners {
+		if err := listener.Close(); err != nil && errors.Is(err, net.ErrClosed) == false {
+			slog.Error("unable to close listener", "err", err)
+		}
+	}
+	g.listeners = nil
+	for conn := range g.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+// Wait for every session to end
+func (g *sessionGroup) wait() {
+	g.wg.Wait()
+}
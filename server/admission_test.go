@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+// Check that a connection was rejected as busy
+func checkRejected(client net.Conn, t *testing.T) {
+	header, err := common.ReadHeader(client)
+	if err != nil {
+		t.Fatalf("unable to read rejection: %v", err)
+	}
+	if header.Operation != "ERROR" || header.Params.Get(common.ParamCode) != common.CodeBusy {
+		t.Errorf("rejection header = %v, expected busy error", header)
+	}
+	client.Close()
+}
+
+func TestAdmitConnection(t *testing.T) {
+	svr := Server{
+		handleChan: make(chan net.Conn, 1),
+		slots:      make(chan struct{}, 2),
+	}
+	rejected := rejectedConnections.Load()
+
+	// the first connection is queued
+	first, _ := net.Pipe()
+	admitConnection(first, svr)
+	if len(svr.handleChan) != 1 || len(svr.slots) != 1 {
+		t.Fatalf("first connection not queued")
+	}
+
+	// the second is admitted but finds the queue full
+	server, client := net.Pipe()
+	admitConnection(server, svr)
+	checkRejected(client, t)
+	if len(svr.slots) != 1 {
+		t.Errorf("rejected connection holds a slot")
+	}
+
+	// the third is over the connection limit
+	<-svr.handleChan
+	admitConnection(first, svr)
+	server, client = net.Pipe()
+	admitConnection(server, svr)
+	checkRejected(client, t)
+
+	if count := rejectedConnections.Load() - rejected; count != 2 {
+		t.Errorf("rejected %d connections, expected 2", count)
+	}
+
+	releaseConnection(svr)
+	releaseConnection(svr)
+	if len(svr.slots) != 0 {
+		t.Errorf("%d slots held after release", len(svr.slots))
+	}
+}
@@ -0,0 +1,323 @@
+// Audit trail of every operation
+//
+// Each request handled by dispatch appends a JSON line to the
+// audit log recording who did what to which file and how it
+// ended. The log is rotated once it reaches its maximum size,
+// keeping a fixed number of older files numbered from the
+// newest, and is queried by administrators with AUDIT.
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+const (
+	defaultAuditMaxSize  int64 = 10 * 1024 * 1024
+	defaultAuditMaxFiles int   = 5
+	defaultAuditLimit    int   = 100
+)
+
+var (
+	// record every operation in the audit log
+	auditEnabled bool = true
+	// path of the audit log, defaults to the state directory
+	auditPath string
+	// size at which the audit log is rotated
+	auditMaxSize int64 = defaultAuditMaxSize
+	// rotated audit logs kept
+	auditMaxFiles int = defaultAuditMaxFiles
+
+	// audit log of the server, nil if auditing is disabled
+	auditTrail *auditLog
+)
+
+// A line of the audit log
+type auditEntry struct {
+	Time     time.Time `json:"time"`
+	Request  string    `json:"request,omitempty"`
+	Remote   string    `json:"remote,omitempty"`
+	Actor    string    `json:"actor"`
+	Account  string    `json:"account,omitempty"`
+	Op       string    `json:"op"`
+	File     string    `json:"file,omitempty"`
+	BytesIn  uint64    `json:"bytes_in"`
+	BytesOut uint64    `json:"bytes_out"`
+	Outcome  string    `json:"outcome"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// An append-only log rotated by size
+type auditLog struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// Default path of the audit log
+func defaultAuditPath() string {
+	return path.Join(stateDir(), "audit.log")
+}
+
+// Open an audit log for appending
+func openAuditLog(logPath string, maxSize int64, maxFiles int) (*auditLog, error) {
+	a := &auditLog{path: logPath, maxSize: maxSize, maxFiles: maxFiles}
+	if err := os.MkdirAll(path.Dir(logPath), os.FileMode(0744)); err != nil {
+		return nil, err
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Open the current file of the log
+func (a *auditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.FileMode(0600))
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	a.file = file
+	a.size = info.Size()
+	return nil
+}
+
+// Path of the nth most recent rotated file of the log
+func (a *auditLog) rotatedPath(n int) string {
+	return a.path + "." + strconv.Itoa(n)
+}
+
+// Move the current file of the log to the first rotated
+// file, discarding the oldest, and start a new one
+func (a *auditLog) rotate() error {
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+	os.Remove(a.rotatedPath(a.maxFiles))
+	for n := a.maxFiles - 1; n >= 1; n-- {
+		err := os.Rename(a.rotatedPath(n), a.rotatedPath(n+1))
+		if err != nil && os.IsNotExist(err) == false {
+			return err
+		}
+	}
+	if a.maxFiles > 0 {
+		if err := os.Rename(a.path, a.rotatedPath(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(a.path); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// Append an entry to the log
+func (a *auditLog) record(entry auditEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	return err
+}
+
+// Close the log
+func (a *auditLog) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
+
+// Read the entries of the log, oldest first, passing those
+// matching a filter to a function
+//
+// The files are opened under the lock and read without it so
+// a long query does not hold up recording. Rotation only
+// renames and removes files, which leaves open files readable
+func (a *auditLog) scan(match func(auditEntry) bool, found func(auditEntry)) error {
+	files, err := a.openFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	for _, file := range files {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var entry auditEntry
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+				continue
+			}
+			if match(entry) == true {
+				found(entry)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Open the files of the log, oldest first
+func (a *auditLog) openFiles() ([]*os.File, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	paths := []string{}
+	for n := a.maxFiles; n >= 1; n-- {
+		paths = append(paths, a.rotatedPath(n))
+	}
+	paths = append(paths, a.path)
+
+	var files []*os.File
+	for _, logPath := range paths {
+		file, err := os.Open(logPath)
+		if os.IsNotExist(err) == true {
+			continue
+		}
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// Record a request handled by dispatch in the audit log
+func recordAudit(data common.ClientData, account string, res common.ResponseData, err error) {
+	if auditTrail == nil {
+		return
+	}
+	header := data.Header
+	entry := auditEntry{
+		Time:     time.Now().UTC(),
+		Request:  connRequestID(data.Conn),
+		Actor:    header.Info,
+		Account:  account,
+		Op:       header.Operation,
+		File:     header.FileName,
+		BytesIn:  header.Size,
+		BytesOut: res.Header.Size,
+		Outcome:  outcome(err),
+	}
+	if data.Conn != nil && data.Conn.RemoteAddr() != nil {
+		entry.Remote = data.Conn.RemoteAddr().String()
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if err := auditTrail.record(entry); err != nil {
+		slog.Error("unable to record audit entry", "err", err)
+	}
+}
+
+// Record a request rejected before reaching dispatch, such as
+// an unreadable header, a throttled client or a write over quota
+func recordRejection(header common.Header, conn net.Conn, err error) {
+	account, accountErr := resolveAccount(header)
+	if accountErr != nil {
+		account = ""
+	}
+	recordAudit(common.ClientData{Header: header, Conn: conn}, account, common.ResponseData{}, err)
+}
+
+// Query the audit log
+//
+// Entries may be filtered by the account they were made by or
+// operated on with the audit-account parameter, by operation
+// with the audit-op parameter and by time with the since and
+// until parameters in RFC 3339 format. The most recent entries
+// up to the limit parameter are sent as JSON lines, oldest
+// first
+func queryAudit(params url.Values, conn net.Conn) (common.ResponseData, error) {
+	if auditTrail == nil {
+		return common.ResponseData{}, fmt.Errorf("auditing is disabled")
+	}
+
+	limit := defaultAuditLimit
+	if value := params.Get(common.ParamLimit); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			return common.ResponseData{}, fmt.Errorf("invalid limit: %q", value)
+		}
+	}
+	var since, until time.Time
+	for _, bound := range []struct {
+		param string
+		value *time.Time
+	}{{common.ParamSince, &since}, {common.ParamUntil, &until}} {
+		if value := params.Get(bound.param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return common.ResponseData{}, fmt.Errorf("invalid %s: %q", bound.param, value)
+			}
+			*bound.value = t
+		}
+	}
+	account := params.Get(common.ParamAuditAccount)
+	op := params.Get(common.ParamAuditOp)
+
+	match := func(entry auditEntry) bool {
+		return (account == "" || entry.Actor == account || entry.Account == account) &&
+			(op == "" || entry.Op == op) &&
+			(since.IsZero() || entry.Time.Before(since) == false) &&
+			(until.IsZero() || entry.Time.Before(until))
+	}
+	dataList := list.New()
+	var size int
+	err := auditTrail.scan(match, func(entry auditEntry) {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+		line = append(line, '\n')
+		dataList.PushBack(common.Data{Size: len(line), Buffer: line})
+		size += len(line)
+		if dataList.Len() > limit {
+			size -= dataList.Remove(dataList.Front()).(common.Data).Size
+		}
+	})
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+
+	resp := fmt.Sprintf("%d audit entries", dataList.Len())
+	return createResponseData("AUDIT", resp, "", uint64(size), dataList, conn), nil
+}
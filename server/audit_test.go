@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+func TestAuditLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go_ftp_audit")
+	if err != nil {
+		t.Fatalf("unable to create audit directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPath := path.Join(dir, "audit.log")
+	a, err := openAuditLog(logPath, 300, 2)
+	if err != nil {
+		t.Fatalf("openAuditLog() = %v", err)
+	}
+	defer a.close()
+
+	for i := 0; i < 10; i++ {
+		entry := auditEntry{Time: time.Now(), Actor: "auditor", Op: "READ", File: fmt.Sprintf("file%d", i), Outcome: "ok"}
+		if err := a.record(entry); err != nil {
+			t.Fatalf("record() = %v", err)
+		}
+	}
+
+	for _, rotated := range []string{logPath, a.rotatedPath(1), a.rotatedPath(2)} {
+		info, err := os.Stat(rotated)
+		if err != nil {
+			t.Errorf("audit log %s missing: %v", rotated, err)
+		} else if info.Size() > 300 {
+			t.Errorf("audit log %s has %d bytes, expected at most 300", rotated, info.Size())
+		}
+	}
+	if _, err := os.Stat(a.rotatedPath(3)); os.IsNotExist(err) == false {
+		t.Errorf("audit log kept more than 2 rotated files")
+	}
+
+	// entries are scanned oldest first and end with the newest
+	var files []string
+	a.scan(func(auditEntry) bool { return true }, func(entry auditEntry) {
+		files = append(files, entry.File)
+	})
+	if len(files) == 0 || files[len(files)-1] != "file9" {
+		t.Errorf("scanned entries %v, expected to end with file9", files)
+	}
+	for i := 1; i < len(files); i++ {
+		if files[i] <= files[i-1] {
+			t.Errorf("scanned entries %v out of order", files)
+		}
+	}
+}
+
+func TestQueryAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go_ftp_audit")
+	if err != nil {
+		t.Fatalf("unable to create audit directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(trail *auditLog) { auditTrail = trail }(auditTrail)
+	auditTrail, err = openAuditLog(path.Join(dir, "audit.log"), defaultAuditMaxSize, 1)
+	if err != nil {
+		t.Fatalf("openAuditLog() = %v", err)
+	}
+	defer auditTrail.close()
+
+	read := common.ClientData{Header: common.Header{Operation: "READ", Info: "reader", FileName: "a", Params: url.Values{common.ParamOwner: {"owner"}}}}
+	recordAudit(read, "owner", createResponseData("READ", "", "a", 12, nil, nil), nil)
+	remove := common.ClientData{Header: common.Header{Operation: "DELETE", Info: "owner", FileName: "b"}}
+	recordAudit(remove, "owner", common.ResponseData{}, fmt.Errorf("b: %w", os.ErrNotExist))
+	recordAudit(read, "", common.ResponseData{}, fmt.Errorf("%w: READ", errPermissionDenied))
+
+	var tests = []struct {
+		params   url.Values
+		outcomes []string
+	}{
+		{url.Values{}, []string{"ok", "not-found", "permission-denied"}},
+		{url.Values{common.ParamAuditAccount: {"owner"}}, []string{"ok", "not-found"}},
+		{url.Values{common.ParamAuditOp: {"READ"}}, []string{"ok", "permission-denied"}},
+		{url.Values{common.ParamLimit: {"1"}}, []string{"permission-denied"}},
+		{url.Values{common.ParamSince: {time.Now().Add(time.Hour).Format(time.RFC3339)}}, nil},
+	}
+
+	for _, test := range tests {
+		res, err := queryAudit(test.params, nil)
+		if err != nil {
+			t.Errorf("queryAudit(%v) = %v", test.params, err)
+			continue
+		}
+		var outcomes []string
+		body := strings.TrimSpace(string(common.JoinDataList(res.DataList)))
+		for _, line := range strings.Split(body, "\n") {
+			if line == "" {
+				continue
+			}
+			var entry auditEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("invalid audit line %q: %v", line, err)
+			}
+			outcomes = append(outcomes, entry.Outcome)
+		}
+		if strings.Join(outcomes, ",") != strings.Join(test.outcomes, ",") {
+			t.Errorf("queryAudit(%v) outcomes = %v, expected %v", test.params, outcomes, test.outcomes)
+		}
+	}
+
+	if _, err := queryAudit(url.Values{common.ParamLimit: {"none"}}, nil); err == nil {
+		t.Errorf("queryAudit() with an invalid limit succeeded")
+	}
+}
+
+// Record to an audit log in a temporary directory until the
+// returned function is called
+func useTestAuditLog(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "go_ftp_audit")
+	if err != nil {
+		t.Fatalf("unable to create audit directory: %v", err)
+	}
+	trail, err := openAuditLog(path.Join(dir, "audit.log"), defaultAuditMaxSize, 1)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("openAuditLog() = %v", err)
+	}
+	previous := auditTrail
+	auditTrail = trail
+	return func() {
+		auditTrail = previous
+		trail.close()
+		os.RemoveAll(dir)
+	}
+}
+
+// Entries of the audit log, oldest first
+func recordedAudit(t *testing.T) []auditEntry {
+	var entries []auditEntry
+	err := auditTrail.scan(func(auditEntry) bool { return true }, func(entry auditEntry) {
+		entries = append(entries, entry)
+	})
+	if err != nil {
+		t.Fatalf("scan() = %v", err)
+	}
+	return entries
+}
+
+func TestAuditRejections(t *testing.T) {
+	defer useTestAuditLog(t)()
+
+	defer func(q quota) { defaultQuota = q }(defaultQuota)
+	defaultQuota = quota{maxBytes: 4}
+	defer func(requests *rateLimiter) { requestLimits = requests }(requestLimits)
+	requestLimits = newRateLimiter(1, 1)
+
+	accountName := "audit_rejections"
+	accountPath := createTestAccount(accountName, t)
+	defer os.RemoveAll(accountPath)
+
+	throttled := common.Header{Operation: "READ", Info: "audit_throttled", FileName: "file"}
+	checkRateLimits(throttled, nil)
+	var tests = []struct {
+		message []byte
+		op      string
+		account string
+		outcome string
+	}{
+		{nil, "", "", "error"},
+		{common.SerializeHeader(throttled), "READ", "audit_throttled", common.CodeThrottled},
+		{common.SerializeHeader(common.Header{Operation: "WRITE", Info: accountName, FileName: "big", Size: 10}), "WRITE", accountName, common.CodeQuotaExceeded},
+	}
+
+	for _, test := range tests {
+		server, client := net.Pipe()
+		go func(message []byte) {
+			client.Write(message)
+			client.Close()
+		}(test.message)
+		if err := handleConnection(server, Server{}); err == nil {
+			t.Errorf("handleConnection(%q) succeeded", test.message)
+		}
+		server.Close()
+	}
+
+	entries := recordedAudit(t)
+	if len(entries) != len(tests) {
+		t.Fatalf("recorded %d rejections, expected %d", len(entries), len(tests))
+	}
+	for i, test := range tests {
+		entry := entries[i]
+		if entry.Op != test.op || entry.Account != test.account || entry.Outcome != test.outcome {
+			t.Errorf("rejection %d recorded as %s %s %s, expected %s %s %s",
+				i, entry.Op, entry.Account, entry.Outcome, test.op, test.account, test.outcome)
+		}
+	}
+}
+
+func TestAuditScanUnlocked(t *testing.T) {
+	defer useTestAuditLog(t)()
+	trail := auditTrail
+	trail.record(auditEntry{Op: "READ"})
+
+	done := make(chan error, 1)
+	go func() {
+		// recording while a scan is reading must not wait for it
+		done <- trail.scan(func(entry auditEntry) bool { return entry.Op == "READ" }, func(auditEntry) {
+			trail.record(auditEntry{Op: "WRITE"})
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("scan() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("record blocked behind scan")
+	}
+}
@@ -0,0 +1,86 @@
+// Deadlines protecting workers from slow or stalled clients
+//
+// The header and body of a request must each arrive within
+// their timeout, and no read may wait longer than the idle
+// timeout for data. Responses must be sent within the write
+// timeout. Connections missing a deadline are closed and
+// counted.
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultHeaderTimeout time.Duration = 10 * time.Second
+	defaultBodyTimeout   time.Duration = 5 * time.Minute
+	defaultIdleTimeout   time.Duration = 30 * time.Second
+	defaultWriteTimeout  time.Duration = time.Minute
+)
+
+var (
+	// time allowed to read a request header, zero is unlimited
+	headerTimeout time.Duration = defaultHeaderTimeout
+	// time allowed to read a request body, zero is unlimited
+	bodyTimeout time.Duration = defaultBodyTimeout
+	// time a read may wait for data, zero is unlimited
+	idleTimeout time.Duration = defaultIdleTimeout
+	// time allowed to send a response, zero is unlimited
+	writeTimeout time.Duration = defaultWriteTimeout
+
+	// connections closed for missing a deadline
+	timedOutConnections atomic.Int64
+)
+
+// A connection whose reads fail once its deadline passes
+// or once no data arrives within the idle timeout
+type deadlineConn struct {
+	net.Conn
+	deadline time.Time
+}
+
+// Give the reads of a connection a deadline after the
+// timeout, or none if it is zero
+func (c *deadlineConn) setTimeout(timeout time.Duration) {
+	c.deadline = time.Time{}
+	if timeout > 0 {
+		c.deadline = time.Now().Add(timeout)
+	}
+}
+
+// Read from the connection before the earlier of its
+// deadline and the idle timeout
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	deadline := c.deadline
+	if idleTimeout > 0 {
+		idle := time.Now().Add(idleTimeout)
+		if deadline.IsZero() || idle.Before(deadline) {
+			deadline = idle
+		}
+	}
+	if err := c.Conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// Give sending a response to a connection a deadline after
+// the write timeout
+func setWriteTimeout(conn net.Conn) error {
+	if writeTimeout <= 0 {
+		return nil
+	}
+	return conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+}
+
+// Count the connection failing with an error if it missed
+// a deadline
+func countTimeout(err error) {
+	if errors.Is(err, os.ErrDeadlineExceeded) == true {
+		timedOutConnections.Add(1)
+	}
+}
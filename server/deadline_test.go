@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+func TestReadTimeouts(t *testing.T) {
+	defer func(header, body, idle time.Duration) {
+		headerTimeout = header
+		bodyTimeout = body
+		idleTimeout = idle
+	}(headerTimeout, bodyTimeout, idleTimeout)
+
+	request := common.SerializeHeader(common.Header{Operation: "WRITE", Info: "slow", FileName: "file", Size: 10})
+	var tests = []struct {
+		name    string
+		header  time.Duration
+		body    time.Duration
+		idle    time.Duration
+		message []byte
+	}{
+		{"silent client", 50 * time.Millisecond, 0, 0, nil},
+		{"partial header", 0, 0, 50 * time.Millisecond, request[:5]},
+		{"partial body", 0, 50 * time.Millisecond, 0, append(request, "short"...)},
+	}
+
+	for _, test := range tests {
+		headerTimeout = test.header
+		bodyTimeout = test.body
+		idleTimeout = test.idle
+		timeouts := timedOutConnections.Load()
+
+		server, client := net.Pipe()
+		go client.Write(test.message)
+
+		err := handleConnection(server, Server{})
+		if errors.Is(err, os.ErrDeadlineExceeded) == false {
+			t.Errorf("%s: handleConnection() = %v, expected a timeout", test.name, err)
+		}
+		if errorCode(err) != common.CodeTimeout {
+			t.Errorf("%s: error code %q, expected %q", test.name, errorCode(err), common.CodeTimeout)
+		}
+		if timedOutConnections.Load() != timeouts+1 {
+			t.Errorf("%s: timeout not counted", test.name)
+		}
+		client.Close()
+		server.Close()
+	}
+}
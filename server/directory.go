@@ -0,0 +1,216 @@
+// Directories, moves and copies within an account
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+// Check that the file of a request names something other
+// than the account itself
+func checkNotRoot(fileName string) error {
+	if clean := path.Clean("/" + fileName); clean == "/" {
+		return fmt.Errorf("invalid file name: %q names the account", fileName)
+	}
+	return nil
+}
+
+// Check the destination parameter of a move or copy, which
+// may not be the account itself or lie inside the source
+func checkDestination(fileName string, params url.Values) (string, error) {
+	dest := params.Get(common.ParamDestination)
+	if err := checkFileName(dest); err != nil {
+		return "", err
+	}
+	if err := checkNotRoot(dest); err != nil {
+		return "", err
+	}
+	src := path.Clean("/" + fileName)
+	dst := path.Clean("/" + dest)
+	if dst == src || strings.HasPrefix(dst, src+"/") {
+		return "", fmt.Errorf("invalid destination: %q is inside %q", dest, fileName)
+	}
+	return dest, nil
+}
+
+// Lock two paths in a fixed order so operations locking the
+// same pair cannot deadlock
+func lockPair(a string, b string) func() {
+	if b < a {
+		a, b = b, a
+	}
+	fileLocks.lock(a)
+	fileLocks.lock(b)
+	return func() {
+		fileLocks.unlock(b)
+		fileLocks.unlock(a)
+	}
+}
+
+// Total storage used by the files under a path
+func treeUsage(root string) (usage, error) {
+	var u usage
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode().IsRegular() == false {
+			return err
+		}
+		size, err := contentSize(filePath, info)
+		u.bytes += size
+		u.files++
+		return err
+	})
+	return u, err
+}
+
+// Create a directory under the given account
+//
+// The parent directory must already exist
+func makeDirectory(account string, fileName string, conn net.Conn) (common.ResponseData, error) {
+	if err := checkNotRoot(fileName); err != nil {
+		return common.ResponseData{}, err
+	}
+	dirPath := path.Join(accountRoot, account, fileName)
+
+	fileLocks.lock(dirPath)
+	defer fileLocks.unlock(dirPath)
+
+	if err := os.Mkdir(dirPath, os.FileMode(0744)); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	resp := fmt.Sprintf("created directory %s", fileName)
+	return createResponseData("MKDIR", resp, fileName, 0, nil, conn), nil
+}
+
+// Remove an empty directory under the given account
+func removeDirectory(account string, fileName string, conn net.Conn) (common.ResponseData, error) {
+	if err := checkNotRoot(fileName); err != nil {
+		return common.ResponseData{}, err
+	}
+	dirPath := path.Join(accountRoot, account, fileName)
+
+	fileLocks.lock(dirPath)
+	defer fileLocks.unlock(dirPath)
+
+	files, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	if len(files) > 0 {
+		return common.ResponseData{}, fmt.Errorf("directory %s is not empty", fileName)
+	}
+	if err := os.Remove(dirPath); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	resp := fmt.Sprintf("removed directory %s", fileName)
+	return createResponseData("RMDIR", resp, fileName, 0, nil, conn), nil
+}
+
+// Move a file or directory under the given account to the
+// name given by the destination parameter, along with the
+// previous versions of the file
+//
+// Move will fail if the destination exists or if the
+// if-match or if-none-match parameters do not match the
+// current file version
+func movePath(account string, fileName string, params url.Values, conn net.Conn) (common.ResponseData, error) {
+	if err := checkNotRoot(fileName); err != nil {
+		return common.ResponseData{}, err
+	}
+	dest, err := checkDestination(fileName, params)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	src := path.Join(accountRoot, account, fileName)
+	dst := path.Join(accountRoot, account, dest)
+
+	defer lockPair(src, dst)()
+
+	if err := checkPrecondition(src, params); err != nil {
+		return common.ResponseData{}, err
+	}
+	exists, err := checkExistence(dst)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	if exists == true {
+		return common.ResponseData{}, fmt.Errorf("%s: %w", dest, os.ErrExist)
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	versions := versionDir(account, fileName)
+	if exists, err := checkExistence(versions); err == nil && exists == true {
+		target := versionDir(account, dest)
+		if err := os.MkdirAll(path.Dir(target), os.FileMode(0744)); err != nil {
+			return common.ResponseData{}, err
+		}
+		if err := os.Rename(versions, target); err != nil {
+			return common.ResponseData{}, err
+		}
+	}
+
+	resp := fmt.Sprintf("moved %s to %s", fileName, dest)
+	return createResponseData("MOVE", resp, dest, 0, nil, conn), nil
+}
+
+// Copy a file or directory under the given account to the
+// name given by the destination parameter
+//
+// Copy will fail if the destination exists or if the
+// account's quota would be exceeded
+func copyPath(account string, fileName string, params url.Values, conn net.Conn) (common.ResponseData, error) {
+	if err := checkNotRoot(fileName); err != nil {
+		return common.ResponseData{}, err
+	}
+	dest, err := checkDestination(fileName, params)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	src := path.Join(accountRoot, account, fileName)
+	dst := path.Join(accountRoot, account, dest)
+
+	defer lockPair(src, dst)()
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	exists, err := checkExistence(dst)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	if exists == true {
+		return common.ResponseData{}, fmt.Errorf("%s: %w", dest, os.ErrExist)
+	}
+	added, err := treeUsage(src)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	if err := checkQuotaUsage(account, added); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	if info.IsDir() {
+		err = copyTree(src, dst)
+	} else {
+		err = copyFile(src, dst)
+	}
+	if err != nil {
+		os.RemoveAll(dst)
+		return common.ResponseData{}, err
+	}
+
+	resp := fmt.Sprintf("copied %s to %s", fileName, dest)
+	return createResponseData("COPY", resp, dest, 0, nil, conn), nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+func TestDirectoryOperations(t *testing.T) {
+	accountName := "directory"
+	createTestAccount(accountName, t)
+	defer func() {
+		for _, dir := range accountDirs(accountName) {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	if _, err := makeDirectory(accountName, "notes", nil); err != nil {
+		t.Fatalf("makeDirectory(notes) = %v", err)
+	}
+	if _, err := makeDirectory(accountName, "notes", nil); errors.Is(err, os.ErrExist) == false {
+		t.Errorf("makeDirectory of an existing directory = %v", err)
+	}
+	if _, err := makeDirectory(accountName, "", nil); err == nil {
+		t.Errorf("makeDirectory of the account succeeded")
+	}
+
+	writeTestFile(accountName, "notes/a.txt", "first", t)
+	writeTestFile(accountName, "notes/a.txt", "second", t)
+
+	stat, err := statFile(accountName, "notes", nil, nil)
+	if err != nil || stat.Header.Params.Get(common.ParamType) != common.TypeDirectory {
+		t.Errorf("statFile(notes) = %v, %v", stat.Header.Params, err)
+	}
+	stat, err = statFile(accountName, "notes/a.txt", nil, nil)
+	if err != nil || stat.Header.Params.Get(common.ParamType) != common.TypeFile {
+		t.Errorf("statFile(notes/a.txt) = %v, %v", stat.Header.Params, err)
+	}
+
+	to := func(dest string) url.Values {
+		return url.Values{common.ParamDestination: {dest}}
+	}
+	var failures = []struct {
+		op       string
+		fileName string
+		dest     string
+	}{
+		{"MOVE", "notes", "notes/inside"},
+		{"MOVE", "notes", ""},
+		{"MOVE", "notes", "../escape"},
+		{"MOVE", "", "elsewhere"},
+		{"COPY", "notes", "notes"},
+		{"COPY", "missing.txt", "copy.txt"},
+	}
+	for _, test := range failures {
+		var err error
+		if test.op == "MOVE" {
+			_, err = movePath(accountName, test.fileName, to(test.dest), nil)
+		} else {
+			_, err = copyPath(accountName, test.fileName, to(test.dest), nil)
+		}
+		if err == nil {
+			t.Errorf("%s %q to %q succeeded", test.op, test.fileName, test.dest)
+		}
+	}
+
+	if _, err := copyPath(accountName, "notes", to("backup"), nil); err != nil {
+		t.Fatalf("copyPath(notes, backup) = %v", err)
+	}
+	if _, err := copyPath(accountName, "notes", to("backup"), nil); errors.Is(err, os.ErrExist) == false {
+		t.Errorf("copyPath onto an existing directory = %v", err)
+	}
+	if _, err := movePath(accountName, "notes/a.txt", to("b.txt"), nil); err != nil {
+		t.Fatalf("movePath(notes/a.txt, b.txt) = %v", err)
+	}
+
+	for fileName, want := range map[string]string{"backup/a.txt": "firstsecond", "b.txt": "firstsecond"} {
+		res, err := readFile(accountName, fileName, nil, nil)
+		if err != nil || string(common.JoinDataList(res.DataList)) != want {
+			t.Errorf("readFile(%s) = %q, %v, expected %q", fileName, common.JoinDataList(res.DataList), err, want)
+		}
+	}
+	if versions, err := listVersions(accountName, "b.txt"); err != nil || len(versions) != 1 {
+		t.Errorf("versions of moved file = %v, %v, expected 1", versions, err)
+	}
+
+	if _, err := removeDirectory(accountName, "backup", nil); err == nil {
+		t.Errorf("removeDirectory of a non-empty directory succeeded")
+	}
+	if _, err := removeDirectory(accountName, "notes", nil); err != nil {
+		t.Errorf("removeDirectory(notes) = %v", err)
+	}
+	if exists, _ := checkExistence(path.Join(accountRoot, accountName, "notes")); exists == true {
+		t.Errorf("removed directory still exists")
+	}
+}
+
+func TestCopyQuota(t *testing.T) {
+	accountName := "copy_quota"
+	createTestAccount(accountName, t)
+	defer func() {
+		for _, dir := range accountDirs(accountName) {
+			os.RemoveAll(dir)
+		}
+	}()
+	writeTestFile(accountName, "a.txt", "0123456789", t)
+
+	defer func(q quota) { defaultQuota = q }(defaultQuota)
+	defaultQuota = quota{maxBytes: 15}
+
+	params := url.Values{common.ParamDestination: {"b.txt"}}
+	if _, err := copyPath(accountName, "a.txt", params, nil); errors.Is(err, errQuotaExceeded) == false {
+		t.Errorf("copyPath beyond the quota = %v", err)
+	}
+
+	// a directory is charged for every file it holds
+	if _, err := makeDirectory(accountName, "dir", nil); err != nil {
+		t.Fatalf("makeDirectory(%s, dir) = %v", accountName, err)
+	}
+	writeTestFile(accountName, "dir/b.txt", "", t)
+	writeTestFile(accountName, "dir/c.txt", "", t)
+	defaultQuota = quota{maxFiles: 4}
+	params = url.Values{common.ParamDestination: {"copy"}}
+	if _, err := copyPath(accountName, "dir", params, nil); errors.Is(err, errQuotaExceeded) == false {
+		t.Errorf("copyPath of a directory beyond the file quota = %v", err)
+	}
+}
+
+func TestResolveDestinationGrant(t *testing.T) {
+	owner := "destination_owner"
+	createTestAccount(owner, t)
+	defer func() {
+		for _, dir := range accountDirs(owner) {
+			os.RemoveAll(dir)
+		}
+	}()
+	params := url.Values{common.ParamGrantee: {"mover"}, common.ParamAccess: {common.AccessReadWrite}}
+	if _, err := grantAccess(owner, "shared", params, nil); err != nil {
+		t.Fatalf("grantAccess(%s, shared) = %v", owner, err)
+	}
+
+	for dest, allowed := range map[string]bool{"shared/b.txt": true, "private.txt": false} {
+		header := common.Header{
+			Operation: "MOVE",
+			Info:      "mover",
+			FileName:  "shared/a.txt",
+			Params:    url.Values{common.ParamOwner: {owner}, common.ParamDestination: {dest}},
+		}
+		if _, err := resolveAccount(header); allowed != (err == nil) {
+			t.Errorf("resolveAccount(MOVE to %s) = %v, expected allowed %v", dest, err, allowed)
+		}
+	}
+}
@@ -0,0 +1,649 @@
+// FTP front end
+//
+// A subset of RFC 959 lets standard FTP clients browse and
+// change the files of an account. The user named by USER is
+// the account, whose directory is the root of the session.
+// The password is the secret of the account's S3 key, or the
+// administrator token, which is then sent with each command.
+// Sessions are admitted under the same connection limit as
+// the TCP protocol. Each command is performed with dispatch,
+// so FTP shares authorization, quotas, rate limits, storage,
+// metrics and the audit log with the other front ends.
+//
+// Only passive data connections are supported, and they are
+// only accepted from the address of the control connection.
+// Files are always transferred as images, whatever the TYPE.
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+const defaultFTPIdleTimeout time.Duration = 5 * time.Minute
+
+var (
+	// address accepting FTP clients, empty disables them
+	ftpAddress string
+	// time an FTP session may wait for a command, zero is
+	// unlimited
+	ftpIdleTimeout time.Duration = defaultFTPIdleTimeout
+)
+
+// State of the control connection of an FTP client
+type ftpSession struct {
+	conn    net.Conn
+	scanner *bufio.Scanner
+	svr     Server
+
+	user     string
+	loggedIn bool
+	// administrator token given as the password, if any
+	token string
+	// working directory within the account, "" at its root
+	cwd string
+	// listener for the next passive data connection
+	passive net.Listener
+	// file named by RNFR awaiting RNTO
+	renameFrom string
+}
+
+// A reply code with the message sent with it
+type ftpReply struct {
+	code int
+	msg  string
+}
+
+// Listen for FTP clients on the FTP address
+func serveFTP(svr Server) error {
+	listener, err := net.Listen("tcp", ftpAddress)
+	if err != nil {
+		return err
+	}
+	slog.Info("listening for FTP clients", "address", listener.Addr().String())
+	sessions.listen(listener)
+	go acceptFTP(listener, svr)
+	return nil
+}
+
+// Accept FTP clients until the listener is closed, retrying
+// other accept errors with an increasing delay
+func acceptFTP(listener net.Listener, svr Server) {
+	var backoff time.Duration
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) == true {
+			return
+		}
+		if err != nil {
+			backoff = min(max(2*backoff, minAcceptBackoff), maxAcceptBackoff)
+			slog.Error("failed to accept FTP client", "err", err, "retry", backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		conn = trackConnection(conn)
+		connLogger(conn).Info("accepted FTP client")
+		sessions.admit(conn, svr, rejectFTP, newFTPSession(conn, svr).run)
+	}
+}
+
+// Tell an FTP client the server cannot serve it and close
+// its connection
+func rejectFTP(conn net.Conn, err error) {
+	conn.SetDeadline(time.Now().Add(rejectTimeout))
+	fmt.Fprintf(conn, "421 %v\r\n", err)
+	if err := conn.Close(); err != nil {
+		connLogger(conn).Error("unable to close connection", "err", err)
+	}
+}
+
+func newFTPSession(conn net.Conn, svr Server) *ftpSession {
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 512), common.MaxHeaderSize)
+	return &ftpSession{conn: conn, scanner: scanner, svr: svr}
+}
+
+// Send a reply on the control connection, with the lines
+// between the first and last of a multiline reply indented
+func (s *ftpSession) reply(code int, format string, args ...any) error {
+	if err := setWriteTimeout(s.conn); err != nil {
+		return err
+	}
+	lines := strings.Split(fmt.Sprintf(format, args...), "\n")
+	var msg strings.Builder
+	for i, line := range lines {
+		switch {
+		case len(lines) == 1 || i == len(lines)-1:
+			fmt.Fprintf(&msg, "%d %s\r\n", code, line)
+		case i == 0:
+			fmt.Fprintf(&msg, "%d-%s\r\n", code, line)
+		default:
+			fmt.Fprintf(&msg, " %s\r\n", line)
+		}
+	}
+	_, err := s.conn.Write([]byte(msg.String()))
+	return err
+}
+
+// Read and answer commands until the client quits, the
+// session is idle for too long or the server shuts down
+func (s *ftpSession) run() {
+	logger := connLogger(s.conn)
+	defer func() {
+		s.closePassive()
+		if err := s.conn.Close(); err != nil {
+			logger.Error("unable to close connection", "err", err)
+		}
+	}()
+
+	if err := s.reply(220, "go_ftp ready"); err != nil {
+		logger.Error("failed to greet FTP client", "err", err)
+		return
+	}
+	for {
+		if shuttingDown.Load() == true {
+			s.reply(421, "Server shutting down")
+			return
+		}
+		if ftpIdleTimeout > 0 {
+			s.conn.SetReadDeadline(time.Now().Add(ftpIdleTimeout))
+		}
+		if s.scanner.Scan() == false {
+			if shuttingDown.Load() == true {
+				s.reply(421, "Server shutting down")
+				return
+			}
+			if err := s.scanner.Err(); err != nil {
+				countTimeout(err)
+				logger.Warn("FTP session ended", "err", err)
+				s.reply(421, "Timeout, closing control connection")
+			}
+			return
+		}
+		verb, arg, _ := strings.Cut(strings.TrimRight(s.scanner.Text(), "\r"), " ")
+		verb = strings.ToUpper(verb)
+		if verb == "PASS" {
+			logger.Debug("FTP command", "command", verb)
+		} else {
+			logger.Debug("FTP command", "command", verb, "arg", arg)
+		}
+
+		if shuttingDown.Load() == true {
+			s.reply(421, "Server shutting down")
+			return
+		}
+		reply := s.handle(verb, arg)
+		if err := s.reply(reply.code, "%s", reply.msg); err != nil {
+			logger.Error("failed to send FTP reply", "err", err)
+			return
+		}
+		if verb == "QUIT" {
+			return
+		}
+	}
+}
+
+// Commands allowed before logging in
+var ftpPublicCommands = map[string]bool{
+	"USER": true, "PASS": true, "QUIT": true, "NOOP": true,
+	"SYST": true, "FEAT": true, "OPTS": true,
+}
+
+// Answer a command
+func (s *ftpSession) handle(verb string, arg string) ftpReply {
+	if s.loggedIn == false && ftpPublicCommands[verb] == false {
+		return ftpReply{530, "Please login with USER and PASS"}
+	}
+	// RNFR only names the file for the command right after it
+	if verb != "RNTO" {
+		s.renameFrom = ""
+	}
+
+	switch verb {
+	case "USER":
+		s.user, s.loggedIn = arg, false
+		return ftpReply{331, "Password required for " + arg}
+	case "PASS":
+		return s.login(arg)
+	case "QUIT":
+		return ftpReply{221, "Goodbye"}
+	case "NOOP":
+		return ftpReply{200, "NOOP ok"}
+	case "SYST":
+		return ftpReply{215, "UNIX Type: L8"}
+	case "FEAT":
+		return ftpReply{211, "Features:\nEPSV\nPASV\nSIZE\nMDTM\nUTF8\nEnd"}
+	case "OPTS":
+		if strings.EqualFold(arg, "UTF8 ON") {
+			return ftpReply{200, "UTF8 enabled"}
+		}
+		return ftpReply{501, "Option not understood"}
+	case "TYPE":
+		return ftpReply{200, "Type set to " + arg}
+	case "MODE":
+		if strings.EqualFold(arg, "S") {
+			return ftpReply{200, "Mode set to S"}
+		}
+		return ftpReply{504, "Only stream mode is supported"}
+	case "STRU":
+		if strings.EqualFold(arg, "F") {
+			return ftpReply{200, "Structure set to F"}
+		}
+		return ftpReply{504, "Only file structure is supported"}
+	case "PWD", "XPWD":
+		return ftpReply{257, quotePath("/"+s.cwd) + " is the current directory"}
+	case "CWD", "XCWD":
+		return s.changeDir(arg)
+	case "CDUP", "XCUP":
+		return s.changeDir("..")
+	case "PASV":
+		return s.enterPassive(false)
+	case "EPSV":
+		return s.enterPassive(true)
+	case "PORT", "EPRT":
+		return ftpReply{502, "Active mode is not supported, use PASV"}
+	case "LIST", "NLST":
+		return s.list(verb, arg)
+	case "RETR":
+		return s.retrieve(arg)
+	case "STOR", "APPE":
+		return s.store(verb, arg)
+	case "DELE":
+		return s.simple("DELETE", arg, nil, ftpReply{250, "Deleted " + arg})
+	case "MKD", "XMKD":
+		return s.simple("MKDIR", arg, nil, ftpReply{257, quotePath("/"+s.resolve(arg)) + " created"})
+	case "RMD", "XRMD":
+		return s.simple("RMDIR", arg, nil, ftpReply{250, "Removed " + arg})
+	case "RNFR":
+		if _, err := s.stat(arg); err != nil {
+			return ftpError(err)
+		}
+		s.renameFrom = s.resolve(arg)
+		return ftpReply{350, "Ready for RNTO"}
+	case "RNTO":
+		return s.rename(arg)
+	case "SIZE":
+		params, err := s.stat(arg)
+		if err != nil {
+			return ftpError(err)
+		}
+		if params.Get(common.ParamType) == common.TypeDirectory {
+			return ftpReply{550, arg + " is a directory"}
+		}
+		return ftpReply{213, params.Get(common.ParamSize)}
+	case "MDTM":
+		params, err := s.stat(arg)
+		if err != nil {
+			return ftpError(err)
+		}
+		mtime, err := time.Parse(time.RFC3339, params.Get(common.ParamModTime))
+		if err != nil {
+			return ftpError(err)
+		}
+		return ftpReply{213, mtime.UTC().Format("20060102150405")}
+	default:
+		return ftpReply{502, verb + " not implemented"}
+	}
+}
+
+// Map an error to an FTP reply
+func ftpError(err error) ftpReply {
+	switch errorCode(err) {
+	case common.CodeQuotaExceeded, common.CodeTooLarge:
+		return ftpReply{552, err.Error()}
+	case common.CodeThrottled:
+		return ftpReply{450, err.Error()}
+	case common.CodeBusy:
+		return ftpReply{421, err.Error()}
+	case common.CodeTimeout:
+		return ftpReply{426, err.Error()}
+	default:
+		return ftpReply{550, err.Error()}
+	}
+}
+
+// Quote a path in a reply, doubling any quotes within it
+func quotePath(p string) string {
+	return `"` + strings.ReplaceAll(p, `"`, `""`) + `"`
+}
+
+// Path of a file named in a command within the account
+func (s *ftpSession) resolve(name string) string {
+	if path.IsAbs(name) == false {
+		name = path.Join("/", s.cwd, name)
+	}
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// Log in as the account named by USER
+func (s *ftpSession) login(password string) ftpReply {
+	if s.user == "" {
+		return ftpReply{503, "Login with USER first"}
+	}
+	if err := checkAccountName(s.user); err != nil {
+		return ftpReply{530, err.Error()}
+	}
+	exists, err := checkExistence(path.Join(accountRoot, s.user))
+	if err != nil || exists == false {
+		return ftpReply{530, "Login incorrect"}
+	}
+	s.token = ""
+	if isAdmin(url.Values{common.ParamToken: {password}}) == true {
+		s.token = password
+	} else {
+		secret, err := accountS3Secret(s.user)
+		if err != nil || secret == "" || hmac.Equal([]byte(password), []byte(secret)) == false {
+			return ftpReply{530, "Login incorrect"}
+		}
+	}
+	s.loggedIn, s.cwd = true, ""
+	annotateConn(s.conn, "account", s.user)
+	return ftpReply{230, "User " + s.user + " logged in"}
+}
+
+// Header of an operation on a file of the account
+func (s *ftpSession) header(op string, fileName string) common.Header {
+	header := common.Header{Operation: op, Info: s.user, FileName: fileName, Params: url.Values{}}
+	if s.token != "" {
+		header.Params.Set(common.ParamToken, s.token)
+	}
+	return header
+}
+
+// Perform an operation, checking the same limits as
+// handleConnection
+func (s *ftpSession) perform(header common.Header, body []byte) (common.ResponseData, error) {
+	start := time.Now()
+	data := common.ClientData{Header: header, DataList: list.New(), Conn: s.conn}
+	if body != nil {
+		data.DataList.PushBack(common.Data{Size: len(body), Buffer: body})
+		data.Header.Size = uint64(len(body))
+	}
+	if err := checkRateLimits(data.Header, s.conn); err != nil {
+		requestMetrics.observe(header.Operation, err, time.Since(start))
+		recordRejection(data.Header, s.conn, err)
+		return common.ResponseData{}, err
+	}
+
+	res, err := dispatch(data, s.svr)
+	logger := connLogger(s.conn)
+	if err != nil {
+		logger.Warn("request failed", "op", header.Operation, "file", header.FileName,
+			"err", err, "code", errorCode(err), "duration", time.Since(start))
+		return common.ResponseData{}, err
+	}
+	logger.Info("handled request", "op", header.Operation, "file", header.FileName,
+		"size", data.Header.Size, "duration", time.Since(start))
+	return res, nil
+}
+
+// Perform an operation on a file named in a command, with
+// the reply to send if it succeeds
+func (s *ftpSession) simple(op string, name string, params url.Values, success ftpReply) ftpReply {
+	if name == "" {
+		return ftpReply{501, "Missing file name"}
+	}
+	header := s.header(op, s.resolve(name))
+	for key, values := range params {
+		header.Params[key] = values
+	}
+	if _, err := s.perform(header, nil); err != nil {
+		return ftpError(err)
+	}
+	return success
+}
+
+// Parameters of a STAT of a file named in a command
+func (s *ftpSession) stat(name string) (url.Values, error) {
+	res, err := s.perform(s.header("STAT", s.resolve(name)), nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Header.Params, nil
+}
+
+// Change the working directory
+func (s *ftpSession) changeDir(name string) ftpReply {
+	dir := s.resolve(name)
+	if dir != "" {
+		params, err := s.stat(name)
+		if err != nil {
+			return ftpError(err)
+		}
+		if params.Get(common.ParamType) != common.TypeDirectory {
+			return ftpReply{550, name + " is not a directory"}
+		}
+	}
+	s.cwd = dir
+	return ftpReply{250, "Directory changed to /" + dir}
+}
+
+// Rename the file named by RNFR
+func (s *ftpSession) rename(name string) ftpReply {
+	if s.renameFrom == "" {
+		return ftpReply{503, "RNFR required first"}
+	}
+	from := s.renameFrom
+	s.renameFrom = ""
+	header := s.header("MOVE", from)
+	header.Params.Set(common.ParamDestination, s.resolve(name))
+	if _, err := s.perform(header, nil); err != nil {
+		return ftpError(err)
+	}
+	return ftpReply{250, "Renamed /" + from + " to /" + s.resolve(name)}
+}
+
+func (s *ftpSession) closePassive() {
+	if s.passive != nil {
+		s.passive.Close()
+		s.passive = nil
+	}
+}
+
+// Listen for the next data connection on the address the
+// client reached the server on
+func (s *ftpSession) enterPassive(extended bool) ftpReply {
+	s.closePassive()
+	host, _, err := net.SplitHostPort(s.conn.LocalAddr().String())
+	if err != nil {
+		return ftpReply{425, err.Error()}
+	}
+	ip := net.ParseIP(host).To4()
+	if extended == false && ip == nil {
+		return ftpReply{425, "PASV requires IPv4, use EPSV"}
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return ftpReply{425, err.Error()}
+	}
+	s.passive = listener
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	if extended == true {
+		return ftpReply{229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port)}
+	}
+	return ftpReply{227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)",
+		ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff)}
+}
+
+// Accept the data connection of a transfer from the client
+func (s *ftpSession) acceptData() (net.Conn, error) {
+	if s.passive == nil {
+		return nil, fmt.Errorf("use PASV or EPSV first")
+	}
+	listener := s.passive
+	s.passive = nil
+	defer listener.Close()
+
+	if idleTimeout > 0 {
+		listener.(*net.TCPListener).SetDeadline(time.Now().Add(idleTimeout))
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		countTimeout(err)
+		return nil, err
+	}
+	client, _, _ := net.SplitHostPort(s.conn.RemoteAddr().String())
+	remote, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if client != remote {
+		conn.Close()
+		return nil, fmt.Errorf("data connection from %s, expected %s", remote, client)
+	}
+	return conn, nil
+}
+
+// Send data to the client over a data connection
+func (s *ftpSession) sendData(contents []byte) ftpReply {
+	if err := s.reply(150, "Opening data connection"); err != nil {
+		return ftpReply{426, err.Error()}
+	}
+	conn, err := s.acceptData()
+	if err != nil {
+		return ftpReply{425, err.Error()}
+	}
+	defer conn.Close()
+
+	setWriteTimeout(conn)
+	if _, err := conn.Write(contents); err != nil {
+		countTimeout(err)
+		return ftpReply{426, err.Error()}
+	}
+	bytesSent.Add(int64(len(contents)))
+	return ftpReply{226, "Transfer complete"}
+}
+
+// List a directory, or describe a file, with one line per
+// entry in the format of ls -l for LIST or names for NLST
+func (s *ftpSession) list(verb string, arg string) ftpReply {
+	// ignore the ls options many clients send
+	fields := strings.Fields(arg)
+	for len(fields) > 0 && strings.HasPrefix(fields[0], "-") {
+		fields = fields[1:]
+	}
+	target := s.resolve(strings.Join(fields, " "))
+
+	stat, err := s.perform(s.header("STAT", target), nil)
+	if err != nil {
+		return ftpError(err)
+	}
+	entries := map[string]url.Values{path.Base("/" + target): stat.Header.Params}
+	var names []string
+	if stat.Header.Params.Get(common.ParamType) == common.TypeDirectory {
+		res, err := s.perform(s.header("LIST", target), nil)
+		if err != nil {
+			return ftpError(err)
+		}
+		names, entries = nil, map[string]url.Values{}
+		for iter := res.DataList.Front(); iter != nil; iter = iter.Next() {
+			data := iter.Value.(common.Data)
+			names = append(names, strings.TrimSuffix(string(data.Buffer[:data.Size]), "\n"))
+		}
+		if verb == "LIST" {
+			storageLock.RLock()
+			for _, name := range names {
+				member, err := statFile(s.user, path.Join(target, name), url.Values{}, s.conn)
+				if err == nil {
+					entries[name] = member.Header.Params
+				}
+			}
+			storageLock.RUnlock()
+		}
+	} else {
+		names = []string{path.Base("/" + target)}
+	}
+
+	var listing strings.Builder
+	for _, name := range names {
+		if verb == "NLST" {
+			listing.WriteString(name + "\r\n")
+		} else if params, ok := entries[name]; ok == true {
+			listing.WriteString(listLine(s.user, name, params) + "\r\n")
+		}
+	}
+	return s.sendData([]byte(listing.String()))
+}
+
+// Describe a file in the format of ls -l
+func listLine(account string, name string, params url.Values) string {
+	mode := "-rw-r--r--"
+	if params.Get(common.ParamType) == common.TypeDirectory {
+		mode = "drwxr-xr-x"
+	}
+	size, _ := strconv.ParseInt(params.Get(common.ParamSize), 10, 64)
+	mtime, _ := time.Parse(time.RFC3339, params.Get(common.ParamModTime))
+	stamp := mtime.Format("Jan _2 15:04")
+	if time.Since(mtime) > 180*24*time.Hour || mtime.After(time.Now()) {
+		stamp = mtime.Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s 1 %s %s %12d %s %s", mode, account, account, size, stamp, name)
+}
+
+// Send a file to the client
+func (s *ftpSession) retrieve(name string) ftpReply {
+	if name == "" {
+		return ftpReply{501, "Missing file name"}
+	}
+	res, err := s.perform(s.header("READ", s.resolve(name)), nil)
+	if err != nil {
+		return ftpError(err)
+	}
+	return s.sendData(common.JoinDataList(res.DataList))
+}
+
+// Receive a file from the client, replacing the file for
+// STOR or appending to it for APPE
+func (s *ftpSession) store(verb string, name string) ftpReply {
+	if name == "" {
+		return ftpReply{501, "Missing file name"}
+	}
+	header := s.header("WRITE", s.resolve(name))
+	if verb == "STOR" {
+		header.Params.Set(common.ParamTruncate, "true")
+	}
+	if err := checkWrite(header); err != nil {
+		recordRejection(header, s.conn, err)
+		return ftpError(err)
+	}
+
+	if err := s.reply(150, "Opening data connection"); err != nil {
+		return ftpReply{426, err.Error()}
+	}
+	conn, err := s.acceptData()
+	if err != nil {
+		return ftpReply{425, err.Error()}
+	}
+	data := &deadlineConn{Conn: conn}
+	data.setTimeout(bodyTimeout)
+	body, err := readWriteBody(header, data)
+	conn.Close()
+	if err != nil {
+		recordRejection(header, s.conn, err)
+	}
+	if code := errorCode(err); code == common.CodeQuotaExceeded || code == common.CodeTooLarge {
+		return ftpError(err)
+	}
+	if err != nil {
+		countTimeout(err)
+		return ftpReply{426, err.Error()}
+	}
+	bytesReceived.Add(int64(len(body)))
+
+	if _, err := s.perform(header, body); err != nil {
+		return ftpError(err)
+	}
+	return ftpReply{226, "Transfer complete"}
+}
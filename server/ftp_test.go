@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+// FTP client driving a session
+type testFTPClient struct {
+	t    *testing.T
+	text *textproto.Conn
+}
+
+// Send a command and check the code of its reply
+func (c *testFTPClient) expect(code int, format string, args ...any) string {
+	c.t.Helper()
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		c.t.Fatalf("%s: %v", fmt.Sprintf(format, args...), err)
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+	_, msg, err := c.text.ReadResponse(code)
+	if err != nil {
+		c.t.Errorf("%s = %v, expected %d", fmt.Sprintf(format, args...), err, code)
+	}
+	return msg
+}
+
+// Open a data connection with EPSV and run a transfer
+// command over it, returning what the server sent
+func (c *testFTPClient) transfer(upload string, format string, args ...any) string {
+	c.t.Helper()
+	return c.transferExpect(226, upload, format, args...)
+}
+
+// Run a transfer command as transfer does and check the code
+// of the reply that ends it
+func (c *testFTPClient) transferExpect(code int, upload string, format string, args ...any) string {
+	c.t.Helper()
+	msg := c.expect(229, "EPSV")
+	var port int
+	if _, err := fmt.Sscanf(msg[strings.Index(msg, "|||"):], "|||%d|", &port); err != nil {
+		c.t.Fatalf("EPSV reply %q: %v", msg, err)
+	}
+	data, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		c.t.Fatalf("dial data connection: %v", err)
+	}
+	c.expect(150, format, args...)
+	data.Write([]byte(upload))
+	data.(*net.TCPConn).CloseWrite()
+	contents, _ := ioutil.ReadAll(data)
+	data.Close()
+	if _, _, err := c.text.ReadResponse(code); err != nil {
+		c.t.Errorf("%s = %v, expected %d", fmt.Sprintf(format, args...), err, code)
+	}
+	return string(contents)
+}
+
+func TestFTPSession(t *testing.T) {
+	accountName := "ftp"
+	createTestAccount(accountName, t)
+	defer func() {
+		for _, dir := range accountDirs(accountName) {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen = %v", err)
+	}
+	defer listener.Close()
+	go acceptFTP(listener, Server{})
+
+	text, err := textproto.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial = %v", err)
+	}
+	defer text.Close()
+	if _, _, err := text.ReadResponse(220); err != nil {
+		t.Fatalf("greeting = %v", err)
+	}
+	c := &testFTPClient{t: t, text: text}
+
+	key, err := createS3Key(accountName, nil)
+	if err != nil {
+		t.Fatalf("createS3Key(%s) = %v", accountName, err)
+	}
+	secret := key.Header.Params.Get(common.ParamSecretKey)
+
+	c.expect(530, "PWD")
+	c.expect(331, "USER missing")
+	c.expect(530, "PASS %s", secret)
+	c.expect(331, "USER %s", accountName)
+	c.expect(530, "PASS wrong")
+	c.expect(331, "USER %s", accountName)
+	c.expect(230, "PASS %s", secret)
+	if features := c.expect(211, "FEAT"); strings.Contains(features, "EPSV") == false {
+		t.Errorf("FEAT = %q", features)
+	}
+
+	c.expect(257, "MKD notes")
+	c.expect(250, "CWD notes")
+	if msg := c.expect(257, "PWD"); strings.HasPrefix(msg, `"/notes"`) == false {
+		t.Errorf("PWD = %q", msg)
+	}
+	c.transfer("dear diary", "STOR monday.txt")
+	c.transfer("dear diary, again", "STOR monday.txt")
+	c.transfer("!", "APPE monday.txt")
+	if msg := c.expect(213, "SIZE monday.txt"); msg != "18" {
+		t.Errorf("SIZE = %q", msg)
+	}
+	if contents := c.transfer("", "RETR /notes/monday.txt"); contents != "dear diary, again!" {
+		t.Errorf("RETR = %q", contents)
+	}
+
+	c.expect(350, "RNFR monday.txt")
+	c.expect(250, "RNTO tuesday.txt")
+	c.expect(503, "RNTO wednesday.txt")
+	if names := c.transfer("", "NLST"); names != "tuesday.txt\r\n" {
+		t.Errorf("NLST = %q", names)
+	}
+	c.expect(250, "CDUP")
+	listing := c.transfer("", "LIST -la")
+	if strings.HasPrefix(listing, "drwxr-xr-x") == false || strings.HasSuffix(listing, " notes\r\n") == false {
+		t.Errorf("LIST = %q", listing)
+	}
+
+	c.expect(550, "CWD notes/tuesday.txt")
+	c.expect(550, "RETR missing.txt")
+	c.expect(550, "RMD notes")
+	c.expect(250, "DELE notes/tuesday.txt")
+	c.expect(250, "RMD notes")
+	c.expect(502, "PORT 127,0,0,1,4,1")
+
+	defer func(q quota) { defaultQuota = q }(defaultQuota)
+	u, err := accountUsage(accountName)
+	if err != nil {
+		t.Fatalf("accountUsage(%s) = %v", accountName, err)
+	}
+	defaultQuota = quota{maxBytes: u.bytes + 5}
+	c.transferExpect(552, "0123456789", "STOR large.txt")
+	c.expect(221, "QUIT")
+}
+
+func TestListLine(t *testing.T) {
+	params := url.Values{common.ParamSize: {"42"}, common.ParamModTime: {"2001-02-03T04:05:06Z"}}
+	line := listLine("a", "b.txt", params)
+	if line != "-rw-r--r-- 1 a a           42 Feb  3  2001 b.txt" {
+		t.Errorf("listLine = %q", line)
+	}
+}
+
+func TestFTPAdmission(t *testing.T) {
+	defer func(limit int) { maxConnections = limit }(maxConnections)
+	maxConnections = 1
+	svr, err := initServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen = %v", err)
+	}
+	sessions.listen(listener)
+	go acceptFTP(listener, svr)
+
+	dial := func() *textproto.Conn {
+		text, err := textproto.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial = %v", err)
+		}
+		return text
+	}
+	first := dial()
+	defer first.Close()
+	if _, _, err := first.ReadResponse(220); err != nil {
+		t.Fatalf("greeting = %v", err)
+	}
+	second := dial()
+	defer second.Close()
+	if _, _, err := second.ReadResponse(421); err != nil {
+		t.Errorf("session beyond the connection limit = %v, expected 421", err)
+	}
+
+	// an idle session ends on shutdown and is waited for
+	defer shuttingDown.Store(false)
+	shuttingDown.Store(true)
+	svr.listener.Close()
+	if err := shutdownServer(svr, 5*time.Second); err != nil {
+		t.Fatalf("shutdownServer() = %v", err)
+	}
+	if _, _, err := first.ReadResponse(421); err != nil {
+		t.Errorf("idle session on shutdown = %v, expected 421", err)
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Errorf("FTP listener still open after shutdown")
+	}
+}
@@ -0,0 +1,322 @@
+// HTTP gateway to accounts and files
+//
+// The gateway maps resources to the operations of the TCP
+// protocol and performs them with dispatch, so both front ends
+// share authorization, quotas, rate limits, storage, metrics
+// and the audit log:
+//
+//	GET    /accounts                    LIST-ACCOUNTS
+//	GET    /accounts/{account}          USAGE
+//	PUT    /accounts/{account}          CREATE
+//	DELETE /accounts/{account}          DELETE-ACCOUNT
+//	GET    /accounts/{account}/files/   LIST (any path ending in /)
+//	GET    /accounts/{account}/files/f  READ
+//	HEAD   /accounts/{account}/files/f  STAT
+//	PUT    /accounts/{account}/files/f  WRITE replacing the file
+//	POST   /accounts/{account}/files/f  WRITE appending to the file
+//	DELETE /accounts/{account}/files/f  DELETE
+//
+// Requests are made by the account named in the account
+// header or by the basic authentication user, or else by the
+// account of the path, and operate on the account of the path. The administrator
+// token is sent as a bearer token, versions as ETags and
+// other parameters in the query string. Files are sent as
+// they are stored and all other responses as JSON.
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+const (
+	// header naming the account making a request
+	gatewayAccountHeader string = "X-Go-Ftp-Account"
+
+	gatewayPrefix string = "/accounts"
+)
+
+// address serving the HTTP gateway, empty disables it
+var gatewayAddress string
+
+// errMethodNotAllowed is returned for methods a resource
+// does not support
+var errMethodNotAllowed = errors.New("method not allowed")
+
+// Address of the client of an HTTP request
+type httpAddr string
+
+func (a httpAddr) Network() string { return "tcp" }
+func (a httpAddr) String() string  { return string(a) }
+
+// Connection standing in for an HTTP request in the
+// operation handlers, which only use it for its address
+type httpConn struct {
+	remote httpAddr
+}
+
+func (c *httpConn) Read(b []byte) (int, error)         { return 0, io.EOF }
+func (c *httpConn) Write(b []byte) (int, error)        { return 0, errors.ErrUnsupported }
+func (c *httpConn) Close() error                       { return nil }
+func (c *httpConn) LocalAddr() net.Addr                { return httpAddr(gatewayAddress) }
+func (c *httpConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *httpConn) SetDeadline(t time.Time) error      { return nil }
+func (c *httpConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *httpConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// JSON body of a successful response
+type gatewayResult struct {
+	Op     string            `json:"op"`
+	Result string            `json:"result"`
+	Params map[string]string `json:"params,omitempty"`
+	Items  []string          `json:"items,omitempty"`
+}
+
+// JSON body of an error response
+type gatewayError struct {
+	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
+}
+
+// Map the method and path of an HTTP request to the header
+// of the operation it performs
+func gatewayHeader(r *http.Request) (common.Header, error) {
+	header := common.Header{Params: r.URL.Query()}
+	rest := strings.TrimPrefix(r.URL.Path, gatewayPrefix)
+	if rest == r.URL.Path {
+		return header, fmt.Errorf("%s: %w", r.URL.Path, os.ErrNotExist)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(rest, "/"), "/", 3)
+	account := parts[0]
+
+	var ops map[string]string
+	switch {
+	case account == "":
+		ops = map[string]string{http.MethodGet: "LIST-ACCOUNTS"}
+	case len(parts) == 1:
+		ops = map[string]string{
+			http.MethodGet:    "USAGE",
+			http.MethodPut:    "CREATE",
+			http.MethodDelete: "DELETE-ACCOUNT",
+		}
+	case parts[1] == "files" && (len(parts) == 2 || parts[2] == "" || strings.HasSuffix(parts[2], "/")):
+		ops = map[string]string{http.MethodGet: "LIST"}
+	case parts[1] == "files":
+		ops = map[string]string{
+			http.MethodGet:    "READ",
+			http.MethodHead:   "STAT",
+			http.MethodPut:    "WRITE",
+			http.MethodPost:   "WRITE",
+			http.MethodDelete: "DELETE",
+		}
+	default:
+		return header, fmt.Errorf("%s: %w", r.URL.Path, os.ErrNotExist)
+	}
+	op, ok := ops[r.Method]
+	if ok == false {
+		return header, fmt.Errorf("%w: %s %s", errMethodNotAllowed, r.Method, r.URL.Path)
+	}
+	header.Operation = op
+	if len(parts) == 3 {
+		header.FileName = strings.TrimSuffix(parts[2], "/")
+	}
+	setRequestIdentity(&header, r, account)
+	if op == "WRITE" {
+		if r.Method == http.MethodPut {
+			header.Params.Set(common.ParamTruncate, "true")
+		}
+		if r.ContentLength > 0 {
+			header.Size = uint64(r.ContentLength)
+		}
+	}
+	return header, nil
+}
+
+// Set the account making an HTTP request on an account and
+// the parameters carried by its headers
+//
+// The request is made by the account named in the account
+// header or by the user of basic authentication, or by the
+// account it operates on if neither is given. As with the
+// TCP protocol, passwords are not checked
+func setRequestIdentity(header *common.Header, r *http.Request, account string) {
+	header.Info = r.Header.Get(gatewayAccountHeader)
+	if user, _, ok := r.BasicAuth(); ok == true && header.Info == "" {
+		header.Info = user
+	}
+	if header.Info == "" {
+		header.Info = account
+	}
+	if account != "" && account != header.Info {
+		header.Params.Set(common.ParamOwner, account)
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok == true {
+		header.Params.Set(common.ParamToken, token)
+	}
+	if etag := r.Header.Get("If-Match"); etag != "" {
+		header.Params.Set(common.ParamIfMatch, strings.Trim(etag, `"`))
+	}
+	if etag := r.Header.Get("If-None-Match"); etag != "" {
+		header.Params.Set(common.ParamIfNoneMatch, strings.Trim(etag, `"`))
+	}
+}
+
+// Map an error to the HTTP status sent to the client
+func httpStatus(err error) int {
+	if errors.Is(err, errMethodNotAllowed) {
+		return http.StatusMethodNotAllowed
+	}
+	switch errorCode(err) {
+	case common.CodePreconditionFailed:
+		return http.StatusPreconditionFailed
+	case common.CodeNotFound:
+		return http.StatusNotFound
+	case common.CodeExists:
+		return http.StatusConflict
+	case common.CodeQuotaExceeded:
+		return http.StatusInsufficientStorage
+	case common.CodeReadOnly, common.CodePermissionDenied:
+		return http.StatusForbidden
+	case common.CodeThrottled:
+		return http.StatusTooManyRequests
+	case common.CodeBusy:
+		return http.StatusServiceUnavailable
+	case common.CodeTimeout:
+		return http.StatusRequestTimeout
+	case common.CodeTooLarge:
+		return http.StatusRequestEntityTooLarge
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// Send an error as JSON with the status it maps to
+func writeGatewayError(w http.ResponseWriter, err error) {
+	var throttled *throttledError
+	if errors.As(err, &throttled) == true {
+		seconds := math.Ceil(throttled.retryAfter.Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(int(seconds)))
+	}
+	writeJSON(w, httpStatus(err), gatewayError{Error: err.Error(), Code: errorCode(err)})
+}
+
+// Send a value as JSON
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// Send the response to an operation
+//
+// Files are sent as they are stored with their version as
+// the ETag, STAT answers with headers only and all other
+// operations answer with their result as JSON
+func writeGatewayResponse(w http.ResponseWriter, res common.ResponseData) {
+	if version := res.Header.Params.Get(common.ParamVersion); version != "" {
+		w.Header().Set("ETag", `"`+version+`"`)
+	}
+	switch res.Header.Operation {
+	case "READ":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatUint(res.Header.Size, 10))
+		w.Write(common.JoinDataList(res.DataList))
+		return
+	case "STAT":
+		w.Header().Set("Content-Length", res.Header.Params.Get(common.ParamSize))
+		if mtime, err := time.Parse(time.RFC3339, res.Header.Params.Get(common.ParamModTime)); err == nil {
+			w.Header().Set("Last-Modified", mtime.Format(http.TimeFormat))
+		}
+		return
+	}
+
+	result := gatewayResult{Op: res.Header.Operation, Result: res.Header.Info}
+	if len(res.Header.Params) > 0 {
+		result.Params = make(map[string]string)
+		for key := range res.Header.Params {
+			result.Params[key] = res.Header.Params.Get(key)
+		}
+	}
+	if res.DataList != nil {
+		for iter := res.DataList.Front(); iter != nil; iter = iter.Next() {
+			data := iter.Value.(common.Data)
+			result.Items = append(result.Items, strings.TrimSuffix(string(data.Buffer[:data.Size]), "\n"))
+		}
+	}
+	status := http.StatusOK
+	if res.Header.Operation == "CREATE" {
+		status = http.StatusCreated
+	}
+	writeJSON(w, status, result)
+}
+
+// Serve requests to the HTTP gateway
+func gatewayHandler(svr Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		conn := trackConnection(&httpConn{remote: httpAddr(r.RemoteAddr)})
+		data, err := readGatewayRequest(r, conn)
+		if err != nil {
+			requestMetrics.observe(data.Header.Operation, err, time.Since(start))
+			recordRejection(data.Header, conn, err)
+			connLogger(conn).Warn("unable to read request", "err", err)
+			writeGatewayError(w, err)
+			return
+		}
+
+		res, err := dispatch(data, svr)
+		duration := time.Since(start)
+		if err != nil {
+			connLogger(conn).Warn("request failed", "err", err, "code", errorCode(err), "duration", duration)
+			writeGatewayError(w, err)
+			return
+		}
+		writeGatewayResponse(w, res)
+		bytesSent.Add(int64(res.Header.Size))
+		connLogger(conn).Info("handled request", "size", data.Header.Size, "duration", duration)
+	}
+}
+
+// Map an HTTP request to an operation and read its body,
+// checking the same limits as handleConnection
+func readGatewayRequest(r *http.Request, conn net.Conn) (common.ClientData, error) {
+	header, err := gatewayHeader(r)
+	data := common.ClientData{Header: header, DataList: list.New(), Conn: conn}
+	if err != nil {
+		return data, err
+	}
+	annotateConn(conn, "op", header.Operation, "account", header.Info, "file", header.FileName)
+
+	if shuttingDown.Load() == true {
+		return data, fmt.Errorf("%w: shutting down", errServerBusy)
+	}
+	if err := checkRateLimits(header, conn); err != nil {
+		return data, err
+	}
+	if err := checkWrite(header); err != nil {
+		return data, err
+	}
+
+	if header.Operation == "WRITE" {
+		body, err := readWriteBody(header, r.Body)
+		if err != nil {
+			return data, err
+		}
+		data.Header.Size = uint64(len(body))
+		data.DataList.PushBack(common.Data{Size: len(body), Buffer: body})
+		bytesReceived.Add(int64(len(body)))
+	}
+	return data, nil
+}
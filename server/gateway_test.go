@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+func TestGatewayHandler(t *testing.T) {
+	accountName := "gateway"
+	defer func() {
+		for _, dir := range accountDirs(accountName) {
+			os.RemoveAll(dir)
+		}
+	}()
+	defer func(enabled bool) { dedup = enabled }(dedup)
+	defer os.RemoveAll(blobDir())
+
+	handler := gatewayHandler(Server{})
+	do := func(method string, target string, body string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		recorder := httptest.NewRecorder()
+		handler(recorder, r)
+		return recorder
+	}
+
+	if res := do("PUT", "/accounts/gateway", ""); res.Code != http.StatusCreated {
+		t.Fatalf("create account = %d %s", res.Code, res.Body.String())
+	}
+	if res := do("PUT", "/accounts/gateway", ""); res.Code != http.StatusConflict {
+		t.Errorf("create existing account = %d, expected %d", res.Code, http.StatusConflict)
+	}
+
+	for _, dedup = range []bool{false, true} {
+		file := "/accounts/gateway/files/notes.txt"
+		do("PUT", file, "hello")
+		do("POST", file, " world")
+		res := do("GET", file, "")
+		if res.Code != http.StatusOK || res.Body.String() != "hello world" {
+			t.Errorf("dedup %v: read after append = %d %q", dedup, res.Code, res.Body.String())
+		}
+
+		put := do("PUT", file, "bye", "If-Match", res.Header().Get("ETag"))
+		if put.Code != http.StatusOK {
+			t.Errorf("dedup %v: conditional replace = %d %s", dedup, put.Code, put.Body.String())
+		}
+		if res := do("GET", file, ""); res.Body.String() != "bye" || res.Header().Get("ETag") != put.Header().Get("ETag") {
+			t.Errorf("dedup %v: read after replace = %q with ETag %s", dedup, res.Body.String(), res.Header().Get("ETag"))
+		}
+		if res := do("PUT", file, "stale", "If-Match", `"stale"`); res.Code != http.StatusPreconditionFailed {
+			t.Errorf("dedup %v: stale replace = %d, expected %d", dedup, res.Code, http.StatusPreconditionFailed)
+		}
+
+		if res := do("HEAD", file, ""); res.Code != http.StatusOK || res.Header().Get("Content-Length") != "3" {
+			t.Errorf("dedup %v: stat = %d with length %s", dedup, res.Code, res.Header().Get("Content-Length"))
+		}
+		if res := do("DELETE", file, ""); res.Code != http.StatusOK {
+			t.Errorf("dedup %v: delete = %d %s", dedup, res.Code, res.Body.String())
+		}
+		if res := do("GET", file, ""); res.Code != http.StatusNotFound {
+			t.Errorf("dedup %v: read deleted file = %d, expected %d", dedup, res.Code, http.StatusNotFound)
+		}
+	}
+
+	do("PUT", "/accounts/gateway/files/a.txt", "a")
+	do("PUT", "/accounts/gateway/files/b.txt", "b")
+	res := do("GET", "/accounts/gateway/files/", "")
+	var result gatewayResult
+	if err := json.Unmarshal(res.Body.Bytes(), &result); err != nil {
+		t.Fatalf("list = %d %q: %v", res.Code, res.Body.String(), err)
+	}
+	if result.Op != "LIST" || strings.Join(result.Items, ",") != "a.txt,b.txt" {
+		t.Errorf("list = %+v, expected a.txt and b.txt", result)
+	}
+
+	var failures = []struct {
+		method  string
+		target  string
+		headers []string
+		status  int
+	}{
+		{"PATCH", "/accounts/gateway/files/a.txt", nil, http.StatusMethodNotAllowed},
+		{"GET", "/accounts/gateway/other", nil, http.StatusNotFound},
+		{"GET", "/accounts/gateway/files/a.txt", []string{gatewayAccountHeader, "stranger"}, http.StatusForbidden},
+		{"GET", "/accounts", nil, http.StatusForbidden},
+	}
+	for _, test := range failures {
+		res := do(test.method, test.target, "", test.headers...)
+		var body gatewayError
+		if res.Code != test.status || json.Unmarshal(res.Body.Bytes(), &body) != nil || body.Error == "" {
+			t.Errorf("%s %s = %d %q, expected %d", test.method, test.target, res.Code, res.Body.String(), test.status)
+		}
+	}
+}
+
+func TestGatewayThrottled(t *testing.T) {
+	defer func(l *rateLimiter) { requestLimits = l }(requestLimits)
+	requestLimits = newRateLimiter(0.5, 1)
+
+	handler := gatewayHandler(Server{})
+	var res *httptest.ResponseRecorder
+	for i := 0; i < 2; i++ {
+		res = httptest.NewRecorder()
+		handler(res, httptest.NewRequest("GET", "/accounts/throttled/files/a.txt", nil))
+	}
+	if res.Code != http.StatusTooManyRequests || res.Header().Get("Retry-After") != "2" {
+		t.Errorf("throttled request = %d with Retry-After %q", res.Code, res.Header().Get("Retry-After"))
+	}
+}
+
+func TestGatewayBodyLimit(t *testing.T) {
+	accountName := "gateway_limit"
+	createTestAccount(accountName, t)
+	defer func() {
+		for _, dir := range accountDirs(accountName) {
+			os.RemoveAll(dir)
+		}
+	}()
+	defer func(q quota, size int64) { defaultQuota, maxBodySize = q, size }(defaultQuota, maxBodySize)
+
+	handler := gatewayHandler(Server{})
+	put := func(body string) int {
+		// a reader of unknown length is sent without a Content-Length
+		r := httptest.NewRequest("PUT", "/accounts/gateway_limit/files/big.txt", io.MultiReader(strings.NewReader(body)))
+		res := httptest.NewRecorder()
+		handler(res, r)
+		return res.Code
+	}
+
+	defaultQuota = quota{maxBytes: 10}
+	if code := put("0123456789a"); code != http.StatusInsufficientStorage {
+		t.Errorf("body beyond the quota = %d, expected %d", code, http.StatusInsufficientStorage)
+	}
+	if code := put("0123456789"); code != http.StatusOK {
+		t.Errorf("body within the quota = %d, expected %d", code, http.StatusOK)
+	}
+
+	defaultQuota = quota{}
+	maxBodySize = 4
+	if code := put("01234"); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("body beyond the server limit = %d, expected %d", code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestGatewayAuditRejections(t *testing.T) {
+	accountName := "gateway_audit"
+	createTestAccount(accountName, t)
+	defer func() {
+		for _, dir := range accountDirs(accountName) {
+			os.RemoveAll(dir)
+		}
+	}()
+	defer useTestAuditLog(t)()
+	defer func(size int64) { maxBodySize = size }(maxBodySize)
+	maxBodySize = 4
+
+	r := httptest.NewRequest("PUT", "/accounts/gateway_audit/files/big.txt", strings.NewReader("01234"))
+	gatewayHandler(Server{})(httptest.NewRecorder(), r)
+
+	entries := recordedAudit(t)
+	if len(entries) != 1 {
+		t.Fatalf("recorded %d entries, expected the rejected write", len(entries))
+	}
+	entry := entries[0]
+	if entry.Op != "WRITE" || entry.Account != accountName || entry.File != "big.txt" || entry.Outcome != common.CodeTooLarge {
+		t.Errorf("rejected write recorded as %+v", entry)
+	}
+}
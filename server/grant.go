@@ -0,0 +1,303 @@
+// Cross-account sharing through access grants
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+// Operations another account may perform with a grant,
+// and the access they require
+var grantOps = map[string]string{
+	"READ":     common.AccessRead,
+	"STAT":     common.AccessRead,
+	"LIST":     common.AccessRead,
+	"VERSIONS": common.AccessRead,
+	"WRITE":    common.AccessReadWrite,
+	"DELETE":   common.AccessReadWrite,
+	"MKDIR":    common.AccessReadWrite,
+	"RMDIR":    common.AccessReadWrite,
+	"MOVE":     common.AccessReadWrite,
+	"COPY":     common.AccessReadWrite,
+	"RESTORE":  common.AccessReadWrite,
+	"UNDELETE": common.AccessReadWrite,
+}
+
+// serializes changes to the grant files
+var grantsLock sync.Mutex
+
+// Access to a file or directory of an owner given to a grantee
+//
+// An empty path grants access to the whole account
+type grant struct {
+	owner   string
+	grantee string
+	access  string
+	path    string
+}
+
+// Directory holding the grants given by every account
+func grantsDir() string {
+	return path.Join(stateDir(), "grants")
+}
+
+// Serialize a grant as a line of its owner's grant file
+func (g grant) String() string {
+	return fmt.Sprintf("%s %s /%s\n", g.grantee, g.access, url.PathEscape(g.path))
+}
+
+// Check whether a grant gives the access needed for a file
+func (g grant) allows(fileName string, access string) bool {
+	if access == common.AccessReadWrite && g.access != common.AccessReadWrite {
+		return false
+	}
+	fileName = path.Clean(fileName)
+	return g.path == "" || fileName == g.path || strings.HasPrefix(fileName, g.path+"/")
+}
+
+// Check that a file name stays within its account
+func checkFileName(fileName string) error {
+	clean := path.Clean(fileName)
+	if path.IsAbs(fileName) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return fmt.Errorf("invalid file name: %q", fileName)
+	}
+	return nil
+}
+
+// Read the grants given by an owner
+func readGrants(owner string) ([]grant, error) {
+	file, err := os.Open(path.Join(grantsDir(), owner))
+	if os.IsNotExist(err) == true {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var grants []grant
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			continue
+		}
+		grantPath, err := url.PathUnescape(strings.TrimPrefix(fields[2], "/"))
+		if err != nil {
+			continue
+		}
+		grants = append(grants, grant{owner, fields[0], fields[1], grantPath})
+	}
+	return grants, scanner.Err()
+}
+
+// Replace the grants given by an owner
+func writeGrants(owner string, grants []grant) error {
+	if err := os.MkdirAll(grantsDir(), os.FileMode(0744)); err != nil {
+		return err
+	}
+	var contents strings.Builder
+	for _, g := range grants {
+		contents.WriteString(g.String())
+	}
+	return ioutil.WriteFile(path.Join(grantsDir(), owner), []byte(contents.String()), defaultPerms)
+}
+
+// Check that an account was granted the access an operation
+// needs to a file of an owner
+func checkGrant(owner string, account string, op string, fileName string) error {
+	access, ok := grantOps[op]
+	if ok == false {
+		return fmt.Errorf("%w: %s on another account", errPermissionDenied, op)
+	}
+
+	grants, err := readGrants(owner)
+	if err != nil {
+		return err
+	}
+	for _, g := range grants {
+		if g.grantee == account && g.allows(fileName, access) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s has no %s access to %s of %s", errPermissionDenied, account, access, fileName, owner)
+}
+
+// Determine the account a request operates on
+//
+// Requests naming another account with the owner parameter
+// operate on that account if it granted them access to the
+// file and to any destination, or if they come from an
+// administrator. The account and owner must be valid account
+// names unless the operation is on the server itself
+func resolveAccount(header common.Header) (string, error) {
+	if serverOps[header.Operation] == false {
+		if err := checkAccountName(header.Info); err != nil {
+			return "", err
+		}
+	}
+	if err := checkFileName(header.FileName); err != nil {
+		return "", err
+	}
+	owner := header.Params.Get(common.ParamOwner)
+	if owner == "" || owner == header.Info {
+		return header.Info, nil
+	}
+	if err := checkAccountName(owner); err != nil {
+		return "", err
+	}
+	if isAdmin(header.Params) == true {
+		return owner, nil
+	}
+	if err := checkGrant(owner, header.Info, header.Operation, header.FileName); err != nil {
+		return "", err
+	}
+	if dest := header.Params.Get(common.ParamDestination); dest != "" {
+		if err := checkGrant(owner, header.Info, header.Operation, dest); err != nil {
+			return "", err
+		}
+	}
+	return owner, nil
+}
+
+// Give the account named by the grantee parameter access to
+// a file or directory of the given account, or to the whole
+// account if no file name is given
+//
+// The access parameter is either read or read-write
+func grantAccess(account string, fileName string, params url.Values, conn net.Conn) (common.ResponseData, error) {
+	g := grant{account, params.Get(common.ParamGrantee), params.Get(common.ParamAccess), path.Clean("/" + fileName)[1:]}
+	if err := checkAccountName(g.grantee); err != nil {
+		return common.ResponseData{}, err
+	}
+	if g.access != common.AccessRead && g.access != common.AccessReadWrite {
+		return common.ResponseData{}, fmt.Errorf("invalid access: %q", g.access)
+	}
+
+	grantsLock.Lock()
+	defer grantsLock.Unlock()
+
+	grants, err := readGrants(account)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	kept := []grant{g}
+	for _, existing := range grants {
+		if existing.grantee != g.grantee || existing.path != g.path {
+			kept = append(kept, existing)
+		}
+	}
+	if err := writeGrants(account, kept); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	resp := fmt.Sprintf("granted %s %s access to /%s", g.grantee, g.access, g.path)
+	return createResponseData("GRANT", resp, "", 0, nil, conn), nil
+}
+
+// Remove the grant given by the account to the grantee
+// parameter for a file or directory
+func revokeAccess(account string, fileName string, params url.Values, conn net.Conn) (common.ResponseData, error) {
+	grantee := params.Get(common.ParamGrantee)
+	grantPath := path.Clean("/" + fileName)[1:]
+
+	grantsLock.Lock()
+	defer grantsLock.Unlock()
+
+	grants, err := readGrants(account)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	var kept []grant
+	for _, g := range grants {
+		if g.grantee != grantee || g.path != grantPath {
+			kept = append(kept, g)
+		}
+	}
+	if len(kept) == len(grants) {
+		return common.ResponseData{}, fmt.Errorf("grant to %s for /%s: %w", grantee, grantPath, os.ErrNotExist)
+	}
+	if err := writeGrants(account, kept); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	resp := fmt.Sprintf("revoked access of %s to /%s", grantee, grantPath)
+	return createResponseData("REVOKE", resp, "", 0, nil, conn), nil
+}
+
+// List the grants given and received by the given account
+//
+// Each grant is sent as a line of the form:
+//
+//	owner grantee access /path
+func listGrants(account string, conn net.Conn) (common.ResponseData, error) {
+	owners, err := ioutil.ReadDir(grantsDir())
+	if err != nil && os.IsNotExist(err) == false {
+		return common.ResponseData{}, err
+	}
+
+	var size int
+	dataList := list.New()
+	for _, owner := range owners {
+		grants, err := readGrants(owner.Name())
+		if err != nil {
+			return common.ResponseData{}, err
+		}
+		for _, g := range grants {
+			if g.owner != account && g.grantee != account {
+				continue
+			}
+			line := fmt.Sprintf("%s %s %s /%s\n", g.owner, g.grantee, g.access, g.path)
+			dataList.PushBack(common.Data{Size: len(line), Buffer: []byte(line)})
+			size += len(line)
+		}
+	}
+
+	resp := fmt.Sprintf("%d grants", dataList.Len())
+	return createResponseData("LIST-GRANTS", resp, "", uint64(size), dataList, conn), nil
+}
+
+// Move the grants received by an account to a new name,
+// or drop them if the new name is empty
+func renameGrantee(account string, newName string) error {
+	grantsLock.Lock()
+	defer grantsLock.Unlock()
+
+	owners, err := ioutil.ReadDir(grantsDir())
+	if os.IsNotExist(err) == true {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, owner := range owners {
+		grants, err := readGrants(owner.Name())
+		if err != nil {
+			return err
+		}
+		var kept []grant
+		for _, g := range grants {
+			if g.grantee == account {
+				if newName == "" {
+					continue
+				}
+				g.grantee = newName
+			}
+			kept = append(kept, g)
+		}
+		if err := writeGrants(owner.Name(), kept); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+func TestCheckFileName(t *testing.T) {
+	var tests = []struct {
+		fileName string
+		valid    bool
+	}{
+		{"", true},
+		{"journal.txt", true},
+		{"dir/journal.txt", true},
+		{"dir/../journal.txt", true},
+		{"..", false},
+		{"../other/journal.txt", false},
+		{"dir/../../other", false},
+		{"/etc/passwd", false},
+	}
+
+	for _, test := range tests {
+		if err := checkFileName(test.fileName); test.valid != (err == nil) {
+			t.Errorf("checkFileName(%q) = %v", test.fileName, err)
+		}
+	}
+}
+
+func TestGrants(t *testing.T) {
+	owner := "writer"
+	createTestAccount(owner, t)
+	defer func() {
+		for _, account := range []string{owner, "editor", "reviewer"} {
+			for _, dir := range accountDirs(account) {
+				os.RemoveAll(dir)
+			}
+		}
+	}()
+
+	give := func(grantee string, access string, fileName string) {
+		params := url.Values{common.ParamGrantee: {grantee}, common.ParamAccess: {access}}
+		if _, err := grantAccess(owner, fileName, params, nil); err != nil {
+			t.Fatalf("grantAccess(%s, %s, %v) = %v", owner, fileName, params, err)
+		}
+	}
+	give("editor", common.AccessReadWrite, "drafts")
+	give("reviewer", common.AccessRead, "")
+
+	var tests = []struct {
+		account  string
+		op       string
+		fileName string
+		allowed  bool
+	}{
+		{"editor", "WRITE", "drafts/monday.txt", true},
+		{"editor", "READ", "drafts", true},
+		{"editor", "LIST", "drafts", true},
+		{"editor", "READ", "published.txt", false},
+		{"editor", "READ", "drafts/../published.txt", false},
+		{"editor", "READ", "draftsmanship.txt", false},
+		{"editor", "SNAPSHOT", "drafts", false},
+		{"reviewer", "READ", "published.txt", true},
+		{"reviewer", "LIST", "", true},
+		{"reviewer", "DELETE", "published.txt", false},
+		{"stranger", "READ", "published.txt", false},
+		{owner, "DELETE", "published.txt", true},
+	}
+
+	for _, test := range tests {
+		header := common.Header{
+			Operation: test.op,
+			Info:      test.account,
+			FileName:  test.fileName,
+			Params:    url.Values{common.ParamOwner: {owner}},
+		}
+		account, err := resolveAccount(header)
+		if test.allowed && (err != nil || account != owner) {
+			t.Errorf("resolveAccount(%v) = %s, %v, expected access", header, account, err)
+		}
+		if test.allowed == false && errors.Is(err, errPermissionDenied) == false {
+			t.Errorf("resolveAccount(%v) = %s, %v, expected permission denied", header, account, err)
+		}
+	}
+
+	give("editor", common.AccessRead, "drafts")
+	resp, err := listGrants("editor", nil)
+	if err != nil || strings.Count(string(common.JoinDataList(resp.DataList)), "\n") != 1 {
+		t.Errorf("listGrants(editor) after replacing a grant = %q, %v", common.JoinDataList(resp.DataList), err)
+	}
+
+	if err := renameGrantee("reviewer", "critic"); err != nil {
+		t.Fatalf("renameGrantee(reviewer, critic) = %v", err)
+	}
+	if err := checkGrant(owner, "critic", "READ", "published.txt"); err != nil {
+		t.Errorf("checkGrant after renaming the grantee = %v", err)
+	}
+	if err := checkGrant(owner, "reviewer", "READ", "published.txt"); err == nil {
+		t.Errorf("grant kept the old grantee name")
+	}
+
+	revoke := url.Values{common.ParamGrantee: {"critic"}}
+	if _, err := revokeAccess(owner, "", revoke, nil); err != nil {
+		t.Errorf("revokeAccess(%s, %v) = %v", owner, revoke, err)
+	}
+	if _, err := revokeAccess(owner, "", revoke, nil); errors.Is(err, os.ErrNotExist) == false {
+		t.Errorf("repeat revokeAccess(%s, %v) = %v, expected not found", owner, revoke, err)
+	}
+	if err := checkGrant(owner, "critic", "READ", "published.txt"); err == nil {
+		t.Errorf("revoked grant still allows access")
+	}
+}
+
+func TestResolveAccountNames(t *testing.T) {
+	var tests = []struct {
+		op      string
+		account string
+		owner   string
+		valid   bool
+	}{
+		{"READ", "reader", "", true},
+		{"LIST-ACCOUNTS", "", "", true},
+		{"READ", "", "", false},
+		{"LIST", "..", "", false},
+		{"READ", ".state", "", false},
+		{"WRITE", "a/b", "", false},
+		{"READ", "reader", "..", false},
+		{"READ", "reader", ".go_ftp", false},
+	}
+
+	for _, test := range tests {
+		header := common.Header{Operation: test.op, Info: test.account, Params: url.Values{}}
+		if test.owner != "" {
+			header.Params.Set(common.ParamOwner, test.owner)
+		}
+		if _, err := resolveAccount(header); test.valid != (err == nil) {
+			t.Errorf("resolveAccount(%s by %q for %q) = %v", test.op, test.account, test.owner, err)
+		}
+	}
+
+	if rel, err := filepath.Rel(accountRoot, stateDir()); err != nil || strings.HasPrefix(rel, "../") == false {
+		t.Errorf("state directory %s is not outside the root %s", stateDir(), accountRoot)
+	}
+}
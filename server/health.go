@@ -0,0 +1,180 @@
+// Liveness and readiness checks
+//
+// The PING operation answers as soon as a worker reaches it.
+// The HTTP endpoints report liveness, which only requires the
+// server to respond, and readiness, which requires the storage
+// root to be writable, no stage of the pipeline to be saturated
+// and the server not to be shutting down.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+var (
+	// address serving the health endpoints, empty disables them
+	healthAddress string
+
+	// set once the server stops accepting connections
+	shuttingDown atomic.Bool
+)
+
+// Result of a readiness check
+type healthCheck struct {
+	name string
+	err  error
+}
+
+// Answer a PING
+func ping(conn net.Conn) (common.ResponseData, error) {
+	return createResponseData("PING", "pong", "", 0, nil, conn), nil
+}
+
+// Check that files can be created in the account root, which
+// holds the files of every account, and in the state directory
+func checkStorageWritable() error {
+	if err := os.MkdirAll(stateDir(), os.FileMode(0744)); err != nil {
+		return err
+	}
+	for _, dir := range []string{accountRoot, stateDir()} {
+		file, err := ioutil.TempFile(dir, ".health")
+		if err != nil {
+			return err
+		}
+		file.Close()
+		if err := os.Remove(file.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check that no stage of the pipeline has a full queue
+func checkSaturation(svr Server) error {
+	var saturated []string
+	if len(svr.handleChan) >= cap(svr.handleChan) {
+		saturated = append(saturated, "conn")
+	}
+	if len(svr.ioChan) >= cap(svr.ioChan) {
+		saturated = append(saturated, "io")
+	}
+	if len(svr.respChan) >= cap(svr.respChan) {
+		saturated = append(saturated, "response")
+	}
+	if len(saturated) > 0 {
+		return fmt.Errorf("saturated: %s", strings.Join(saturated, ", "))
+	}
+	return nil
+}
+
+// Report that the server is alive
+func livenessHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// Report whether the server is ready for requests, with the
+// result of each check
+func readinessHandler(svr Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks := []healthCheck{
+			{"storage", checkStorageWritable()},
+			{"workers", checkSaturation(svr)},
+		}
+		if shuttingDown.Load() == true {
+			checks = append(checks, healthCheck{"accepting", fmt.Errorf("shutting down")})
+		}
+
+		var report strings.Builder
+		status := http.StatusOK
+		for _, check := range checks {
+			if check.err != nil {
+				status = http.StatusServiceUnavailable
+				fmt.Fprintf(&report, "%s: %v\n", check.name, check.err)
+			} else {
+				fmt.Fprintf(&report, "%s: ok\n", check.name)
+			}
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, report.String())
+	}
+}
+
+// Serve the metrics, health, gateway, WebDAV and S3 endpoints on
+// their addresses, sharing a server if the addresses are the same
+//
+// Every address is bound before any is served, so an address
+// that cannot be bound fails startup as the FTP and JSON-RPC
+// addresses do. The servers are returned so shutdownServer
+// can stop them
+func serveEndpoints(svr Server) ([]*http.Server, error) {
+	muxes := make(map[string]*http.ServeMux)
+	handle := func(address string, pattern string, handler http.Handler) {
+		if address == "" {
+			return
+		}
+		if muxes[address] == nil {
+			muxes[address] = http.NewServeMux()
+		}
+		muxes[address].Handle(pattern, handler)
+	}
+	handle(metricsAddress, "/metrics", metricsHandler(svr))
+	handle(healthAddress, "/healthz", http.HandlerFunc(livenessHandler))
+	handle(healthAddress, "/readyz", readinessHandler(svr))
+	handle(gatewayAddress, gatewayPrefix, gatewayHandler(svr))
+	handle(gatewayAddress, gatewayPrefix+"/", gatewayHandler(svr))
+	handle(davAddress, davPrefix, davHandler(svr))
+	handle(s3Address, "/", s3Handler(svr))
+
+	listeners := make(map[string]net.Listener)
+	for address := range muxes {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			for _, bound := range listeners {
+				bound.Close()
+			}
+			return nil, err
+		}
+		listeners[address] = listener
+	}
+
+	var servers []*http.Server
+	for address, mux := range muxes {
+		server := newHTTPServer(address, mux)
+		servers = append(servers, server)
+		go func(server *http.Server, listener net.Listener) {
+			slog.Info("serving HTTP endpoints", "address", listener.Addr().String())
+			if err := server.Serve(listener); errors.Is(err, http.ErrServerClosed) == false {
+				slog.Error("HTTP endpoints failed", "address", server.Addr, "err", err)
+			}
+		}(server, listeners[address])
+	}
+	return servers, nil
+}
+
+// Server of HTTP endpoints holding its clients to the same
+// deadlines as those of the TCP protocol
+func newHTTPServer(address string, handler http.Handler) *http.Server {
+	var readTimeout time.Duration
+	if headerTimeout > 0 && bodyTimeout > 0 {
+		readTimeout = headerTimeout + bodyTimeout
+	}
+	return &http.Server{
+		Addr:              address,
+		Handler:           handler,
+		ReadHeaderTimeout: headerTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+func TestPing(t *testing.T) {
+	// pings are answered even while storage is locked
+	storageLock.Lock()
+	defer storageLock.Unlock()
+
+	data := common.ClientData{Header: common.Header{Operation: "PING"}}
+	_, res, err := performIO(data, Server{})
+	if err != nil || res.Header.Operation != "PING" {
+		t.Errorf("performIO(PING) = %v, %v", res.Header, err)
+	}
+}
+
+func TestReadinessHandler(t *testing.T) {
+	defer shuttingDown.Store(false)
+
+	svr := Server{
+		handleChan: make(chan net.Conn, 1),
+		ioChan:     make(chan common.ClientData, 1),
+		respChan:   make(chan common.ResponseData, 1),
+	}
+
+	var tests = []struct {
+		name     string
+		prepare  func()
+		status   int
+		contains string
+	}{
+		{"ready", func() {}, http.StatusOK, "workers: ok"},
+		{"saturated", func() { svr.ioChan <- common.ClientData{} }, http.StatusServiceUnavailable, "saturated: io"},
+		{"shutting down", func() {
+			<-svr.ioChan
+			shuttingDown.Store(true)
+		}, http.StatusServiceUnavailable, "accepting: shutting down"},
+	}
+
+	for _, test := range tests {
+		test.prepare()
+		recorder := httptest.NewRecorder()
+		readinessHandler(svr)(recorder, httptest.NewRequest("GET", "/readyz", nil))
+		if recorder.Code != test.status || strings.Contains(recorder.Body.String(), test.contains) == false {
+			t.Errorf("%s: readiness = %d %q, expected %d with %q", test.name,
+				recorder.Code, recorder.Body.String(), test.status, test.contains)
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	livenessHandler(recorder, httptest.NewRequest("GET", "/healthz", nil))
+	if recorder.Code != http.StatusOK {
+		t.Errorf("liveness = %d, expected %d", recorder.Code, http.StatusOK)
+	}
+}
+
+func TestCheckStorageWritable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go_ftp_health")
+	if err != nil {
+		t.Fatalf("unable to create storage directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(root string, state string) {
+		accountRoot = root
+		stateRoot = state
+	}(accountRoot, stateRoot)
+	accountRoot = path.Join(dir, "accounts")
+	stateRoot = path.Join(dir, "state")
+
+	// a missing account root is not ready even with a state directory
+	if err := checkStorageWritable(); err == nil {
+		t.Errorf("checkStorageWritable() without an account root succeeded")
+	}
+	os.Mkdir(accountRoot, os.FileMode(0744))
+	if err := checkStorageWritable(); err != nil {
+		t.Errorf("checkStorageWritable() = %v", err)
+	}
+}
+
+func TestServeEndpointsBind(t *testing.T) {
+	defer func(metrics, health, gateway, dav, s3 string) {
+		metricsAddress, healthAddress, gatewayAddress, davAddress, s3Address = metrics, health, gateway, dav, s3
+	}(metricsAddress, healthAddress, gatewayAddress, davAddress, s3Address)
+	metricsAddress, gatewayAddress, davAddress, s3Address = "", "", "", ""
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen = %v", err)
+	}
+	defer taken.Close()
+
+	healthAddress = taken.Addr().String()
+	metricsAddress = "127.0.0.1:0"
+	if servers, err := serveEndpoints(Server{}); err == nil {
+		for _, server := range servers {
+			server.Close()
+		}
+		t.Errorf("serveEndpoints() on an address in use succeeded")
+	}
+
+	healthAddress = "127.0.0.1:0"
+	servers, err := serveEndpoints(Server{})
+	if err != nil || len(servers) != 1 {
+		t.Fatalf("serveEndpoints() = %d servers, %v", len(servers), err)
+	}
+	servers[0].Close()
+}
@@ -0,0 +1,284 @@
+// Retained history of previous file versions
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+const (
+	defaultMaxVersions   int           = 10
+	defaultMaxVersionAge time.Duration = 0
+)
+
+var (
+	// number of previous versions retained per file
+	maxVersions int = defaultMaxVersions
+	// age after which previous versions are discarded,
+	// zero keeps them regardless of age
+	maxVersionAge time.Duration = defaultMaxVersionAge
+)
+
+// A previous version of a file
+type versionInfo struct {
+	path    string
+	version string
+	size    int64
+	saved   time.Time
+}
+
+// Directory holding the previous versions of a file
+func versionDir(account string, fileName string) string {
+	return path.Join(stateDir(), "versions", account, fileName)
+}
+
+// Copy the contents of src to a new file dst
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, defaultPerms)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Save the current contents of a file as a previous version
+// and discard versions beyond the retention limits
+//
+// Nothing is saved if the file does not exist
+func saveVersion(account string, fileName string) error {
+	filePath := path.Join(accountRoot, account, fileName)
+	version, err := fileVersion(filePath)
+	if err != nil || version == "" {
+		return err
+	}
+
+	dir := versionDir(account, fileName)
+	if err := os.MkdirAll(dir, os.FileMode(0744)); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%020d-%s", time.Now().UnixNano(), version)
+	if err := copyFile(filePath, path.Join(dir, name)); err != nil {
+		return err
+	}
+	return pruneVersions(account, fileName)
+}
+
+// List the previous versions of a file, newest first
+func listVersions(account string, fileName string) ([]versionInfo, error) {
+	dir := versionDir(account, fileName)
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) == true {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []versionInfo
+	for _, entry := range entries {
+		fields := strings.SplitN(entry.Name(), "-", 2)
+		if len(fields) != 2 || entry.IsDir() {
+			continue
+		}
+		nanos, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		versionPath := path.Join(dir, entry.Name())
+		size, err := contentSize(versionPath, entry)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, versionInfo{
+			path:    versionPath,
+			version: fields[1],
+			size:    size,
+			saved:   time.Unix(0, nanos),
+		})
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].saved.After(versions[j].saved)
+	})
+	return versions, nil
+}
+
+// Discard previous versions exceeding maxVersions or maxVersionAge
+func pruneVersions(account string, fileName string) error {
+	versions, err := listVersions(account, fileName)
+	if err != nil {
+		return err
+	}
+
+	for i, v := range versions {
+		expired := maxVersionAge > 0 && time.Since(v.saved) > maxVersionAge
+		if i >= maxVersions || expired {
+			if err := os.Remove(v.path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Find the path holding the given version of a file
+//
+// The current file is preferred over previous versions
+func findVersion(account string, fileName string, version string) (string, error) {
+	filePath := path.Join(accountRoot, account, fileName)
+	current, err := fileVersion(filePath)
+	if err != nil {
+		return "", err
+	}
+	if current == version {
+		return filePath, nil
+	}
+
+	versions, err := listVersions(account, fileName)
+	if err != nil {
+		return "", err
+	}
+	for _, v := range versions {
+		if v.version == version {
+			return v.path, nil
+		}
+	}
+	return "", fmt.Errorf("%s version %s: %w", fileName, version, os.ErrNotExist)
+}
+
+// List the previous versions of a file under the given account
+//
+// Each version is sent as a line of the form:
+//
+//	version size saved
+func versionsFile(account string, fileName string, conn net.Conn) (common.ResponseData, error) {
+	filePath := path.Join(accountRoot, account, fileName)
+
+	fileLocks.lock(filePath)
+	defer fileLocks.unlock(filePath)
+
+	if err := pruneVersions(account, fileName); err != nil {
+		return common.ResponseData{}, err
+	}
+	versions, err := listVersions(account, fileName)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+
+	var size int
+	dataList := list.New()
+	for _, v := range versions {
+		line := fmt.Sprintf("%s %d %s\n", v.version, v.size, v.saved.UTC().Format(time.RFC3339))
+		dataList.PushBack(common.Data{Size: len(line), Buffer: []byte(line)})
+		size += len(line)
+	}
+
+	resp := fmt.Sprintf("%d versions of %s", len(versions), fileName)
+	return createResponseData("VERSIONS", resp, fileName, uint64(size), dataList, conn), nil
+}
+
+// Replace the contents of a file with a copy of src, saving
+// the current contents as a previous version
+func replaceFile(account string, fileName string, src string) error {
+	dir := versionDir(account, fileName)
+	if err := os.MkdirAll(dir, os.FileMode(0744)); err != nil {
+		return err
+	}
+
+	// stage the new contents first since saving the
+	// current contents may prune src
+	staged := path.Join(dir, "restore.tmp")
+	os.Remove(staged)
+	if err := copyFile(src, staged); err != nil {
+		return err
+	}
+	if err := saveVersion(account, fileName); err != nil {
+		os.Remove(staged)
+		return err
+	}
+	return os.Rename(staged, path.Join(accountRoot, account, fileName))
+}
+
+// Check the growth of an account from replacing a file
+// with a previous version stays within its quota
+func checkRestoreQuota(account string, fileName string, src string) error {
+	srcInfo, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	growth, err := contentSize(src, srcInfo)
+	if err != nil {
+		return err
+	}
+	filePath := path.Join(accountRoot, account, fileName)
+	if info, err := os.Stat(filePath); err == nil {
+		size, err := contentSize(filePath, info)
+		if err != nil {
+			return err
+		}
+		growth -= size
+	}
+	if growth < 0 {
+		growth = 0
+	}
+	return checkQuota(account, fileName, growth)
+}
+
+// Restore a previous version of a file under the given account
+//
+// The current contents are saved as a version before being
+// replaced, so a restore can itself be undone
+func restoreFile(account string, fileName string, params url.Values, conn net.Conn) (common.ResponseData, error) {
+	filePath := path.Join(accountRoot, account, fileName)
+	version := params.Get(common.ParamVersion)
+	if version == "" {
+		return common.ResponseData{}, fmt.Errorf("restore of %s requires a version", fileName)
+	}
+
+	fileLocks.lock(filePath)
+	defer fileLocks.unlock(filePath)
+
+	if err := checkPrecondition(filePath, params); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	src, err := findVersion(account, fileName, version)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	if src != filePath {
+		if err := checkRestoreQuota(account, fileName, src); err != nil {
+			return common.ResponseData{}, err
+		}
+		if err := replaceFile(account, fileName, src); err != nil {
+			return common.ResponseData{}, err
+		}
+	}
+
+	resp := fmt.Sprintf("restored %s to %s", fileName, version)
+	res := createResponseData("RESTORE", resp, "", 0, nil, conn)
+	res.Header.Params = versionParams(version)
+	return res, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+// write a message to a file under an account and return its version
+func writeTestFile(accountName string, fileName string, message string, t *testing.T) string {
+	dataList := list.New()
+	dataList.PushBack(common.Data{Size: len(message), Buffer: []byte(message)})
+	resp, err := writeFile(accountName, fileName, nil, dataList, nil)
+	if err != nil {
+		t.Fatalf("unable to write test file: %v", err)
+	}
+	return resp.Header.Params.Get(common.ParamVersion)
+}
+
+func TestVersionHistory(t *testing.T) {
+	accountName := "history"
+	accountPath := createTestAccount(accountName, t)
+	defer os.RemoveAll(accountPath)
+	defer os.RemoveAll(path.Join(stateDir(), "versions", accountName))
+	defer os.RemoveAll(trashDir(accountName))
+
+	fileName := "journal.txt"
+	first := writeTestFile(accountName, fileName, "dear diary", t)
+	writeTestFile(accountName, fileName, ", today", t)
+
+	resp, err := versionsFile(accountName, fileName, nil)
+	if err != nil {
+		t.Fatalf("versionsFile(%s, %s) = %v", accountName, fileName, err)
+	}
+	if resp.DataList.Len() != 1 {
+		t.Fatalf("versionsFile(%s, %s) returned %d versions, want 1", accountName, fileName, resp.DataList.Len())
+	}
+	line := string(resp.DataList.Front().Value.(common.Data).Buffer)
+	if strings.HasPrefix(line, first+" 10 ") == false {
+		t.Errorf("unexpected version line: %q", line)
+	}
+
+	old, err := readFile(accountName, fileName, versionParams(first), nil)
+	if err != nil {
+		t.Fatalf("readFile of version %s = %v", first, err)
+	}
+	if got := string(old.DataList.Front().Value.(common.Data).Buffer); got != "dear diary" {
+		t.Errorf("readFile of version %s = %q", first, got)
+	}
+
+	_, err = readFile(accountName, fileName, versionParams("missing"), nil)
+	if errors.Is(err, os.ErrNotExist) == false {
+		t.Errorf("readFile of missing version = %v, expected not found", err)
+	}
+
+	if _, err := deleteFile(accountName, fileName, nil, nil); err != nil {
+		t.Fatalf("deleteFile(%s, %s) = %v", accountName, fileName, err)
+	}
+
+	if _, err := restoreFile(accountName, fileName, versionParams(first), nil); err != nil {
+		t.Fatalf("restoreFile to %s = %v", first, err)
+	}
+	bytes, err := ioutil.ReadFile(path.Join(accountPath, fileName))
+	if err != nil || string(bytes) != "dear diary" {
+		t.Errorf("restored contents = %q, %v", string(bytes), err)
+	}
+
+	versions, err := listVersions(accountName, fileName)
+	if err != nil || len(versions) != 1 || versions[0].version != first {
+		t.Errorf("listVersions after restore = %v, %v", versions, err)
+	}
+}
+
+func TestPruneVersions(t *testing.T) {
+	accountName := "prune"
+	accountPath := createTestAccount(accountName, t)
+	defer os.RemoveAll(accountPath)
+	defer os.RemoveAll(path.Join(stateDir(), "versions", accountName))
+
+	defer func(count int) { maxVersions = count }(maxVersions)
+	maxVersions = 2
+
+	fileName := "journal.txt"
+	for _, message := range []string{"a", "b", "c", "d"} {
+		writeTestFile(accountName, fileName, message, t)
+	}
+
+	versions, err := listVersions(accountName, fileName)
+	if err != nil || len(versions) != maxVersions {
+		t.Errorf("listVersions = %v, %v, want %d versions", versions, err, maxVersions)
+	}
+
+	_, err = restoreFile(accountName, fileName, url.Values{}, nil)
+	if err == nil {
+		t.Errorf("restoreFile without a version succeeded")
+	}
+}
@@ -0,0 +1,84 @@
+// Per-request structured logging
+//
+// Every accepted connection carries one request, so each is
+// given a request ID on admission. The connection carries a
+// logger with the ID through the handler, io and response
+// stages, and the logger gains the operation and account
+// once the header is read.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net"
+)
+
+// A connection carrying the logger of its request
+type loggedConn struct {
+	net.Conn
+	id     string
+	logger *slog.Logger
+}
+
+// Generate an ID identifying a request in the logs
+func newRequestID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Give a newly accepted connection a request ID and logger
+func trackConnection(conn net.Conn) net.Conn {
+	id := newRequestID()
+	logger := slog.With("request", id, "remote", conn.RemoteAddr().String())
+	return &loggedConn{Conn: conn, id: id, logger: logger}
+}
+
+// ID of the request carried by a connection, empty if it
+// has none
+func connRequestID(conn net.Conn) string {
+	switch c := conn.(type) {
+	case *loggedConn:
+		return c.id
+	case *deadlineConn:
+		return connRequestID(c.Conn)
+	default:
+		return ""
+	}
+}
+
+// Logger of the request carried by a connection
+func connLogger(conn net.Conn) *slog.Logger {
+	switch c := conn.(type) {
+	case *loggedConn:
+		return c.logger
+	case *deadlineConn:
+		return connLogger(c.Conn)
+	default:
+		return slog.Default()
+	}
+}
+
+// Add attributes to every later line logged for the
+// request carried by a connection
+//
+// Stages hand a connection to the next over a channel, so
+// only one stage annotates it at a time
+func annotateConn(conn net.Conn, args ...any) {
+	switch c := conn.(type) {
+	case *loggedConn:
+		c.logger = c.logger.With(args...)
+	case *deadlineConn:
+		annotateConn(c.Conn, args...)
+	}
+}
+
+// Half-close the connection if the underlying connection
+// supports it
+func (c *loggedConn) CloseWrite() error {
+	if closer, ok := c.Conn.(interface{ CloseWrite() error }); ok == true {
+		return closer.CloseWrite()
+	}
+	return nil
+}
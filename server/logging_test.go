@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestConnLogger(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	var out strings.Builder
+	slog.SetDefault(slog.New(slog.NewTextHandler(&out, nil)))
+
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := trackConnection(server)
+	defer conn.Close()
+
+	annotateConn(&deadlineConn{Conn: conn}, "op", "READ")
+	connLogger(conn).Info("first")
+	connLogger(&deadlineConn{Conn: conn}).Info("second")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, expected 2: %q", len(lines), out.String())
+	}
+	request := conn.(*loggedConn).logger
+	if request == slog.Default() {
+		t.Fatalf("connection has the default logger")
+	}
+	var id string
+	for _, line := range lines {
+		if strings.Contains(line, "op=READ") == false {
+			t.Errorf("line %q missing operation", line)
+		}
+		fields := strings.Fields(line[strings.Index(line, "request="):])
+		if id != "" && fields[0] != id {
+			t.Errorf("request IDs differ: %s and %s", id, fields[0])
+		}
+		id = fields[0]
+	}
+
+	if connLogger(client) != slog.Default() {
+		t.Errorf("untracked connection does not use the default logger")
+	}
+}
@@ -0,0 +1,188 @@
+// Metrics served over HTTP in the Prometheus text format
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds in seconds of the request latency buckets
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+var (
+	// address serving metrics, empty disables them
+	metricsAddress string
+
+	requestMetrics = newMetrics()
+
+	// bytes of request and response bodies
+	bytesReceived atomic.Int64
+	bytesSent     atomic.Int64
+)
+
+// Distribution of request latencies
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// Requests handled by operation and outcome, and their
+// latencies by operation
+type metrics struct {
+	mu       sync.Mutex
+	requests map[[2]string]uint64
+	latency  map[string]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{requests: make(map[[2]string]uint64), latency: make(map[string]*histogram)}
+}
+
+// Outcome of a request reported in metrics
+func outcome(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	if code := errorCode(err); code != "" {
+		return code
+	}
+	return "error"
+}
+
+// Record a request of an operation finishing with an error
+// or nil after a duration
+func (m *metrics) observe(op string, err error, duration time.Duration) {
+	if op == "" {
+		op = "unknown"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[[2]string{op, outcome(err)}]++
+
+	h, ok := m.latency[op]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets))}
+		m.latency[op] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// Write the request counters and latency histograms
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([][2]string, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || (keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1])
+	})
+	writeMetricHeader(w, "go_ftp_requests_total", "counter", "Requests handled by operation and outcome.")
+	for _, key := range keys {
+		fmt.Fprintf(w, "go_ftp_requests_total{op=%q,outcome=%q} %d\n", key[0], key[1], m.requests[key])
+	}
+
+	ops := make([]string, 0, len(m.latency))
+	for op := range m.latency {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	writeMetricHeader(w, "go_ftp_request_duration_seconds", "histogram", "Time taken to handle requests by operation.")
+	for _, op := range ops {
+		h := m.latency[op]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "go_ftp_request_duration_seconds_bucket{op=%q,le=\"%g\"} %d\n", op, bound, h.buckets[i])
+		}
+		fmt.Fprintf(w, "go_ftp_request_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, h.count)
+		fmt.Fprintf(w, "go_ftp_request_duration_seconds_sum{op=%q} %g\n", op, h.sum)
+		fmt.Fprintf(w, "go_ftp_request_duration_seconds_count{op=%q} %d\n", op, h.count)
+	}
+}
+
+// Write the HELP and TYPE lines of a metric
+func writeMetricHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Write a metric with a single value
+func writeMetric(w io.Writer, name string, kind string, help string, value int64) {
+	writeMetricHeader(w, name, kind, help)
+	fmt.Fprintf(w, "%s %d\n", name, value)
+}
+
+// Write the storage used by every account
+func writeStorageMetrics(w io.Writer) error {
+	storageLock.RLock()
+	defer storageLock.RUnlock()
+
+	records, err := ioutil.ReadDir(accountsDir())
+	if err != nil && os.IsNotExist(err) == false {
+		return err
+	}
+	var bytes, files strings.Builder
+	for _, record := range records {
+		account := record.Name()
+		u, err := accountUsage(account)
+		if os.IsNotExist(err) == true {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&bytes, "go_ftp_account_bytes{account=%q} %d\n", account, u.bytes)
+		fmt.Fprintf(&files, "go_ftp_account_files{account=%q} %d\n", account, u.files)
+	}
+	writeMetricHeader(w, "go_ftp_account_bytes", "gauge", "Bytes stored by each account.")
+	io.WriteString(w, bytes.String())
+	writeMetricHeader(w, "go_ftp_account_files", "gauge", "Files stored by each account.")
+	io.WriteString(w, files.String())
+	return nil
+}
+
+// Serve the metrics of a server
+func metricsHandler(svr Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		requestMetrics.write(w)
+		writeMetric(w, "go_ftp_received_bytes_total", "counter", "Bytes of request bodies received.", bytesReceived.Load())
+		writeMetric(w, "go_ftp_sent_bytes_total", "counter", "Bytes of response bodies sent.", bytesSent.Load())
+		writeMetric(w, "go_ftp_active_connections", "gauge", "Connections admitted and not yet closed.", activeConnections.Load())
+		writeMetric(w, "go_ftp_rejected_connections_total", "counter", "Connections rejected as the server was busy.", rejectedConnections.Load())
+		writeMetric(w, "go_ftp_timed_out_connections_total", "counter", "Connections closed for missing a deadline.", timedOutConnections.Load())
+
+		writeMetricHeader(w, "go_ftp_queue_depth", "gauge", "Work waiting for each stage of the pipeline.")
+		fmt.Fprintf(w, "go_ftp_queue_depth{queue=\"handle\"} %d\n", len(svr.handleChan))
+		fmt.Fprintf(w, "go_ftp_queue_depth{queue=\"io\"} %d\n", len(svr.ioChan))
+		fmt.Fprintf(w, "go_ftp_queue_depth{queue=\"resp\"} %d\n", len(svr.respChan))
+
+		writeMetricHeader(w, "go_ftp_workers", "gauge", "Workers running in each stage of the pipeline.")
+		fmt.Fprintf(w, "go_ftp_workers{pool=\"conn\"} %d\n", svr.handlePool.workers())
+		fmt.Fprintf(w, "go_ftp_workers{pool=\"io\"} %d\n", svr.ioPool.workers())
+		fmt.Fprintf(w, "go_ftp_workers{pool=\"response\"} %d\n", svr.respPool.workers())
+
+		if err := writeStorageMetrics(w); err != nil {
+			slog.Error("unable to report storage metrics", "err", err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+func TestMetricsObserve(t *testing.T) {
+	m := newMetrics()
+	m.observe("READ", nil, 2*time.Millisecond)
+	m.observe("READ", fmt.Errorf("file: %w", os.ErrNotExist), 20*time.Millisecond)
+	m.observe("", fmt.Errorf("bad header"), time.Millisecond)
+
+	var out strings.Builder
+	m.write(&out)
+	for _, line := range []string{
+		`go_ftp_requests_total{op="READ",outcome="ok"} 1`,
+		`go_ftp_requests_total{op="READ",outcome="not-found"} 1`,
+		`go_ftp_requests_total{op="unknown",outcome="error"} 1`,
+		`go_ftp_request_duration_seconds_bucket{op="READ",le="0.005"} 1`,
+		`go_ftp_request_duration_seconds_bucket{op="READ",le="0.05"} 2`,
+		`go_ftp_request_duration_seconds_bucket{op="READ",le="+Inf"} 2`,
+		`go_ftp_request_duration_seconds_count{op="READ"} 2`,
+	} {
+		if strings.Contains(out.String(), line+"\n") == false {
+			t.Errorf("metrics missing %q in:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	account := "metrics_account"
+	createTestAccount(account, t)
+	defer func() {
+		for _, dir := range accountDirs(account) {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	// pools serving other queues so the queued request stays queued
+	handleQueue := make(chan net.Conn)
+	ioQueue := make(chan common.ClientData)
+	respQueue := make(chan common.ResponseData)
+	defer func() {
+		close(handleQueue)
+		close(ioQueue)
+		close(respQueue)
+	}()
+	svr := Server{
+		handleChan: make(chan net.Conn, 1),
+		ioChan:     make(chan common.ClientData, 1),
+		respChan:   make(chan common.ResponseData, 1),
+		handlePool: newWorkerPool("conn", handleQueue, func(net.Conn) {}, 1, 1),
+		ioPool:     newWorkerPool("io", ioQueue, func(common.ClientData) {}, 1, 1),
+		respPool:   newWorkerPool("response", respQueue, func(common.ResponseData) {}, 1, 1),
+	}
+	svr.ioChan <- common.ClientData{}
+
+	recorder := httptest.NewRecorder()
+	metricsHandler(svr)(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	for _, line := range []string{
+		`go_ftp_queue_depth{queue="io"} 1`,
+		`go_ftp_workers{pool="conn"} 1`,
+		`go_ftp_account_files{account="metrics_account"} 0`,
+	} {
+		if strings.Contains(body, line+"\n") == false {
+			t.Errorf("metrics missing %q in:\n%s", line, body)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Worker pools serving each stage of the pipeline
+//
+// A pool runs between its minimum and maximum number of
+// workers. Pools whose maximum exceeds their minimum are
+// resized every scaleInterval: a worker is added while work
+// is queued and one is removed while the queue is empty.
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWorkers       int           = 3
+	defaultScaleInterval time.Duration = 100 * time.Millisecond
+
+	// work queued between stages of the pipeline
+	pipelineQueue int = 64
+)
+
+var (
+	// workers started for each stage
+	handleConnWorkers int = defaultWorkers
+	ioWorkers         int = defaultWorkers
+	respWorkers       int = defaultWorkers
+
+	// workers each stage may grow to, no more than
+	// the starting number disables scaling
+	maxWorkers int
+	// interval between resizes of the pools
+	scaleInterval time.Duration = defaultScaleInterval
+)
+
+// Workers taking work of type T from a queue
+type workerPool[T any] struct {
+	name  string
+	queue chan T
+	work  func(T)
+	min   int
+	max   int
+
+	mu      sync.Mutex
+	size    int
+	stopped bool
+	// asks one idle worker to exit
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Create a pool of workers and start its minimum number of
+// workers
+func newWorkerPool[T any](name string, queue chan T, work func(T), low int, high int) *workerPool[T] {
+	low = max(low, 1)
+	high = max(low, high)
+	p := &workerPool[T]{name: name, queue: queue, work: work, min: low, max: high, quit: make(chan struct{}, high)}
+
+	slog.Info("creating workers", "pool", name, "workers", low, "max", high)
+	for i := 0; i < low; i++ {
+		p.grow()
+	}
+	if high > low {
+		go p.scale(scaleInterval)
+	}
+	return p
+}
+
+// Number of workers running
+func (p *workerPool[T]) workers() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
+
+// Start another worker unless the pool is at its maximum
+// or stopped
+func (p *workerPool[T]) grow() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped == true || p.size >= p.max {
+		return
+	}
+	p.size++
+	p.wg.Add(1)
+	go p.run()
+}
+
+// Ask an idle worker to exit unless the pool is at its
+// minimum
+func (p *workerPool[T]) shrink() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.size-len(p.quit) <= p.min {
+		return
+	}
+	select {
+	case p.quit <- struct{}{}:
+	default:
+	}
+}
+
+// Work until the queue is closed or the worker is asked
+// to exit
+func (p *workerPool[T]) run() {
+	defer p.wg.Done()
+	defer func() {
+		p.mu.Lock()
+		p.size--
+		p.mu.Unlock()
+	}()
+	for {
+		select {
+		case item, ok := <-p.queue:
+			if ok == false {
+				return
+			}
+			p.work(item)
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// Resize the pool to the depth of its queue every interval
+// until it is stopped
+func (p *workerPool[T]) scale(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.mu.Lock()
+		stopped := p.stopped
+		p.mu.Unlock()
+		if stopped == true {
+			return
+		}
+
+		if len(p.queue) > 0 {
+			p.grow()
+		} else {
+			p.shrink()
+		}
+	}
+}
+
+// Stop resizing the pool and wait for its workers to exit
+// once its queue is closed
+func (p *workerPool[T]) wait() {
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+	p.wg.Wait()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Wait for a pool to reach a number of workers
+func waitForWorkers(p *workerPool[int], want int, t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for p.workers() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s pool has %d workers, expected %d", p.name, p.workers(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	queue := make(chan int, 4)
+	done := make(chan int, 4)
+	p := newWorkerPool("test", queue, func(i int) { done <- i }, 2, 2)
+	if p.workers() != 2 {
+		t.Errorf("pool started %d workers, expected 2", p.workers())
+	}
+
+	for i := 0; i < 4; i++ {
+		queue <- i
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+
+	close(queue)
+	p.wait()
+	if p.workers() != 0 {
+		t.Errorf("%d workers running after the queue closed", p.workers())
+	}
+}
+
+func TestWorkerPoolScaling(t *testing.T) {
+	defer func(interval time.Duration) { scaleInterval = interval }(scaleInterval)
+	scaleInterval = time.Millisecond
+
+	queue := make(chan int, 16)
+	release := make(chan struct{})
+	p := newWorkerPool("scaling", queue, func(int) { <-release }, 1, 4)
+
+	// workers are added while work is queued
+	for i := 0; i < 16; i++ {
+		queue <- i
+	}
+	waitForWorkers(p, 4, t)
+
+	// and removed once the queue is empty
+	close(release)
+	waitForWorkers(p, 1, t)
+
+	close(queue)
+	p.wait()
+}
@@ -0,0 +1,192 @@
+// Per-account storage quotas
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+// errQuotaExceeded is returned when a request would take
+// an account beyond its quota
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// Storage limits of an account, zero means unlimited
+type quota struct {
+	maxBytes int64
+	maxFiles int64
+}
+
+// Storage used by an account
+type usage struct {
+	bytes int64
+	files int64
+}
+
+// quota applied to accounts without their own
+var defaultQuota quota
+
+// Directory holding the quotas set for single accounts
+func quotasDir() string {
+	return path.Join(stateDir(), "quotas")
+}
+
+// Look up the quota of an account
+func accountQuota(account string) (quota, error) {
+	contents, err := ioutil.ReadFile(path.Join(quotasDir(), account))
+	if os.IsNotExist(err) == true {
+		return defaultQuota, nil
+	}
+	if err != nil {
+		return quota{}, err
+	}
+
+	var q quota
+	if _, err := fmt.Sscanf(string(contents), "%d %d", &q.maxBytes, &q.maxFiles); err != nil {
+		return quota{}, fmt.Errorf("invalid quota of %s: %v", account, err)
+	}
+	return q, nil
+}
+
+// Set the quota of the given account from the max-bytes and
+// max-files parameters, where a missing parameter keeps the
+// current limit
+//
+// The default quota is restored if neither is given. The
+// resulting usage and quota are reported as for USAGE
+func setQuota(account string, params url.Values, conn net.Conn) (common.ResponseData, error) {
+	quotaPath := path.Join(quotasDir(), account)
+	maxBytes := params.Get(common.ParamMaxBytes)
+	maxFiles := params.Get(common.ParamMaxFiles)
+	if maxBytes == "" && maxFiles == "" {
+		if err := os.Remove(quotaPath); err != nil && os.IsNotExist(err) == false {
+			return common.ResponseData{}, err
+		}
+		return accountUsageInfo(account, conn)
+	}
+
+	q, err := accountQuota(account)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	if maxBytes != "" {
+		if q.maxBytes, err = strconv.ParseInt(maxBytes, 10, 64); err != nil || q.maxBytes < 0 {
+			return common.ResponseData{}, fmt.Errorf("invalid max-bytes: %q", maxBytes)
+		}
+	}
+	if maxFiles != "" {
+		if q.maxFiles, err = strconv.ParseInt(maxFiles, 10, 64); err != nil || q.maxFiles < 0 {
+			return common.ResponseData{}, fmt.Errorf("invalid max-files: %q", maxFiles)
+		}
+	}
+
+	if err := os.MkdirAll(quotasDir(), os.FileMode(0744)); err != nil {
+		return common.ResponseData{}, err
+	}
+	contents := fmt.Sprintf("%d %d\n", q.maxBytes, q.maxFiles)
+	if err := ioutil.WriteFile(quotaPath, []byte(contents), defaultPerms); err != nil {
+		return common.ResponseData{}, err
+	}
+	return accountUsageInfo(account, conn)
+}
+
+// Compute the storage used by an account: its files and those
+// it holds in the trash, previous versions and snapshots
+func accountUsage(account string) (usage, error) {
+	accountPath := path.Join(accountRoot, account)
+	u, err := treeUsage(accountPath)
+	if err != nil {
+		return u, err
+	}
+	for _, dir := range []string{versionDir(account, ""), trashDir(account), snapshotsDir(account)} {
+		held, err := treeUsage(dir)
+		if err != nil && os.IsNotExist(err) == false {
+			return u, err
+		}
+		u.bytes += held.bytes
+		u.files += held.files
+	}
+	return u, nil
+}
+
+// Check whether adding size bytes to a file of an account
+// stays within the account's quota
+func checkQuota(account string, fileName string, size int64) error {
+	exists, err := checkExistence(path.Join(accountRoot, account, fileName))
+	if err != nil {
+		return err
+	}
+	added := usage{bytes: size}
+	if exists == false {
+		added.files = 1
+	}
+	return checkQuotaUsage(account, added)
+}
+
+// Check whether adding the given bytes and files to an account
+// stays within the account's quota
+func checkQuotaUsage(account string, added usage) error {
+	q, err := accountQuota(account)
+	if err != nil {
+		return err
+	}
+	if q.maxBytes == 0 && q.maxFiles == 0 {
+		return nil
+	}
+
+	u, err := accountUsage(account)
+	if err != nil {
+		return err
+	}
+
+	if q.maxBytes > 0 && u.bytes+added.bytes > q.maxBytes {
+		return fmt.Errorf("%w: %s would use %d of %d bytes", errQuotaExceeded, account, u.bytes+added.bytes, q.maxBytes)
+	}
+	if q.maxFiles > 0 && added.files > 0 && u.files+added.files > q.maxFiles {
+		return fmt.Errorf("%w: %s would use %d of %d files", errQuotaExceeded, account, u.files+added.files, q.maxFiles)
+	}
+	return nil
+}
+
+// Total number of bytes held in a data list
+func dataListSize(dataList *list.List) int64 {
+	var size int64
+	if dataList == nil {
+		return size
+	}
+	for iter := dataList.Front(); iter != nil; iter = iter.Next() {
+		size += int64(iter.Value.(common.Data).Size)
+	}
+	return size
+}
+
+// Report the storage used by the given account and its quota
+func accountUsageInfo(account string, conn net.Conn) (common.ResponseData, error) {
+	u, err := accountUsage(account)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	q, err := accountQuota(account)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+
+	params := url.Values{}
+	params.Set(common.ParamBytes, strconv.FormatInt(u.bytes, 10))
+	params.Set(common.ParamFiles, strconv.FormatInt(u.files, 10))
+	params.Set(common.ParamMaxBytes, strconv.FormatInt(q.maxBytes, 10))
+	params.Set(common.ParamMaxFiles, strconv.FormatInt(q.maxFiles, 10))
+
+	resp := fmt.Sprintf("usage of %s", account)
+	res := createResponseData("USAGE", resp, "", 0, nil, conn)
+	res.Header.Params = params
+	return res, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+func TestCheckQuota(t *testing.T) {
+	accountName := "quota"
+	accountPath := createTestAccount(accountName, t)
+	defer os.RemoveAll(accountPath)
+
+	writeTestFile(accountName, "journal.txt", "0123456789", t)
+
+	defer func(q quota) { defaultQuota = q }(defaultQuota)
+	defaultQuota = quota{maxBytes: 15, maxFiles: 1}
+
+	var tests = []struct {
+		fileName string
+		size     int64
+		fail     bool
+	}{
+		{"journal.txt", 5, false},
+		{"journal.txt", 6, true},
+		{"other.txt", 0, true},
+	}
+
+	for _, test := range tests {
+		err := checkQuota(accountName, test.fileName, test.size)
+		if test.fail != errors.Is(err, errQuotaExceeded) {
+			t.Errorf("checkQuota(%s, %s, %d) = %v", accountName, test.fileName, test.size, err)
+		}
+	}
+
+	resp, err := accountUsageInfo(accountName, nil)
+	if err != nil {
+		t.Fatalf("accountUsageInfo(%s) = %v", accountName, err)
+	}
+	params := resp.Header.Params
+	if params.Get(common.ParamBytes) != "10" || params.Get(common.ParamFiles) != "1" ||
+		params.Get(common.ParamMaxBytes) != "15" || params.Get(common.ParamMaxFiles) != "1" {
+		t.Errorf("accountUsageInfo(%s) = %v", accountName, params)
+	}
+
+	res := createErrorResponse(checkQuota(accountName, "other.txt", 0), nil)
+	if res.Header.Params.Get(common.ParamCode) != common.CodeQuotaExceeded {
+		t.Errorf("quota error code = %s", res.Header.Params.Get(common.ParamCode))
+	}
+}
+
+func TestAccountUsageHeld(t *testing.T) {
+	accountName := "usage_held"
+	accountPath := createTestAccount(accountName, t)
+	defer os.RemoveAll(accountPath)
+	defer os.RemoveAll(trashDir(accountName))
+	defer os.RemoveAll(versionDir(accountName, ""))
+	defer os.RemoveAll(snapshotsDir(accountName))
+
+	writeTestFile(accountName, "kept.txt", "0123456789", t)
+	writeTestFile(accountName, "deleted.txt", "01234", t)
+	if err := trashFile(accountName, "deleted.txt"); err != nil {
+		t.Fatalf("trashFile(%s) = %v", accountName, err)
+	}
+	snapshot := snapshotDir(accountName, "daily")
+	if err := os.MkdirAll(snapshot, os.FileMode(0744)); err != nil {
+		t.Fatalf("unable to create snapshot: %v", err)
+	}
+	if err := copyFile(path.Join(accountPath, "kept.txt"), path.Join(snapshot, "kept.txt")); err != nil {
+		t.Fatalf("unable to copy into snapshot: %v", err)
+	}
+
+	if u, err := accountUsage(accountName); err != nil || u != (usage{25, 3}) {
+		t.Errorf("accountUsage(%s) = %+v, %v, want trash and snapshots counted", accountName, u, err)
+	}
+}
+
+func TestSetQuota(t *testing.T) {
+	accountName := "set_quota"
+	accountPath := createTestAccount(accountName, t)
+	defer os.RemoveAll(accountPath)
+	defer os.RemoveAll(path.Join(quotasDir(), accountName))
+
+	defer func(q quota) { defaultQuota = q }(defaultQuota)
+	defaultQuota = quota{maxBytes: 100, maxFiles: 10}
+
+	var tests = []struct {
+		params url.Values
+		want   quota
+		fail   bool
+	}{
+		{url.Values{common.ParamMaxBytes: {"50"}}, quota{50, 10}, false},
+		{url.Values{common.ParamMaxFiles: {"0"}}, quota{50, 0}, false},
+		{url.Values{common.ParamMaxFiles: {"-1"}}, quota{50, 0}, true},
+		{url.Values{common.ParamMaxBytes: {"lots"}}, quota{50, 0}, true},
+		{url.Values{}, quota{100, 10}, false},
+	}
+
+	for _, test := range tests {
+		_, err := setQuota(accountName, test.params, nil)
+		if test.fail != (err != nil) {
+			t.Errorf("setQuota(%s, %v) = %v", accountName, test.params, err)
+		}
+		if q, err := accountQuota(accountName); err != nil || q != test.want {
+			t.Errorf("accountQuota(%s) after setQuota(%v) = %v, %v, want %v", accountName, test.params, q, err, test.want)
+		}
+	}
+}
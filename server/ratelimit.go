@@ -0,0 +1,205 @@
+// Per-account and per-address rate limiting
+//
+// Requests and bytes transferred are limited with token
+// buckets kept for every account and every remote address.
+// A request is throttled if either of its buckets is empty.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+// interval between removals of idle buckets
+const bucketSweepInterval time.Duration = time.Minute
+
+// errThrottled is returned when a request exceeds a rate limit
+var errThrottled = errors.New("rate limit exceeded")
+
+var (
+	// requests per second allowed to each account and
+	// address, zero disables the limit
+	requestRate float64
+	// requests allowed in a burst, defaults to one
+	// second of requests
+	requestBurst float64
+	// bytes per second allowed to each account and
+	// address, zero disables the limit
+	byteRate float64
+	// bytes allowed in a burst, defaults to one second
+	// of bytes
+	byteBurst float64
+
+	requestLimits *rateLimiter
+	byteLimits    *rateLimiter
+)
+
+// A request throttled by a rate limit
+type throttledError struct {
+	limit      string
+	retryAfter time.Duration
+}
+
+func (e *throttledError) Error() string {
+	return fmt.Sprintf("%v: too many %s, retry after %v", errThrottled, e.limit, e.retryAfter)
+}
+
+func (e *throttledError) Unwrap() error {
+	return errThrottled
+}
+
+// Tokens available to one account or address
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Token buckets sharing a rate and burst size
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// Create a rate limiter, or nil if the rate is not positive
+//
+// The burst defaults to one second at the given rate
+func newRateLimiter(rate float64, burst float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = math.Max(rate, 1)
+	}
+	return &rateLimiter{rate: rate, burst: burst, buckets: make(map[string]*tokenBucket)}
+}
+
+// Refill and return the bucket for a key
+func (l *rateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+		return b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	return b
+}
+
+// Remove the buckets that have refilled completely, as
+// they are indistinguishable from new ones
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < bucketSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key := range l.buckets {
+		if l.bucket(key, now).tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Take n tokens from the bucket of every key, or none of
+// them if any bucket lacks them
+//
+// Requests larger than the burst are allowed from a full
+// bucket and leave it in debt. The time until the tokens
+// are available is returned if they were not taken
+func (l *rateLimiter) take(now time.Time, n float64, keys ...string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	need := math.Min(n, l.burst)
+	var wait time.Duration
+	for _, key := range keys {
+		if missing := need - l.bucket(key, now).tokens; missing > 0 {
+			wait = maxDuration(wait, time.Duration(missing/l.rate*float64(time.Second)))
+		}
+	}
+	if wait > 0 {
+		return (wait + time.Millisecond - 1).Truncate(time.Millisecond)
+	}
+	for _, key := range keys {
+		l.buckets[key].tokens -= n
+	}
+	return 0
+}
+
+// Take n tokens from the bucket of every key even if it
+// leaves them in debt
+func (l *rateLimiter) charge(now time.Time, n float64, keys ...string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		l.bucket(key, now).tokens -= n
+	}
+}
+
+// Longer of two durations
+func maxDuration(a time.Duration, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// Keys of the buckets charged for a request of an account
+// over a connection
+func rateLimitKeys(account string, conn net.Conn) []string {
+	keys := []string{"account:" + account}
+	if conn == nil || conn.RemoteAddr() == nil {
+		return keys
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		host = conn.RemoteAddr().String()
+	}
+	return append(keys, "address:"+host)
+}
+
+// Check the request and byte limits of the account and
+// address of a request, counting the body of a write
+//
+// Administrators are not limited
+func checkRateLimits(header common.Header, conn net.Conn) error {
+	if isAdmin(header.Params) == true {
+		return nil
+	}
+	keys := rateLimitKeys(header.Info, conn)
+	now := time.Now()
+	if wait := requestLimits.take(now, 1, keys...); wait > 0 {
+		return &throttledError{"requests", wait}
+	}
+	if header.Operation == "WRITE" {
+		if wait := byteLimits.take(now, float64(header.Size), keys...); wait > 0 {
+			return &throttledError{"bytes", wait}
+		}
+	}
+	return nil
+}
+
+// Count the body of a response against the byte limits of
+// the account and address of its request
+func chargeResponse(header common.Header, res common.ResponseData) {
+	if isAdmin(header.Params) == true {
+		return
+	}
+	byteLimits.charge(time.Now(), float64(res.Header.Size), rateLimitKeys(header.Info, res.Conn)...)
+}
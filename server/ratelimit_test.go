@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(2, 4)
+	now := time.Now()
+
+	for i := 0; i < 4; i++ {
+		if wait := limiter.take(now, 1, "a"); wait != 0 {
+			t.Fatalf("take %d within burst waits %v", i, wait)
+		}
+	}
+	if wait := limiter.take(now, 1, "a"); wait != 500*time.Millisecond {
+		t.Errorf("take beyond burst waits %v, expected 500ms", wait)
+	}
+	if wait := limiter.take(now, 1, "b"); wait != 0 {
+		t.Errorf("take from another key waits %v", wait)
+	}
+	if wait := limiter.take(now, 1, "a", "b"); wait == 0 {
+		t.Errorf("take from an empty and a full bucket succeeded")
+	}
+	if wait := limiter.take(now.Add(time.Second), 2, "a"); wait != 0 {
+		t.Errorf("take after refill waits %v", wait)
+	}
+
+	// large requests are allowed from a full bucket but leave it in debt
+	if wait := limiter.take(now, 10, "c"); wait != 0 {
+		t.Errorf("take larger than burst from a full bucket waits %v", wait)
+	}
+	if wait := limiter.take(now.Add(time.Second), 1, "c"); wait == 0 {
+		t.Errorf("take from a bucket in debt succeeded")
+	}
+
+	disabled := newRateLimiter(0, 0)
+	if wait := disabled.take(now, 1000, "a"); wait != 0 {
+		t.Errorf("take from a disabled limiter waits %v", wait)
+	}
+}
+
+func TestCheckRateLimits(t *testing.T) {
+	defer func(requests *rateLimiter, token string) {
+		requestLimits = requests
+		adminToken = token
+	}(requestLimits, adminToken)
+	requestLimits = newRateLimiter(1, 1)
+	adminToken = "secret"
+
+	header := common.Header{Operation: "READ", Info: "throttled", FileName: "file"}
+	if err := checkRateLimits(header, nil); err != nil {
+		t.Fatalf("first request throttled: %v", err)
+	}
+	err := checkRateLimits(header, nil)
+	if errors.Is(err, errThrottled) == false {
+		t.Fatalf("second request = %v, expected throttled", err)
+	}
+
+	res := createErrorResponse(err, nil)
+	if res.Header.Params.Get(common.ParamCode) != common.CodeThrottled ||
+		res.Header.Params.Get(common.ParamRetryAfter) == "" {
+		t.Errorf("throttled response params = %v", res.Header.Params)
+	}
+
+	header.Params = url.Values{common.ParamToken: {"secret"}}
+	if err := checkRateLimits(header, nil); err != nil {
+		t.Errorf("administrator request throttled: %v", err)
+	}
+}
@@ -0,0 +1,397 @@
+// JSON-RPC front end for programmatic clients
+//
+// The Files service answers JSON-RPC 1.0 calls over TCP, one
+// JSON object per call, with typed arguments and results:
+//
+//	Files.Create  CREATE of the account
+//	Files.Read    READ of a file
+//	Files.Write   WRITE of a file, appending unless truncate is set
+//	Files.Delete  DELETE of a file
+//	Files.List    LIST of a directory
+//	Files.Stat    STAT of a file or directory
+//
+// Calls are performed with dispatch, as handleIO performs the
+// requests of the TCP protocol, so they share authorization,
+// quotas, rate limits, storage, metrics and the audit log with
+// the other front ends. File contents are sent as base64, as
+// encoding/json encodes byte slices. Errors carrying a code
+// are sent as "code: message". Connections are admitted under
+// the same connection limit as the TCP protocol, and the calls
+// of a connection are answered one at a time.
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+const defaultRPCIdleTimeout time.Duration = 5 * time.Minute
+
+var (
+	// address accepting JSON-RPC clients, empty disables them
+	rpcAddress string
+	// time a JSON-RPC connection may wait for a call, zero is
+	// unlimited
+	rpcIdleTimeout time.Duration = defaultRPCIdleTimeout
+)
+
+// Account making a call and the account and file it
+// operates on
+type RequestArgs struct {
+	Account string `json:"account"`
+	// owner of the file when it is reached through a grant
+	Owner string `json:"owner,omitempty"`
+	// administrator token
+	Token string `json:"token,omitempty"`
+	File  string `json:"file,omitempty"`
+	// versions the file must, or must not, have
+	IfMatch     string `json:"if_match,omitempty"`
+	IfNoneMatch string `json:"if_none_match,omitempty"`
+}
+
+// Arguments and results of the Files methods
+
+type CreateArgs struct {
+	Account string `json:"account"`
+	Token   string `json:"token,omitempty"`
+}
+
+type CreateReply struct {
+	Result string `json:"result"`
+}
+
+type ReadArgs struct {
+	RequestArgs
+	// previous version to read instead of the current one
+	Version string `json:"version,omitempty"`
+}
+
+type ReadReply struct {
+	Data    []byte `json:"data"`
+	Version string `json:"version"`
+}
+
+type WriteArgs struct {
+	RequestArgs
+	Data []byte `json:"data"`
+	// replace the contents of the file instead of appending
+	Truncate bool `json:"truncate,omitempty"`
+}
+
+type WriteReply struct {
+	Version string `json:"version"`
+}
+
+type DeleteReply struct {
+	Result string `json:"result"`
+}
+
+type ListReply struct {
+	Names []string `json:"names"`
+}
+
+type StatReply struct {
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Version string    `json:"version,omitempty"`
+}
+
+// Files service answering the calls of one connection
+type FileService struct {
+	conn net.Conn
+	svr  Server
+}
+
+// Connection whose reads wait no longer than the idle
+// timeout of JSON-RPC clients for a call, and read no more
+// than rpcCallLimit bytes for a call
+type rpcConn struct {
+	net.Conn
+	// bytes that may be read for each call
+	limit int64
+	// bytes left to read for the current call
+	remaining int64
+}
+
+// Most bytes read for one call: a body of maxBodySize in
+// base64 and the rest of the request
+func rpcCallLimit() int64 {
+	return (maxBodySize+2)/3*4 + int64(common.MaxHeaderSize)
+}
+
+func (c *rpcConn) Read(b []byte) (int, error) {
+	// the connection ends once the calls already read are answered
+	if shuttingDown.Load() == true {
+		return 0, io.EOF
+	}
+	if c.remaining <= 0 {
+		return 0, fmt.Errorf("%w: JSON-RPC call of more than %d bytes", errTooLarge, c.limit)
+	}
+	if rpcIdleTimeout > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(rpcIdleTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.Conn.Read(b)
+	c.remaining -= int64(n)
+	return n, err
+}
+
+func (c *rpcConn) Write(b []byte) (int, error) {
+	if err := setWriteTimeout(c.Conn); err != nil {
+		return 0, err
+	}
+	return c.Conn.Write(b)
+}
+
+// Codec renewing the read limit of its connection as each
+// call is read
+//
+// rpc.Server performs each call in its own goroutine, so the
+// next call is only read once the last one is answered
+type rpcLimitCodec struct {
+	rpc.ServerCodec
+	conn *rpcConn
+	// holds a value while a call is being read or performed
+	calls chan struct{}
+}
+
+// Create a codec for the calls of a connection, each limited
+// to rpcCallLimit bytes
+func newRPCLimitCodec(conn *rpcConn) rpcLimitCodec {
+	conn.limit = rpcCallLimit()
+	return rpcLimitCodec{jsonrpc.NewServerCodec(conn), conn, make(chan struct{}, 1)}
+}
+
+func (c rpcLimitCodec) ReadRequestHeader(r *rpc.Request) error {
+	c.calls <- struct{}{}
+	c.conn.remaining = c.conn.limit
+	err := c.ServerCodec.ReadRequestHeader(r)
+	if errors.Is(err, errTooLarge) == true {
+		slog.Warn("closing JSON-RPC client", "remote", c.conn.RemoteAddr().String(), "err", err)
+	}
+	return err
+}
+
+func (c rpcLimitCodec) WriteResponse(r *rpc.Response, reply any) error {
+	defer func() { <-c.calls }()
+	return c.ServerCodec.WriteResponse(r, reply)
+}
+
+// Listen for JSON-RPC clients on the JSON-RPC address
+func serveRPC(svr Server) error {
+	listener, err := net.Listen("tcp", rpcAddress)
+	if err != nil {
+		return err
+	}
+	slog.Info("listening for JSON-RPC clients", "address", listener.Addr().String())
+	sessions.listen(listener)
+	go acceptRPC(listener, svr)
+	return nil
+}
+
+// Accept JSON-RPC clients until the listener is closed,
+// retrying other accept errors with an increasing delay
+func acceptRPC(listener net.Listener, svr Server) {
+	var backoff time.Duration
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) == true {
+			return
+		}
+		if err != nil {
+			backoff = min(max(2*backoff, minAcceptBackoff), maxAcceptBackoff)
+			slog.Error("failed to accept JSON-RPC client", "err", err, "retry", backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		sessions.admit(conn, svr, rejectRPC, func() { serveRPCConn(conn, svr) })
+	}
+}
+
+// Close the connection of a JSON-RPC client the server cannot
+// serve, which has sent no call to answer
+func rejectRPC(conn net.Conn, err error) {
+	if err := conn.Close(); err != nil {
+		slog.Error("unable to close connection", "remote", conn.RemoteAddr().String(), "err", err)
+	}
+}
+
+// Answer the calls of a connection until the client closes
+// it or stays idle for too long
+func serveRPCConn(conn net.Conn, svr Server) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Files", &FileService{conn: conn, svr: svr}); err != nil {
+		slog.Error("failed to register JSON-RPC service", "err", err)
+		conn.Close()
+		return
+	}
+	slog.Debug("accepted JSON-RPC client", "remote", conn.RemoteAddr().String())
+	limited := &rpcConn{Conn: conn}
+	server.ServeCodec(newRPCLimitCodec(limited))
+}
+
+// Perform the operation of a call, checking the same limits
+// as handleConnection
+func (f *FileService) call(header common.Header, body []byte) (common.ResponseData, error) {
+	start := time.Now()
+	conn := trackConnection(f.conn)
+	annotateConn(conn, "op", header.Operation, "account", header.Info, "file", header.FileName)
+	logger := connLogger(conn)
+
+	data := common.ClientData{Header: header, DataList: list.New(), Conn: conn}
+	if body != nil {
+		data.DataList.PushBack(common.Data{Size: len(body), Buffer: body})
+		data.Header.Size = uint64(len(body))
+		bytesReceived.Add(int64(len(body)))
+	}
+	err := checkRPCLimits(data.Header, conn)
+	if err != nil {
+		requestMetrics.observe(header.Operation, err, time.Since(start))
+		recordRejection(data.Header, conn, err)
+		logger.Warn("unable to read request", "err", err)
+		return common.ResponseData{}, rpcError(err)
+	}
+
+	res, err := dispatch(data, f.svr)
+	if err != nil {
+		logger.Warn("request failed", "err", err, "code", errorCode(err), "duration", time.Since(start))
+		return common.ResponseData{}, rpcError(err)
+	}
+	bytesSent.Add(int64(res.Header.Size))
+	logger.Info("handled request", "size", data.Header.Size, "duration", time.Since(start))
+	return res, nil
+}
+
+// Check whether the server accepts a call
+func checkRPCLimits(header common.Header, conn net.Conn) error {
+	if shuttingDown.Load() == true {
+		return fmt.Errorf("%w: shutting down", errServerBusy)
+	}
+	if err := checkRateLimits(header, conn); err != nil {
+		return err
+	}
+	return checkWrite(header)
+}
+
+// Prefix an error with its code so clients can tell errors
+// apart without parsing messages
+func rpcError(err error) error {
+	if code := errorCode(err); code != "" {
+		return fmt.Errorf("%s: %v", code, err)
+	}
+	return err
+}
+
+// Header of an operation on the file of a call
+func (args RequestArgs) header(op string) common.Header {
+	params := url.Values{}
+	for key, value := range map[string]string{
+		common.ParamOwner:       args.Owner,
+		common.ParamToken:       args.Token,
+		common.ParamIfMatch:     args.IfMatch,
+		common.ParamIfNoneMatch: args.IfNoneMatch,
+	} {
+		if value != "" {
+			params.Set(key, value)
+		}
+	}
+	return common.Header{Operation: op, Info: args.Account, FileName: args.File, Params: params}
+}
+
+// Create the account of the call
+func (f *FileService) Create(args *CreateArgs, reply *CreateReply) error {
+	header := RequestArgs{Account: args.Account, Token: args.Token}.header("CREATE")
+	res, err := f.call(header, nil)
+	if err != nil {
+		return err
+	}
+	reply.Result = res.Header.Info
+	return nil
+}
+
+// Read a file, or a previous version of it
+func (f *FileService) Read(args *ReadArgs, reply *ReadReply) error {
+	header := args.header("READ")
+	if args.Version != "" {
+		header.Params.Set(common.ParamVersion, args.Version)
+	}
+	res, err := f.call(header, nil)
+	if err != nil {
+		return err
+	}
+	reply.Data = common.JoinDataList(res.DataList)
+	reply.Version = res.Header.Params.Get(common.ParamVersion)
+	return nil
+}
+
+// Write a file, appending to it unless truncate is set
+func (f *FileService) Write(args *WriteArgs, reply *WriteReply) error {
+	header := args.header("WRITE")
+	if args.Truncate == true {
+		header.Params.Set(common.ParamTruncate, "true")
+	}
+	res, err := f.call(header, args.Data)
+	if err != nil {
+		return err
+	}
+	reply.Version = res.Header.Params.Get(common.ParamVersion)
+	return nil
+}
+
+// Delete a file by moving it to the trash
+func (f *FileService) Delete(args *RequestArgs, reply *DeleteReply) error {
+	res, err := f.call(args.header("DELETE"), nil)
+	if err != nil {
+		return err
+	}
+	reply.Result = res.Header.Info
+	return nil
+}
+
+// List the files of a directory, or of the account if no
+// file is given
+func (f *FileService) List(args *RequestArgs, reply *ListReply) error {
+	res, err := f.call(args.header("LIST"), nil)
+	if err != nil {
+		return err
+	}
+	reply.Names = []string{}
+	for iter := res.DataList.Front(); iter != nil; iter = iter.Next() {
+		data := iter.Value.(common.Data)
+		reply.Names = append(reply.Names, strings.TrimSuffix(string(data.Buffer[:data.Size]), "\n"))
+	}
+	return nil
+}
+
+// Report the type, size, modification time and version of
+// a file or directory
+func (f *FileService) Stat(args *RequestArgs, reply *StatReply) error {
+	res, err := f.call(args.header("STAT"), nil)
+	if err != nil {
+		return err
+	}
+	params := res.Header.Params
+	reply.Type = params.Get(common.ParamType)
+	reply.Size, _ = strconv.ParseInt(params.Get(common.ParamSize), 10, 64)
+	reply.ModTime, _ = time.Parse(time.RFC3339, params.Get(common.ParamModTime))
+	reply.Version = params.Get(common.ParamVersion)
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+func TestRPCService(t *testing.T) {
+	accountName := "rpc"
+	defer func() {
+		for _, dir := range accountDirs(accountName) {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen = %v", err)
+	}
+	defer listener.Close()
+	go acceptRPC(listener, Server{})
+
+	client, err := jsonrpc.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial = %v", err)
+	}
+	defer client.Close()
+
+	var created CreateReply
+	if err := client.Call("Files.Create", CreateArgs{Account: accountName}, &created); err != nil {
+		t.Fatalf("Files.Create = %v", err)
+	}
+
+	file := RequestArgs{Account: accountName, File: "notes.txt"}
+	var written WriteReply
+	if err := client.Call("Files.Write", WriteArgs{RequestArgs: file, Data: []byte("first")}, &written); err != nil {
+		t.Fatalf("Files.Write = %v", err)
+	}
+	if err := client.Call("Files.Write", WriteArgs{RequestArgs: file, Data: []byte("second"), Truncate: true}, &written); err != nil {
+		t.Fatalf("Files.Write with truncate = %v", err)
+	}
+
+	var read ReadReply
+	if err := client.Call("Files.Read", ReadArgs{RequestArgs: file}, &read); err != nil || string(read.Data) != "second" {
+		t.Errorf("Files.Read = %q, %v", read.Data, err)
+	}
+	if read.Version != written.Version {
+		t.Errorf("Files.Read version %q, expected %q", read.Version, written.Version)
+	}
+
+	var stat StatReply
+	if err := client.Call("Files.Stat", file, &stat); err != nil || stat.Type != common.TypeFile || stat.Size != 6 {
+		t.Errorf("Files.Stat = %+v, %v", stat, err)
+	}
+	var listed ListReply
+	err = client.Call("Files.List", RequestArgs{Account: accountName}, &listed)
+	if err != nil || strings.Join(listed.Names, ",") != "notes.txt" {
+		t.Errorf("Files.List = %v, %v", listed.Names, err)
+	}
+
+	stale := file
+	stale.IfMatch = "stale"
+	err = client.Call("Files.Write", WriteArgs{RequestArgs: stale, Data: []byte("third")}, &written)
+	if err == nil || strings.HasPrefix(err.Error(), common.CodePreconditionFailed+": ") == false {
+		t.Errorf("Files.Write with a stale version = %v", err)
+	}
+
+	var deleted DeleteReply
+	if err := client.Call("Files.Delete", file, &deleted); err != nil {
+		t.Errorf("Files.Delete = %v", err)
+	}
+	err = client.Call("Files.Read", ReadArgs{RequestArgs: file}, &read)
+	if err == nil || strings.HasPrefix(err.Error(), common.CodeNotFound+": ") == false {
+		t.Errorf("Files.Read of a deleted file = %v", err)
+	}
+}
+
+func TestRPCBodyLimit(t *testing.T) {
+	accountName := "rpc_limit"
+	createTestAccount(accountName, t)
+	defer func() {
+		for _, dir := range accountDirs(accountName) {
+			os.RemoveAll(dir)
+		}
+	}()
+	defer func(q quota, size int64) { defaultQuota, maxBodySize = q, size }(defaultQuota, maxBodySize)
+	defaultQuota = quota{maxBytes: 10}
+	maxBodySize = 16
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen = %v", err)
+	}
+	defer listener.Close()
+	go acceptRPC(listener, Server{})
+
+	client, err := jsonrpc.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial = %v", err)
+	}
+	defer client.Close()
+
+	file := RequestArgs{Account: accountName, File: "notes.txt"}
+	var written WriteReply
+	err = client.Call("Files.Write", WriteArgs{RequestArgs: file, Data: []byte("0123456789a"), Truncate: true}, &written)
+	if err == nil || strings.HasPrefix(err.Error(), common.CodeQuotaExceeded+": ") == false {
+		t.Errorf("Files.Write beyond the quota = %v", err)
+	}
+
+	// a call too large to be read closes the connection
+	large := make([]byte, rpcCallLimit())
+	if err := client.Call("Files.Write", WriteArgs{RequestArgs: file, Data: large}, &written); err == nil {
+		t.Errorf("Files.Write beyond the call limit succeeded")
+	}
+	if exists, _ := checkExistence(path.Join(accountRoot, accountName, "notes.txt")); exists == true {
+		t.Errorf("Files.Write beyond the limits wrote the file")
+	}
+}
+
+func TestRPCAdmission(t *testing.T) {
+	accountName := "rpc_admission"
+	createTestAccount(accountName, t)
+	defer func() {
+		for _, dir := range accountDirs(accountName) {
+			os.RemoveAll(dir)
+		}
+	}()
+	defer func(limit int) { maxConnections = limit }(maxConnections)
+	maxConnections = 1
+	svr, err := initServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen = %v", err)
+	}
+	sessions.listen(listener)
+	go acceptRPC(listener, svr)
+
+	list := func(client *rpc.Client) error {
+		var listed ListReply
+		return client.Call("Files.List", RequestArgs{Account: accountName}, &listed)
+	}
+	first, err := jsonrpc.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial = %v", err)
+	}
+	defer first.Close()
+	if err := list(first); err != nil {
+		t.Fatalf("Files.List = %v", err)
+	}
+	second, err := jsonrpc.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial = %v", err)
+	}
+	defer second.Close()
+	if err := list(second); err == nil {
+		t.Errorf("Files.List beyond the connection limit succeeded")
+	}
+
+	// an idle connection is closed on shutdown and waited for
+	defer shuttingDown.Store(false)
+	shuttingDown.Store(true)
+	svr.listener.Close()
+	if err := shutdownServer(svr, 5*time.Second); err != nil {
+		t.Fatalf("shutdownServer() = %v", err)
+	}
+	if err := list(first); err == nil {
+		t.Errorf("Files.List after shutdown succeeded")
+	}
+}
+
+// Server codec reading empty calls without a connection
+type stubServerCodec struct{}
+
+func (stubServerCodec) ReadRequestHeader(*rpc.Request) error   { return nil }
+func (stubServerCodec) ReadRequestBody(any) error              { return nil }
+func (stubServerCodec) WriteResponse(*rpc.Response, any) error { return nil }
+func (stubServerCodec) Close() error                           { return nil }
+
+func TestRPCCallsInTurn(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	codec := newRPCLimitCodec(&rpcConn{Conn: server})
+	codec.ServerCodec = stubServerCodec{}
+	if err := codec.ReadRequestHeader(&rpc.Request{}); err != nil {
+		t.Fatalf("ReadRequestHeader() = %v", err)
+	}
+
+	read := make(chan error)
+	go func() { read <- codec.ReadRequestHeader(&rpc.Request{}) }()
+	select {
+	case <-read:
+		t.Fatalf("second call read before the first was answered")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	codec.WriteResponse(&rpc.Response{}, nil)
+	select {
+	case err := <-read:
+		if err != nil {
+			t.Errorf("ReadRequestHeader() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("second call not read once the first was answered")
+	}
+}
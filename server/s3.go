@@ -0,0 +1,877 @@
+// S3-compatible front end
+//
+// Each account is a bucket addressed in path style, with the
+// objects of a bucket stored as the files of the account and
+// keys containing slashes stored in directories. Requests are
+// signed with signature version 4, in the Authorization header
+// or in the query string of a presigned URL, using an access
+// key issued to an account by the S3-KEY operation. The signing
+// account makes the request and the bucket names the account
+// operated on, so grants apply as with the other front ends:
+//
+//	GET    /                        ListBuckets, the signer's bucket
+//	HEAD   /{bucket}                HeadBucket
+//	GET    /{bucket}?list-type=2    ListObjectsV2
+//	PUT    /{bucket}/{key}          PutObject, WRITE replacing the file
+//	GET    /{bucket}/{key}          GetObject, READ
+//	HEAD   /{bucket}/{key}          HeadObject, STAT
+//	DELETE /{bucket}/{key}          DeleteObject, DELETE
+//
+// PutObject creates the directories of a key and DeleteObject
+// removes those left empty. ETags are file versions rather
+// than MD5 digests. Multipart uploads, copies and chunked
+// payload signing are not supported.
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+const (
+	s3Algorithm    string = "AWS4-HMAC-SHA256"
+	s3Namespace    string = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3DateFormat   string = "20060102T150405Z"
+	s3UnsignedBody string = "UNSIGNED-PAYLOAD"
+	s3MaxKeys      int    = 1000
+
+	// time a signature may be ahead of or, unless presigned,
+	// behind the clock of the server
+	s3MaxClockSkew time.Duration = 15 * time.Minute
+	// longest expiry of a presigned URL
+	s3MaxPresignAge time.Duration = 7 * 24 * time.Hour
+)
+
+var (
+	// address serving the S3 API, empty disables it
+	s3Address string
+
+	// serializes changes to the S3 key files
+	s3KeysLock sync.Mutex
+)
+
+// Error answered with the code and status of the S3 API
+type s3Error struct {
+	status int
+	code   string
+	err    error
+}
+
+func (e *s3Error) Error() string {
+	return e.err.Error()
+}
+
+func (e *s3Error) Unwrap() error {
+	return e.err
+}
+
+func newS3Error(status int, code string, format string, args ...any) error {
+	return &s3Error{status, code, fmt.Errorf(format, args...)}
+}
+
+// Directory holding the S3 key of every account
+func s3KeysDir() string {
+	return path.Join(stateDir(), "s3keys")
+}
+
+// Issue a new S3 access key to an account, replacing any
+// key it had
+//
+// Requires the administrator token
+func createS3Key(account string, conn net.Conn) (common.ResponseData, error) {
+	if err := checkAccountName(account); err != nil {
+		return common.ResponseData{}, err
+	}
+	exists, err := checkExistence(path.Join(accountRoot, account))
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	if exists == false {
+		return common.ResponseData{}, fmt.Errorf("account %s: %w", account, os.ErrNotExist)
+	}
+
+	id := make([]byte, 8)
+	secret := make([]byte, 30)
+	if _, err := rand.Read(id); err != nil {
+		return common.ResponseData{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return common.ResponseData{}, err
+	}
+	accessKey := "GOFTP" + strings.ToUpper(hex.EncodeToString(id))
+	secretKey := base64.RawURLEncoding.EncodeToString(secret)
+
+	s3KeysLock.Lock()
+	defer s3KeysLock.Unlock()
+	if err := os.MkdirAll(s3KeysDir(), os.FileMode(0744)); err != nil {
+		return common.ResponseData{}, err
+	}
+	contents := fmt.Sprintf("%s %s\n", accessKey, secretKey)
+	if err := ioutil.WriteFile(path.Join(s3KeysDir(), account), []byte(contents), os.FileMode(0600)); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	res := createResponseData("S3-KEY", fmt.Sprintf("issued S3 key to %s", account), "", 0, nil, conn)
+	res.Header.Params = url.Values{
+		common.ParamAccessKey: {accessKey},
+		common.ParamSecretKey: {secretKey},
+	}
+	return res, nil
+}
+
+// Read the secret of the S3 key of an account, empty if it
+// has none
+func accountS3Secret(account string) (string, error) {
+	s3KeysLock.Lock()
+	defer s3KeysLock.Unlock()
+
+	contents, err := ioutil.ReadFile(path.Join(s3KeysDir(), account))
+	if os.IsNotExist(err) == true {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	_, secret, _ := strings.Cut(strings.TrimSpace(string(contents)), " ")
+	return secret, nil
+}
+
+// Find the account and secret of an access key
+func lookupS3Key(accessKey string) (string, string, error) {
+	s3KeysLock.Lock()
+	defer s3KeysLock.Unlock()
+
+	files, err := ioutil.ReadDir(s3KeysDir())
+	if err != nil && os.IsNotExist(err) == false {
+		return "", "", err
+	}
+	for _, file := range files {
+		contents, err := ioutil.ReadFile(path.Join(s3KeysDir(), file.Name()))
+		if err != nil {
+			return "", "", err
+		}
+		id, secret, _ := strings.Cut(strings.TrimSpace(string(contents)), " ")
+		if hmac.Equal([]byte(id), []byte(accessKey)) == true {
+			return file.Name(), secret, nil
+		}
+	}
+	return "", "", newS3Error(http.StatusForbidden, "InvalidAccessKeyId", "unknown access key %q", accessKey)
+}
+
+// Escape a string as signature version 4 requires, leaving
+// only unreserved characters and, in paths, slashes
+func s3Escape(s string, keepSlash bool) string {
+	var escaped strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/' && keepSlash:
+			escaped.WriteByte(b)
+		default:
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// Build the canonical request that signature version 4 signs
+func canonicalS3Request(r *http.Request, signedHeaders []string, payloadHash string) string {
+	query, _ := url.ParseQuery(r.URL.RawQuery)
+	var pairs [][2]string
+	for key, values := range query {
+		if key == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			pairs = append(pairs, [2]string{s3Escape(key, false), s3Escape(value, false)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	params := make([]string, len(pairs))
+	for i, pair := range pairs {
+		params[i] = pair[0] + "=" + pair[1]
+	}
+
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		var value string
+		switch name {
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = r.Header.Get("Content-Length")
+			if value == "" && r.ContentLength >= 0 {
+				value = strconv.FormatInt(r.ContentLength, 10)
+			}
+		default:
+			var values []string
+			for _, v := range r.Header.Values(name) {
+				values = append(values, strings.Join(strings.Fields(v), " "))
+			}
+			value = strings.Join(values, ",")
+		}
+		fmt.Fprintf(&headers, "%s:%s\n", name, value)
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		s3Escape(r.URL.Path, true),
+		strings.Join(params, "&"),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Sign a canonical request with a secret for the credential
+// scope of a date and region
+func s3Signature(secret string, amzDate string, region string, canonical string) string {
+	day := amzDate[:8]
+	scope := strings.Join([]string{day, region, "s3", "aws4_request"}, "/")
+	digest := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{s3Algorithm, amzDate, scope, hex.EncodeToString(digest[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secret), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+// Verify the signature of a request, returning the signing
+// account and the hash of the payload it signed
+func verifyS3Request(r *http.Request, now time.Time) (string, string, error) {
+	var credential, signed, signature, amzDate, payloadHash string
+	var expires time.Duration
+	query := r.URL.Query()
+
+	if query.Get("X-Amz-Algorithm") != "" {
+		if query.Get("X-Amz-Algorithm") != s3Algorithm {
+			return "", "", newS3Error(http.StatusBadRequest, "AuthorizationQueryParametersError", "unsupported algorithm %q", query.Get("X-Amz-Algorithm"))
+		}
+		credential = query.Get("X-Amz-Credential")
+		signed = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		amzDate = query.Get("X-Amz-Date")
+		payloadHash = s3UnsignedBody
+		seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+		expires = time.Duration(seconds) * time.Second
+		if err != nil || seconds <= 0 || expires > s3MaxPresignAge {
+			return "", "", newS3Error(http.StatusBadRequest, "AuthorizationQueryParametersError", "invalid X-Amz-Expires %q", query.Get("X-Amz-Expires"))
+		}
+	} else {
+		fields, ok := strings.CutPrefix(r.Header.Get("Authorization"), s3Algorithm+" ")
+		if ok == false {
+			return "", "", newS3Error(http.StatusForbidden, "AccessDenied", "requests must be signed with %s", s3Algorithm)
+		}
+		for _, field := range strings.Split(fields, ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+			switch key {
+			case "Credential":
+				credential = value
+			case "SignedHeaders":
+				signed = value
+			case "Signature":
+				signature = value
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			return "", "", newS3Error(http.StatusBadRequest, "InvalidRequest", "missing x-amz-content-sha256")
+		}
+		if strings.HasPrefix(payloadHash, "STREAMING-") {
+			return "", "", newS3Error(http.StatusNotImplemented, "NotImplemented", "chunked payload signing is not supported")
+		}
+	}
+
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" {
+		return "", "", newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "invalid credential %q", credential)
+	}
+	signedAt, err := time.Parse(s3DateFormat, amzDate)
+	if err != nil || parts[1] != amzDate[:8] {
+		return "", "", newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "invalid date %q", amzDate)
+	}
+	if signedAt.After(now.Add(s3MaxClockSkew)) || (expires == 0 && signedAt.Before(now.Add(-s3MaxClockSkew))) {
+		return "", "", newS3Error(http.StatusForbidden, "RequestTimeTooSkewed", "request signed at %s", signedAt)
+	}
+	if expires > 0 && now.After(signedAt.Add(expires)) {
+		return "", "", newS3Error(http.StatusForbidden, "AccessDenied", "request expired at %s", signedAt.Add(expires))
+	}
+	signedHeaders := strings.Split(signed, ";")
+	if sort.StringsAreSorted(signedHeaders) == false || containsToken(signedHeaders, "host") == false {
+		return "", "", newS3Error(http.StatusBadRequest, "AuthorizationHeaderMalformed", "invalid signed headers %q", signed)
+	}
+
+	account, secret, err := lookupS3Key(parts[0])
+	if err != nil {
+		return "", "", err
+	}
+	expected := s3Signature(secret, amzDate, parts[2], canonicalS3Request(r, signedHeaders, payloadHash))
+	if hmac.Equal([]byte(expected), []byte(signature)) == false {
+		return "", "", newS3Error(http.StatusForbidden, "SignatureDoesNotMatch", "signature does not match")
+	}
+	return account, payloadHash, nil
+}
+
+// Map an error to the status and code of the S3 API
+func s3ErrorCode(err error) (int, string) {
+	var s3Err *s3Error
+	if errors.As(err, &s3Err) == true {
+		return s3Err.status, s3Err.code
+	}
+	if errors.Is(err, errMethodNotAllowed) {
+		return http.StatusMethodNotAllowed, "MethodNotAllowed"
+	}
+	switch errorCode(err) {
+	case common.CodePreconditionFailed:
+		return http.StatusPreconditionFailed, "PreconditionFailed"
+	case common.CodeNotFound:
+		return http.StatusNotFound, "NoSuchKey"
+	case common.CodeExists:
+		return http.StatusConflict, "OperationAborted"
+	case common.CodeQuotaExceeded:
+		return http.StatusInsufficientStorage, "QuotaExceeded"
+	case common.CodeReadOnly, common.CodePermissionDenied:
+		return http.StatusForbidden, "AccessDenied"
+	case common.CodeThrottled:
+		return http.StatusServiceUnavailable, "SlowDown"
+	case common.CodeBusy:
+		return http.StatusServiceUnavailable, "ServiceUnavailable"
+	case common.CodeTimeout:
+		return http.StatusBadRequest, "RequestTimeout"
+	case common.CodeTooLarge:
+		return http.StatusBadRequest, "EntityTooLarge"
+	default:
+		return http.StatusBadRequest, "InvalidRequest"
+	}
+}
+
+// XML body of an error response
+type s3ErrorResult struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+// XML body of a ListBuckets response
+type s3ListBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+// XML body of a ListObjectsV2 response
+type s3ListObjectsResult struct {
+	XMLName               xml.Name   `xml:"ListBucketResult"`
+	Xmlns                 string     `xml:"xmlns,attr"`
+	Name                  string     `xml:"Name"`
+	Prefix                string     `xml:"Prefix"`
+	Delimiter             string     `xml:"Delimiter,omitempty"`
+	StartAfter            string     `xml:"StartAfter,omitempty"`
+	EncodingType          string     `xml:"EncodingType,omitempty"`
+	MaxKeys               int        `xml:"MaxKeys"`
+	KeyCount              int        `xml:"KeyCount"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	ContinuationToken     string     `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string     `xml:"NextContinuationToken,omitempty"`
+	Contents              []s3Object `xml:"Contents"`
+	CommonPrefixes        []s3Prefix `xml:"CommonPrefixes"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         string `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3Prefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// Send a value as XML
+func writeXML(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(value)
+}
+
+// A signed S3 request on a bucket or object
+type s3Request struct {
+	w       http.ResponseWriter
+	r       *http.Request
+	conn    net.Conn
+	svr     Server
+	signer  string
+	bucket  string
+	key     string
+	payload string
+}
+
+// Header of an operation on a file of the bucket
+func (s *s3Request) header(op string, fileName string) common.Header {
+	header := common.Header{Operation: op, Info: s.signer, FileName: fileName, Params: url.Values{}}
+	if s.bucket != s.signer {
+		header.Params.Set(common.ParamOwner, s.bucket)
+	}
+	return header
+}
+
+// Perform an operation with dispatch
+func (s *s3Request) perform(header common.Header, body []byte) (common.ResponseData, error) {
+	data := common.ClientData{Header: header, DataList: list.New(), Conn: s.conn}
+	if body != nil {
+		data.DataList.PushBack(common.Data{Size: len(body), Buffer: body})
+		data.Header.Size = uint64(len(body))
+	}
+	return dispatch(data, s.svr)
+}
+
+// Serve S3 requests
+func s3Handler(svr Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		conn := trackConnection(&httpConn{remote: httpAddr(r.RemoteAddr)})
+		annotateConn(conn, "method", r.Method, "path", r.URL.Path)
+		w.Header().Set("X-Amz-Request-Id", connRequestID(conn))
+		fail := func(err error) {
+			status, code := s3ErrorCode(err)
+			connLogger(conn).Warn("request failed", "err", err, "status", status, "code", code, "duration", time.Since(start))
+			var throttled *throttledError
+			if errors.As(err, &throttled) == true {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.retryAfter.Seconds()))))
+			}
+			writeXML(w, status, s3ErrorResult{
+				Code:      code,
+				Message:   err.Error(),
+				Resource:  r.URL.Path,
+				RequestID: connRequestID(conn),
+			})
+		}
+
+		s, err := readS3Request(w, r, conn, svr)
+		if err != nil {
+			requestMetrics.observe(r.Method, err, time.Since(start))
+			fail(err)
+			return
+		}
+		status, err := s.serve()
+		if err != nil {
+			fail(err)
+			return
+		}
+		connLogger(conn).Info("handled request", "status", status, "duration", time.Since(start))
+	}
+}
+
+// Verify an S3 request and find its bucket and key, checking
+// the same limits as handleConnection
+func readS3Request(w http.ResponseWriter, r *http.Request, conn net.Conn, svr Server) (s *s3Request, err error) {
+	limited := common.Header{Operation: r.Method, FileName: r.URL.Path}
+	defer func() {
+		if err != nil {
+			recordRejection(limited, conn, err)
+		}
+	}()
+
+	signer, payload, err := verifyS3Request(r, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	s = &s3Request{w, r, conn, svr, signer, bucket, key, payload}
+	annotateConn(conn, "account", signer)
+	limited = s.header(r.Method, key)
+
+	if bucket != "" {
+		if err := checkAccountName(bucket); err != nil {
+			return nil, newS3Error(http.StatusBadRequest, "InvalidBucketName", "%v", err)
+		}
+		exists, err := checkExistence(path.Join(accountRoot, bucket))
+		if err != nil {
+			return nil, err
+		}
+		if exists == false {
+			return nil, newS3Error(http.StatusNotFound, "NoSuchBucket", "bucket %s does not exist", bucket)
+		}
+	}
+	if key != "" {
+		if err := checkFileName(key); err != nil {
+			return nil, newS3Error(http.StatusBadRequest, "InvalidArgument", "%v", err)
+		}
+	}
+
+	if shuttingDown.Load() == true {
+		return nil, fmt.Errorf("%w: shutting down", errServerBusy)
+	}
+	if r.Method == http.MethodPut {
+		limited.Operation = "WRITE"
+		limited.Size = uint64(max(r.ContentLength, 0))
+	}
+	if err := checkRateLimits(limited, conn); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Serve an S3 request, returning the status sent or the
+// error to answer with
+func (s *s3Request) serve() (int, error) {
+	query := s.r.URL.Query()
+	switch {
+	case s.bucket == "" && s.r.Method == http.MethodGet:
+		return s.listBuckets()
+	case s.bucket == "":
+		return 0, fmt.Errorf("%w: %s /", errMethodNotAllowed, s.r.Method)
+	case s.key == "" && s.r.Method == http.MethodHead:
+		s.w.WriteHeader(http.StatusOK)
+		return http.StatusOK, nil
+	case s.key == "" && s.r.Method == http.MethodGet && query.Has("location"):
+		writeXML(s.w, http.StatusOK, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Xmlns   string   `xml:"xmlns,attr"`
+		}{Xmlns: s3Namespace})
+		return http.StatusOK, nil
+	case s.key == "" && s.r.Method == http.MethodGet && query.Get("list-type") == "2":
+		return s.listObjects()
+	case s.key == "":
+		return 0, newS3Error(http.StatusNotImplemented, "NotImplemented", "%s of a bucket is not supported", s.r.Method)
+	case query.Has("uploads") || query.Has("uploadId") || s.r.Header.Get("X-Amz-Copy-Source") != "":
+		return 0, newS3Error(http.StatusNotImplemented, "NotImplemented", "multipart uploads and copies are not supported")
+	}
+
+	switch s.r.Method {
+	case http.MethodPut:
+		return s.putObject()
+	case http.MethodGet:
+		return s.getObject()
+	case http.MethodHead:
+		return s.headObject()
+	case http.MethodDelete:
+		return s.deleteObject()
+	default:
+		return 0, fmt.Errorf("%w: %s %s", errMethodNotAllowed, s.r.Method, s.r.URL.Path)
+	}
+}
+
+// List the bucket of the signing account
+func (s *s3Request) listBuckets() (int, error) {
+	result := s3ListBucketsResult{Xmlns: s3Namespace, Owner: s3Owner{s.signer, s.signer}}
+	created, err := accountCreated(s.signer)
+	if err != nil && os.IsNotExist(err) == false {
+		return 0, err
+	}
+	result.Buckets = []s3Bucket{{s.signer, created.UTC().Format(time.RFC3339)}}
+	writeXML(s.w, http.StatusOK, result)
+	return http.StatusOK, nil
+}
+
+// Read the body of an object write, checking it against the
+// limits of the write and the digests sent with it
+func (s *s3Request) readBody(header common.Header) ([]byte, error) {
+	if err := checkWrite(header); err != nil {
+		return nil, err
+	}
+	body, err := readWriteBody(header, s.r.Body)
+	if err != nil {
+		return nil, err
+	}
+	bytesReceived.Add(int64(len(body)))
+
+	if s.payload != s3UnsignedBody {
+		digest := sha256.Sum256(body)
+		if hex.EncodeToString(digest[:]) != s.payload {
+			return nil, newS3Error(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "body does not match x-amz-content-sha256")
+		}
+	}
+	if want := s.r.Header.Get("Content-MD5"); want != "" {
+		digest := md5.Sum(body)
+		if base64.StdEncoding.EncodeToString(digest[:]) != want {
+			return nil, newS3Error(http.StatusBadRequest, "BadDigest", "body does not match Content-MD5")
+		}
+	}
+	return body, nil
+}
+
+// Store an object, creating the directories of its key, or
+// create a directory for a key ending in a slash
+func (s *s3Request) putObject() (int, error) {
+	fileName := strings.TrimSuffix(s.key, "/")
+	dirs := strings.Split(fileName, "/")
+	if strings.HasSuffix(s.key, "/") == false {
+		dirs = dirs[:len(dirs)-1]
+	}
+	for i := range dirs {
+		dir := path.Join(dirs[:i+1]...)
+		if exists, err := checkExistence(path.Join(accountRoot, s.bucket, dir)); err != nil || exists == true {
+			continue
+		}
+		if _, err := s.perform(s.header("MKDIR", dir), nil); err != nil && errors.Is(err, os.ErrExist) == false {
+			return 0, err
+		}
+	}
+	if strings.HasSuffix(s.key, "/") {
+		s.w.WriteHeader(http.StatusOK)
+		return http.StatusOK, nil
+	}
+
+	header := s.header("WRITE", fileName)
+	header.Params.Set(common.ParamTruncate, "true")
+	header.Size = uint64(max(s.r.ContentLength, 0))
+	if etag := s.r.Header.Get("If-None-Match"); etag != "" {
+		header.Params.Set(common.ParamIfNoneMatch, strings.Trim(etag, `"`))
+	}
+	if etag := s.r.Header.Get("If-Match"); etag != "" {
+		header.Params.Set(common.ParamIfMatch, strings.Trim(etag, `"`))
+	}
+	body, err := s.readBody(header)
+	if err != nil {
+		recordRejection(header, s.conn, err)
+		return 0, err
+	}
+
+	res, err := s.perform(header, body)
+	if err != nil {
+		return 0, err
+	}
+	if version := res.Header.Params.Get(common.ParamVersion); version != "" {
+		s.w.Header().Set("ETag", `"`+version+`"`)
+	}
+	s.w.WriteHeader(http.StatusOK)
+	return http.StatusOK, nil
+}
+
+// Send an object, leaving ranges and conditional requests to
+// net/http
+func (s *s3Request) getObject() (int, error) {
+	res, err := s.perform(s.header("READ", s.key), nil)
+	if err != nil {
+		if errorCode(err) == "" {
+			if info, statErr := os.Stat(path.Join(accountRoot, s.bucket, s.key)); statErr == nil && info.IsDir() {
+				return 0, newS3Error(http.StatusNotFound, "NoSuchKey", "%s is a directory", s.key)
+			}
+		}
+		return 0, err
+	}
+
+	var modTime time.Time
+	if info, err := os.Stat(path.Join(accountRoot, s.bucket, s.key)); err == nil {
+		modTime = info.ModTime()
+	}
+	if version := res.Header.Params.Get(common.ParamVersion); version != "" {
+		s.w.Header().Set("ETag", `"`+version+`"`)
+	}
+	s.w.Header().Set("Content-Type", contentType(s.key))
+	http.ServeContent(s.w, s.r, s.key, modTime, bytes.NewReader(common.JoinDataList(res.DataList)))
+	bytesSent.Add(int64(res.Header.Size))
+	return http.StatusOK, nil
+}
+
+// Send the headers of an object
+func (s *s3Request) headObject() (int, error) {
+	res, err := s.perform(s.header("STAT", s.key), nil)
+	if err != nil {
+		return 0, err
+	}
+	params := res.Header.Params
+	if params.Get(common.ParamType) == common.TypeDirectory {
+		return 0, newS3Error(http.StatusNotFound, "NoSuchKey", "%s is a directory", s.key)
+	}
+	if version := params.Get(common.ParamVersion); version != "" {
+		s.w.Header().Set("ETag", `"`+version+`"`)
+	}
+	if mtime, err := time.Parse(time.RFC3339, params.Get(common.ParamModTime)); err == nil {
+		s.w.Header().Set("Last-Modified", mtime.Format(http.TimeFormat))
+	}
+	s.w.Header().Set("Content-Type", contentType(s.key))
+	s.w.Header().Set("Content-Length", params.Get(common.ParamSize))
+	s.w.Header().Set("Accept-Ranges", "bytes")
+	s.w.WriteHeader(http.StatusOK)
+	return http.StatusOK, nil
+}
+
+// Delete an object and the directories of its key left
+// empty, succeeding as S3 does if it does not exist
+func (s *s3Request) deleteObject() (int, error) {
+	fileName := strings.TrimSuffix(s.key, "/")
+	if _, err := s.perform(s.header("DELETE", fileName), nil); err != nil && errors.Is(err, os.ErrNotExist) == false {
+		return 0, err
+	}
+	for dir := path.Dir(fileName); dir != "."; dir = path.Dir(dir) {
+		files, err := ioutil.ReadDir(path.Join(accountRoot, s.bucket, dir))
+		if err != nil || len(files) > 0 {
+			break
+		}
+		if _, err := s.perform(s.header("RMDIR", dir), nil); err != nil {
+			break
+		}
+	}
+	s.w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
+
+// List the objects of the bucket in key order, grouping keys
+// by the delimiter after the prefix
+//
+// A LIST of the directory of the prefix authorizes the listing
+// and records it in the audit log
+func (s *s3Request) listObjects() (int, error) {
+	query := s.r.URL.Query()
+	result := s3ListObjectsResult{
+		Xmlns:             s3Namespace,
+		Name:              s.bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+		MaxKeys:           s3MaxKeys,
+	}
+	if value := query.Get("max-keys"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid max-keys %q", value)
+		}
+		result.MaxKeys = min(n, s3MaxKeys)
+	}
+	marker := result.StartAfter
+	if result.ContinuationToken != "" {
+		token, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+		if err != nil {
+			return 0, newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid continuation-token")
+		}
+		marker = string(token)
+	}
+
+	dir := ""
+	if i := strings.LastIndex(result.Prefix, "/"); i >= 0 {
+		dir = result.Prefix[:i]
+	}
+	if _, err := s.perform(s.header("LIST", dir), nil); err != nil && errors.Is(err, os.ErrNotExist) == false {
+		return 0, err
+	}
+	root := path.Join(accountRoot, s.bucket)
+
+	storageLock.RLock()
+	defer storageLock.RUnlock()
+
+	var keys []string
+	filepath.Walk(path.Join(root, dir), func(filePath string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			key, _ := filepath.Rel(root, filePath)
+			keys = append(keys, filepath.ToSlash(key))
+		}
+		return nil
+	})
+	sort.Strings(keys)
+
+	var last string
+	for _, key := range keys {
+		if strings.HasPrefix(key, result.Prefix) == false || key <= marker {
+			continue
+		}
+		if result.Delimiter != "" && strings.HasSuffix(marker, result.Delimiter) && strings.HasPrefix(key, marker) {
+			continue
+		}
+		entry := key
+		if result.Delimiter != "" {
+			rest := key[len(result.Prefix):]
+			if i := strings.Index(rest, result.Delimiter); i >= 0 {
+				entry = result.Prefix + rest[:i+len(result.Delimiter)]
+			}
+		}
+		if entry == last {
+			continue
+		}
+		if result.KeyCount == result.MaxKeys {
+			result.IsTruncated = true
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+			break
+		}
+		last = entry
+		result.KeyCount++
+
+		if entry != key {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3Prefix{entry})
+			continue
+		}
+		stat, err := statFile(s.bucket, key, url.Values{}, s.conn)
+		if err != nil {
+			return 0, err
+		}
+		params := stat.Header.Params
+		mtime, _ := time.Parse(time.RFC3339, params.Get(common.ParamModTime))
+		result.Contents = append(result.Contents, s3Object{
+			Key:          key,
+			LastModified: mtime.UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         `"` + params.Get(common.ParamVersion) + `"`,
+			Size:         params.Get(common.ParamSize),
+			StorageClass: "STANDARD",
+		})
+	}
+
+	if query.Get("encoding-type") == "url" {
+		result.EncodingType = "url"
+		escape := func(s string) string { return s3Escape(s, true) }
+		result.Prefix, result.Delimiter, result.StartAfter = escape(result.Prefix), escape(result.Delimiter), escape(result.StartAfter)
+		for i := range result.Contents {
+			result.Contents[i].Key = escape(result.Contents[i].Key)
+		}
+		for i := range result.CommonPrefixes {
+			result.CommonPrefixes[i].Prefix = escape(result.CommonPrefixes[i].Prefix)
+		}
+	}
+	writeXML(s.w, http.StatusOK, result)
+	return http.StatusOK, nil
+}
@@ -3,13 +3,22 @@ package main
 
 import (
 	"container/list"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"log/slog"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/teirm/go_ftp/common"
 )
@@ -17,16 +26,48 @@ import (
 const (
 	defaultPort string = "0"
 
-	handleConnWorkers int = 3
-	ioWorkers         int = 3
-	respWorkers       int = 3
-
 	headerDelim string = ":"
 
-	accountRoot  string      = "/tmp"
-	defaultPerms os.FileMode = 0644
+	defaultAccountRoot string      = "/tmp/go_ftp"
+	defaultPerms       os.FileMode = 0644
+
+	defaultMaxBodySize int64 = 256 * 1024 * 1024
 )
 
+// directory holding all accounts
+var accountRoot string = defaultAccountRoot
+
+// largest body buffered for a write whose size is not sent
+// up front
+var maxBodySize int64 = defaultMaxBodySize
+
+// errTooLarge is returned when the body of a write exceeds
+// maxBodySize
+var errTooLarge = errors.New("request body too large")
+
+// directory holding server state, empty for the default
+// beside the account root
+var stateRoot string
+
+// Directory holding versions, trash, snapshots, grants and
+// other server state
+//
+// It lies outside the account root so that no account or
+// file name can reach it
+func stateDir() string {
+	if stateRoot != "" {
+		return stateRoot
+	}
+	return path.Clean(accountRoot) + ".state"
+}
+
+// Operations run while no other operation touches storage
+var exclusiveOps = map[string]bool{
+	"GC":             true,
+	"DELETE-ACCOUNT": true,
+	"RENAME-ACCOUNT": true,
+}
+
 // Server instance containing channels and connections
 type Server struct {
 	listener net.Listener
@@ -34,15 +75,50 @@ type Server struct {
 	handleChan chan net.Conn
 	ioChan     chan common.ClientData
 	respChan   chan common.ResponseData
+
+	// one entry per connection being handled,
+	// nil if connections are unlimited
+	slots chan struct{}
+
+	// workers of each stage
+	handlePool *workerPool[net.Conn]
+	ioPool     *workerPool[common.ClientData]
+	respPool   *workerPool[common.ResponseData]
+
+	// servers of the HTTP endpoints
+	endpoints []*http.Server
 }
 
 // handle a connection and read client data
 // pass client data to io worker
 // on error pass error to response worker
-func handleConnection(connection net.Conn, svr Server) error {
-	header, err := common.ReadHeader(connection)
+func handleConnection(connection net.Conn, svr Server) (err error) {
+	start := time.Now()
+	var header common.Header
+	defer func() {
+		// successful requests are recorded once handled
+		if err != nil {
+			requestMetrics.observe(header.Operation, err, time.Since(start))
+			recordRejection(header, connection, err)
+		}
+	}()
+
+	conn := &deadlineConn{Conn: connection}
+	conn.setTimeout(headerTimeout)
+	header, err = common.ReadHeader(conn)
 	if err != nil {
-		return fmt.Errorf("failed to parse header: %v", err)
+		countTimeout(err)
+		return fmt.Errorf("failed to parse header: %w", err)
+	}
+	annotateConn(connection, "op", header.Operation, "account", header.Info, "file", header.FileName)
+	connLogger(connection).Debug("read header", "size", header.Size)
+
+	if err := checkRateLimits(header, connection); err != nil {
+		return err
+	}
+
+	if err := checkWrite(header); err != nil {
+		return err
 	}
 
 	var message common.ClientData
@@ -51,49 +127,293 @@ func handleConnection(connection net.Conn, svr Server) error {
 	message.DataList = list.New()
 
 	readSize := message.Header.Size
-	if err := common.ReadMessage(message.DataList, readSize, connection); err != nil {
-		return fmt.Errorf("error processing input: %v", err)
+	conn.setTimeout(bodyTimeout)
+	if err := common.ReadMessage(message.DataList, readSize, conn); err != nil {
+		countTimeout(err)
+		return fmt.Errorf("error processing input: %w", err)
 	}
+	bytesReceived.Add(int64(readSize))
 
 	svr.ioChan <- message
 	return nil
 }
 
+// Reject unauthorized or oversized writes before buffering
+// the body
+//
+// The declared size of a write must fit the limit of
+// readWriteBody, and other operations carry no body at all
+func checkWrite(header common.Header) error {
+	if header.Operation != "WRITE" {
+		if header.Size > 0 {
+			return fmt.Errorf("%w: %s takes no body", errTooLarge, header.Operation)
+		}
+		return nil
+	}
+	account, err := resolveAccount(header)
+	if err != nil {
+		return err
+	}
+	if header.Params.Get(common.ParamTruncate) != "true" {
+		if err := checkQuota(account, header.FileName, int64(header.Size)); err != nil {
+			return err
+		}
+	}
+	return checkWriteBody(header, int64(header.Size))
+}
+
+// Read the body of a write from a front end where its size
+// may not be known before it arrives
+//
+// Reading stops once the body outgrows the room left in the
+// account's quota or maxBodySize, so no more is buffered than
+// the write could store
+func readWriteBody(header common.Header, body io.Reader) ([]byte, error) {
+	limit, err := writeLimit(header)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("error processing input: %w", err)
+	}
+	if int64(len(contents)) > limit {
+		return nil, bodyLimitError(limit)
+	}
+	return contents, nil
+}
+
+// Check a body already received against the limits of
+// readWriteBody
+func checkWriteBody(header common.Header, size int64) error {
+	limit, err := writeLimit(header)
+	if err != nil {
+		return err
+	}
+	if size > limit {
+		return bodyLimitError(limit)
+	}
+	return nil
+}
+
+// Error for a body larger than the limit of a write
+func bodyLimitError(limit int64) error {
+	if limit < maxBodySize {
+		return fmt.Errorf("%w: room for %d more bytes", errQuotaExceeded, limit)
+	}
+	return fmt.Errorf("%w: more than %d bytes", errTooLarge, maxBodySize)
+}
+
+// Bytes the body of a write may hold: the room its quota
+// leaves the account, no more than maxBodySize
+func writeLimit(header common.Header) (int64, error) {
+	account, err := resolveAccount(header)
+	if err != nil {
+		return 0, err
+	}
+	q, err := accountQuota(account)
+	if err != nil || q.maxBytes == 0 {
+		return maxBodySize, err
+	}
+	u, err := accountUsage(account)
+	if err != nil {
+		return 0, err
+	}
+
+	room := q.maxBytes - u.bytes
+	if header.Params.Get(common.ParamTruncate) == "true" {
+		filePath := path.Join(accountRoot, account, header.FileName)
+		if info, err := os.Stat(filePath); err == nil {
+			size, err := contentSize(filePath, info)
+			if err != nil {
+				return 0, err
+			}
+			room += size
+		}
+	}
+	return min(max(room, 0), maxBodySize), nil
+}
+
 // create a ResponseData
 func createResponseData(op string, result string, fileName string, size uint64, dataList *list.List, conn net.Conn) common.ResponseData {
-	header := common.Header{op, result, fileName, size}
-	return common.ResponseData{header, dataList, conn}
+	header := common.Header{Operation: op, Info: result, FileName: fileName, Size: size}
+	return common.ResponseData{Header: header, DataList: dataList, Conn: conn}
+}
+
+// create an ERROR ResponseData carrying the code of the error
+func createErrorResponse(err error, conn net.Conn) common.ResponseData {
+	res := createResponseData("ERROR", err.Error(), "", 0, nil, conn)
+	if code := errorCode(err); code != "" {
+		res.Header.Params = url.Values{common.ParamCode: {code}}
+	}
+	var throttled *throttledError
+	if errors.As(err, &throttled) == true {
+		res.Header.Params.Set(common.ParamRetryAfter, throttled.retryAfter.String())
+	}
+	return res
+}
+
+// Map an error to the code sent to the client
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, errPreconditionFailed):
+		return common.CodePreconditionFailed
+	case errors.Is(err, os.ErrNotExist):
+		return common.CodeNotFound
+	case errors.Is(err, os.ErrExist):
+		return common.CodeExists
+	case errors.Is(err, errQuotaExceeded):
+		return common.CodeQuotaExceeded
+	case errors.Is(err, errReadOnly):
+		return common.CodeReadOnly
+	case errors.Is(err, errPermissionDenied):
+		return common.CodePermissionDenied
+	case errors.Is(err, errThrottled):
+		return common.CodeThrottled
+	case errors.Is(err, errServerBusy):
+		return common.CodeBusy
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return common.CodeTimeout
+	case errors.Is(err, errTooLarge):
+		return common.CodeTooLarge
+	default:
+		return ""
+	}
 }
 
 // Perform the requested server side IO operation
 // and produce an error or response for the client
 func handleIO(data common.ClientData, svr Server) error {
+	res, err := dispatch(data, svr)
+	if err != nil {
+		return err
+	}
 
+	svr.respChan <- res
+	return nil
+}
+
+// Perform an operation for any front end, recording it in
+// the metrics and audit log and charging its response
+// against the rate limits
+func dispatch(data common.ClientData, svr Server) (common.ResponseData, error) {
+	start := time.Now()
+	account, res, err := performIO(data, svr)
+	requestMetrics.observe(data.Header.Operation, err, time.Since(start))
+	recordAudit(data, account, res, err)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+
+	chargeResponse(data.Header, res)
+	return res, nil
+}
+
+// Perform an operation, returning the account it operated
+// on and the response for the client
+func performIO(data common.ClientData, svr Server) (account string, res common.ResponseData, err error) {
 	header := data.Header
 	op := header.Operation
 
-	var res common.ResponseData
-	var err error
+	// answer pings without waiting for storage
+	if op == "PING" {
+		res, err = ping(data.Conn)
+		return
+	}
+
+	if adminOps[op] {
+		if err = checkAdmin(op, header.Params); err != nil {
+			return
+		}
+	}
+
+	if exclusiveOps[op] {
+		storageLock.Lock()
+		defer storageLock.Unlock()
+	} else {
+		storageLock.RLock()
+		defer storageLock.RUnlock()
+	}
+
+	if err = checkSnapshotAccess(op, header.Params); err != nil {
+		return
+	}
+
+	account, err = resolveAccount(header)
+	if err != nil {
+		return
+	}
+
+	fileName := header.FileName
+	params := header.Params
+
 	switch op {
 	case "CREATE":
-		res, err = createAccount(data.Header.Info, data.Conn)
+		res, err = createAccount(account, data.Conn)
 	case "WRITE":
-		res, err = writeFile(data.Header.Info, data.Header.FileName, data.DataList, data.Conn)
+		res, err = writeFile(account, fileName, params, data.DataList, data.Conn)
 	case "READ":
-		res, err = readFile(data.Header.Info, data.Header.FileName, data.Conn)
+		res, err = readFile(account, fileName, params, data.Conn)
 	case "DELETE":
-		res, err = deleteFile(data.Header.Info, data.Header.FileName, data.Conn)
+		res, err = deleteFile(account, fileName, params, data.Conn)
 	case "LIST":
-		res, err = listFiles(data.Header.Info, data.Conn)
+		res, err = listFiles(account, fileName, params, data.Conn)
+	case "STAT":
+		res, err = statFile(account, fileName, params, data.Conn)
+	case "MKDIR":
+		res, err = makeDirectory(account, fileName, data.Conn)
+	case "RMDIR":
+		res, err = removeDirectory(account, fileName, data.Conn)
+	case "MOVE":
+		res, err = movePath(account, fileName, params, data.Conn)
+	case "COPY":
+		res, err = copyPath(account, fileName, params, data.Conn)
+	case "VERSIONS":
+		res, err = versionsFile(account, fileName, data.Conn)
+	case "RESTORE":
+		res, err = restoreFile(account, fileName, params, data.Conn)
+	case "TRASH":
+		res, err = listTrashFiles(account, data.Conn)
+	case "UNDELETE":
+		res, err = undeleteFile(account, fileName, params, data.Conn)
+	case "PURGE":
+		res, err = purgeFile(account, fileName, params, data.Conn)
+	case "USAGE":
+		res, err = accountUsageInfo(account, data.Conn)
+	case "GC":
+		res, err = garbageCollect(data.Conn)
+	case "SNAPSHOT":
+		res, err = createSnapshot(account, params, data.Conn)
+	case "LIST-SNAPSHOTS":
+		res, err = listSnapshots(account, data.Conn)
+	case "RESTORE-SNAPSHOT":
+		res, err = restoreSnapshot(account, params, data.Conn)
+	case "DELETE-SNAPSHOT":
+		res, err = deleteSnapshot(account, params, data.Conn)
+	case "DELETE-ACCOUNT":
+		res, err = deleteAccount(account, data.Conn)
+	case "RENAME-ACCOUNT":
+		res, err = renameAccount(account, params, data.Conn)
+	case "LIST-ACCOUNTS":
+		res, err = listAccounts(data.Conn)
+	case "SET-QUOTA":
+		res, err = setQuota(account, params, data.Conn)
+	case "SERVER-STATS":
+		res, err = serverStats(svr, data.Conn)
+	case "GRANT":
+		res, err = grantAccess(account, fileName, params, data.Conn)
+	case "REVOKE":
+		res, err = revokeAccess(account, fileName, params, data.Conn)
+	case "LIST-GRANTS":
+		res, err = listGrants(account, data.Conn)
+	case "AUDIT":
+		res, err = queryAudit(params, data.Conn)
+	case "S3-KEY":
+		res, err = createS3Key(account, data.Conn)
 	default:
-		return fmt.Errorf("Invalid operation: %s", op)
+		err = fmt.Errorf("Invalid operation: %s", op)
 	}
-	if err != nil {
-		return err
-	}
-
-	svr.respChan <- res
-	return nil
+	return
 }
 
 // Check if the given path exists or not
@@ -117,12 +437,16 @@ func checkExistence(path string) (bool, error) {
 // new directory
 func createAccount(account string, conn net.Conn) (common.ResponseData, error) {
 	accountPath := path.Join(accountRoot, account)
+	if err := checkAccountName(account); err != nil {
+		return common.ResponseData{}, err
+	}
+
 	exists, err := checkExistence(accountPath)
 	if err != nil {
 		return common.ResponseData{}, err
 	}
 	if exists == true {
-		err := fmt.Errorf("%s already exists", account)
+		err := fmt.Errorf("%s already exists: %w", account, os.ErrExist)
 		return common.ResponseData{}, err
 	}
 
@@ -130,6 +454,9 @@ func createAccount(account string, conn net.Conn) (common.ResponseData, error) {
 	if err != nil {
 		return common.ResponseData{}, err
 	}
+	if err := recordAccount(account); err != nil {
+		return common.ResponseData{}, err
+	}
 
 	resp := fmt.Sprintf("account created %s", account)
 	return createResponseData("CREATE", resp, "", 0, nil, conn), nil
@@ -137,42 +464,113 @@ func createAccount(account string, conn net.Conn) (common.ResponseData, error) {
 
 // Write a file under the given account
 //
-// Write will fail if the file exists already
-func writeFile(account string, fileName string, dataList *list.List, conn net.Conn) (common.ResponseData, error) {
+// The data is appended to the file unless the truncate
+// parameter is set, in which case it replaces the contents.
+// Write will fail if the if-match or if-none-match
+// parameters do not match the current file version or
+// if the account's quota would be exceeded
+func writeFile(account string, fileName string, params url.Values, dataList *list.List, conn net.Conn) (common.ResponseData, error) {
 	filePath := path.Join(accountRoot, account, fileName)
 
-	openFlags := os.O_APPEND | os.O_CREATE | os.O_WRONLY
-	if err := common.WriteFile(filePath, openFlags, defaultPerms, dataList); err != nil {
+	fileLocks.lock(filePath)
+	defer fileLocks.unlock(filePath)
+
+	if err := checkPrecondition(filePath, params); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	truncate := params.Get(common.ParamTruncate) == "true"
+	growth := dataListSize(dataList)
+	if truncate == true {
+		if info, err := os.Stat(filePath); err == nil {
+			size, err := contentSize(filePath, info)
+			if err != nil {
+				return common.ResponseData{}, err
+			}
+			growth = max(growth-size, 0)
+		}
+	}
+	if err := checkQuota(account, fileName, growth); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	if err := saveVersion(account, fileName); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	if err := writeContents(filePath, dataList, truncate); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	version, err := fileVersion(filePath)
+	if err != nil {
 		return common.ResponseData{}, err
 	}
 
 	resp := fmt.Sprintf("wrote file %s", fileName)
-	return createResponseData("WRITE", resp, "", 0, nil, conn), nil
+	res := createResponseData("WRITE", resp, "", 0, nil, conn)
+	res.Header.Params = versionParams(version)
+	return res, nil
 }
 
 // Read a file under the given account
 //
-// Read will fail if the file does not exist
-func readFile(account string, fileName string, conn net.Conn) (common.ResponseData, error) {
+// A previous version is read if the version parameter is
+// given, or the file in a snapshot if the snapshot parameter
+// is given. Read will fail if the file does not exist
+func readFile(account string, fileName string, params url.Values, conn net.Conn) (common.ResponseData, error) {
 	filePath := path.Join(accountRoot, account, fileName)
 
+	fileLocks.lock(filePath)
+	defer fileLocks.unlock(filePath)
+
+	readPath, err := browsePath(account, fileName, params)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	if version := params.Get(common.ParamVersion); version != "" {
+		if readPath, err = findVersion(account, fileName, version); err != nil {
+			return common.ResponseData{}, err
+		}
+	}
+
 	dataList := list.New()
-	size, err := common.ReadFile(filePath, os.O_RDONLY, defaultPerms, dataList)
+	size, err := readContents(readPath, dataList)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+
+	version, err := fileVersion(readPath)
 	if err != nil {
 		return common.ResponseData{}, err
 	}
 
 	resp := fmt.Sprintf("read file %s", fileName)
-	return createResponseData("READ", resp, fileName, size, dataList, conn), nil
+	res := createResponseData("READ", resp, fileName, size, dataList, conn)
+	res.Header.Params = versionParams(version)
+	return res, nil
 }
 
-// Delete a file under the given account
+// Delete a file or directory under the given account by
+// moving it to the account's trash
 //
-// Delete will fail if the file does not exist
-func deleteFile(account string, fileName string, conn net.Conn) (common.ResponseData, error) {
+// Delete will fail if the file does not exist or if the
+// if-match or if-none-match parameters do not match the
+// current file version
+func deleteFile(account string, fileName string, params url.Values, conn net.Conn) (common.ResponseData, error) {
+	if err := checkNotRoot(fileName); err != nil {
+		return common.ResponseData{}, err
+	}
 	filePath := path.Join(accountRoot, account, fileName)
 
-	err := os.Remove(filePath)
+	fileLocks.lock(filePath)
+	defer fileLocks.unlock(filePath)
+
+	if err := checkPrecondition(filePath, params); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	err := trashFile(account, fileName)
 	if err != nil {
 		return common.ResponseData{}, err
 	}
@@ -181,11 +579,59 @@ func deleteFile(account string, fileName string, conn net.Conn) (common.Response
 	return createResponseData("DELETE", resp, "", 0, nil, conn), nil
 }
 
-// List files under an account
+// Report the type, size, modification time and version
+// of a file under the given account, or in the snapshot
+// named by the snapshot parameter
 //
-// List will fail if the account is not present
-func listFiles(account string, conn net.Conn) (common.ResponseData, error) {
-	accountPath := path.Join(accountRoot, account)
+// Directories have no size or version.
+// Stat will fail if the file does not exist
+func statFile(account string, fileName string, params url.Values, conn net.Conn) (common.ResponseData, error) {
+	lockPath := path.Join(accountRoot, account, fileName)
+	fileLocks.lock(lockPath)
+	defer fileLocks.unlock(lockPath)
+
+	filePath, err := browsePath(account, fileName, params)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	var size int64
+	var version string
+	fileType := common.TypeDirectory
+	if info.IsDir() == false {
+		fileType = common.TypeFile
+		if size, err = contentSize(filePath, info); err != nil {
+			return common.ResponseData{}, err
+		}
+		if version, err = fileVersion(filePath); err != nil {
+			return common.ResponseData{}, err
+		}
+	}
+
+	resp := fmt.Sprintf("stat %s", fileName)
+	res := createResponseData("STAT", resp, fileName, 0, nil, conn)
+	res.Header.Params = versionParams(version)
+	res.Header.Params.Set(common.ParamType, fileType)
+	res.Header.Params.Set(common.ParamSize, strconv.FormatInt(size, 10))
+	res.Header.Params.Set(common.ParamModTime, info.ModTime().UTC().Format(time.RFC3339))
+	return res, nil
+}
+
+// List files under an account, or in the snapshot named
+// by the snapshot parameter
+//
+// The files of a directory are listed if a file name is
+// given. Each name is sent as a line. List will fail if the
+// account is not present
+func listFiles(account string, dirName string, params url.Values, conn net.Conn) (common.ResponseData, error) {
+	accountPath, err := browsePath(account, dirName, params)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
 
 	files, err := ioutil.ReadDir(accountPath)
 	if err != nil {
@@ -195,25 +641,31 @@ func listFiles(account string, conn net.Conn) (common.ResponseData, error) {
 	var size int
 	dataList := list.New()
 	for _, file := range files {
-		byteName := []byte(file.Name())
-		dataList.PushBack(common.Data{len(byteName), byteName})
+		byteName := []byte(file.Name() + "\n")
+		dataList.PushBack(common.Data{Size: len(byteName), Buffer: byteName})
 		size += len(byteName)
 	}
-	common.DebugLog("size: %d\n", uint64(size))
 	return createResponseData("LIST", "got list", "", uint64(size), dataList, conn), nil
 }
 
 // Send the response and close the connection
 func sendResponse(response common.ResponseData) {
+	logger := connLogger(response.Conn)
 	serializedHeader := common.SerializeHeader(response.Header)
+	if err := setWriteTimeout(response.Conn); err != nil {
+		logger.Error("unable to set write deadline", "err", err)
+	}
 	if err := common.SendMessage(serializedHeader, response.DataList, response.Conn); err != nil {
-		log.Printf("ERROR: Failed to send message: %v\n", err)
+		countTimeout(err)
+		logger.Error("failed to send response", "err", err)
+	} else {
+		bytesSent.Add(int64(response.Header.Size))
+		logger.Debug("sent response", "result", response.Header.Operation, "size", response.Header.Size)
 	}
-	common.DebugLog("Sent response: %v\n", response.Header)
 
 	// close the connection
 	if err := response.Conn.Close(); err != nil {
-		log.Printf("ERROR: unable to close connection: %v\n", err)
+		logger.Error("unable to close connection", "err", err)
 	}
 }
 
@@ -227,74 +679,159 @@ func initServer(address string) (Server, error) {
 		return s, err
 	}
 
-	s.handleChan = make(chan net.Conn)
-	s.ioChan = make(chan common.ClientData)
-	s.respChan = make(chan common.ResponseData)
-
-	log.Printf("Creating conn workers\n")
-	for i := 0; i < handleConnWorkers; i++ {
-		go func(svr Server) {
-			for conn := range svr.handleChan {
-				err := handleConnection(conn, s)
-				if err != nil {
-					log.Printf(err.Error())
-					svr.respChan <- createResponseData("ERROR", err.Error(), "", 0, nil, conn)
-				}
-			}
-		}(s)
-	}
-
-	log.Printf("Creating io workers\n")
-	for i := 0; i < ioWorkers; i++ {
-		go func(svr Server) {
-			for data := range svr.ioChan {
-				err := handleIO(data, s)
-				if err != nil {
-					log.Printf(err.Error())
-					svr.respChan <- createResponseData("ERROR", err.Error(), "", 0, nil, data.Conn)
-				}
-			}
-		}(s)
+	s.handleChan = make(chan net.Conn, acceptQueue)
+	s.ioChan = make(chan common.ClientData, pipelineQueue)
+	s.respChan = make(chan common.ResponseData, pipelineQueue)
+	if maxConnections > 0 {
+		s.slots = make(chan struct{}, maxConnections)
 	}
 
-	log.Printf("Creating response workers\n")
-	for i := 0; i < respWorkers; i++ {
-		go func(svr Server) {
-			for resp := range svr.respChan {
-				sendResponse(resp)
-			}
-		}(s)
-	}
+	s.handlePool = newWorkerPool("conn", s.handleChan, func(conn net.Conn) {
+		err := handleConnection(conn, s)
+		if err != nil {
+			connLogger(conn).Warn("unable to read request", "err", err)
+			s.respChan <- createErrorResponse(err, conn)
+		}
+	}, handleConnWorkers, maxWorkers)
+
+	s.ioPool = newWorkerPool("io", s.ioChan, func(data common.ClientData) {
+		start := time.Now()
+		err := handleIO(data, s)
+		duration := time.Since(start)
+		if err != nil {
+			connLogger(data.Conn).Warn("request failed", "err", err, "code", errorCode(err), "duration", duration)
+			s.respChan <- createErrorResponse(err, data.Conn)
+			return
+		}
+		connLogger(data.Conn).Info("handled request", "size", data.Header.Size, "duration", duration)
+	}, ioWorkers, maxWorkers)
+
+	s.respPool = newWorkerPool("response", s.respChan, func(resp common.ResponseData) {
+		sendResponse(resp)
+		releaseConnection(s)
+	}, respWorkers, maxWorkers)
 
 	return s, nil
 }
 
 func main() {
 	port := flag.String("port", defaultPort, "port to listen for connections")
+	flag.StringVar(&accountRoot, "root", defaultAccountRoot, "directory holding all accounts (the default was /tmp before server state moved out of the root, see the README to migrate)")
+	flag.StringVar(&stateRoot, "state", "", "directory holding server state, outside the root (defaults to the root with .state appended)")
+	flag.IntVar(&maxVersions, "max-versions", defaultMaxVersions, "previous versions retained per file")
+	flag.Int64Var(&defaultQuota.maxBytes, "quota-bytes", 0, "bytes each account may store (0 is unlimited)")
+	flag.Int64Var(&defaultQuota.maxFiles, "quota-files", 0, "files each account may store (0 is unlimited)")
+	flag.Int64Var(&maxBodySize, "max-body-size", defaultMaxBodySize, "largest body buffered for a write whose size is not sent up front")
+	flag.StringVar(&adminToken, "admin-token", os.Getenv(adminTokenEnv), "token authorizing administrative operations (empty disables them), defaults to $"+adminTokenEnv)
+	flag.BoolVar(&dedup, "dedup", false, "store identical file contents once")
+	flag.DurationVar(&gcInterval, "gc-interval", 0, "interval between collections of unreferenced contents (0 disables them)")
+	flag.DurationVar(&trashExpiry, "trash-expiry", defaultTrashExpiry, "age after which deleted files are purged (0 keeps them)")
+	flag.DurationVar(&maxVersionAge, "max-version-age", defaultMaxVersionAge, "age after which previous versions are discarded (0 keeps them)")
+	flag.Float64Var(&requestRate, "rate-requests", 0, "requests per second allowed to each account and address (0 is unlimited)")
+	flag.Float64Var(&requestBurst, "rate-request-burst", 0, "requests allowed in a burst (0 is one second of requests)")
+	flag.Float64Var(&byteRate, "rate-bytes", 0, "bytes per second allowed to each account and address (0 is unlimited)")
+	flag.Float64Var(&byteBurst, "rate-byte-burst", 0, "bytes allowed in a burst (0 is one second of bytes)")
+	flag.IntVar(&maxConnections, "max-connections", 0, "connections handled at once (0 is unlimited)")
+	flag.IntVar(&handleConnWorkers, "conn-workers", defaultWorkers, "workers reading requests from connections")
+	flag.IntVar(&ioWorkers, "io-workers", defaultWorkers, "workers performing operations")
+	flag.IntVar(&respWorkers, "resp-workers", defaultWorkers, "workers sending responses")
+	flag.IntVar(&maxWorkers, "max-workers", 0, "workers each stage may grow to while work is queued (no more than the starting workers disables scaling)")
+	flag.DurationVar(&scaleInterval, "scale-interval", defaultScaleInterval, "interval between resizes of the worker pools")
+	flag.DurationVar(&headerTimeout, "header-timeout", defaultHeaderTimeout, "time allowed to read a request header (0 is unlimited)")
+	flag.DurationVar(&bodyTimeout, "body-timeout", defaultBodyTimeout, "time allowed to read a request body (0 is unlimited)")
+	flag.DurationVar(&idleTimeout, "idle-timeout", defaultIdleTimeout, "time a read may wait for data from a client (0 is unlimited)")
+	flag.DurationVar(&writeTimeout, "write-timeout", defaultWriteTimeout, "time allowed to send a response (0 is unlimited)")
+	flag.StringVar(&metricsAddress, "metrics-addr", "", "address serving metrics over HTTP, such as localhost:9100 (empty disables them)")
+	flag.BoolVar(&auditEnabled, "audit", true, "record every operation in the audit log")
+	flag.StringVar(&auditPath, "audit-log", "", "path of the audit log (defaults to audit.log in the state directory)")
+	flag.Int64Var(&auditMaxSize, "audit-max-size", defaultAuditMaxSize, "size in bytes at which the audit log is rotated")
+	flag.IntVar(&auditMaxFiles, "audit-max-files", defaultAuditMaxFiles, "rotated audit logs kept")
+	flag.StringVar(&gatewayAddress, "http-addr", "", "address serving accounts and files over HTTP, such as localhost:8080 (empty disables it)")
+	flag.StringVar(&davAddress, "dav-addr", "", "address serving accounts over WebDAV, such as localhost:8081 (empty disables it)")
+	flag.StringVar(&ftpAddress, "ftp-addr", "", "address serving accounts to FTP clients, such as localhost:2121 (empty disables it)")
+	flag.DurationVar(&ftpIdleTimeout, "ftp-idle-timeout", defaultFTPIdleTimeout, "time an FTP session may wait for a command (0 is unlimited)")
+	flag.StringVar(&rpcAddress, "rpc-addr", "", "address serving JSON-RPC clients, such as localhost:7070 (empty disables it)")
+	flag.DurationVar(&rpcIdleTimeout, "rpc-idle-timeout", defaultRPCIdleTimeout, "time a JSON-RPC connection may wait for a call (0 is unlimited)")
+	flag.StringVar(&s3Address, "s3-addr", "", "address serving accounts as S3 buckets, such as localhost:9000 (empty disables it)")
+	flag.StringVar(&healthAddress, "health-addr", "", "address serving /healthz and /readyz over HTTP (empty disables them)")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "time allowed for in-flight operations to finish on shutdown")
+	flag.IntVar(&acceptQueue, "accept-queue", defaultAcceptQueue, "connections waiting for a handler before new ones are rejected")
 	common.AddCommonFlags()
+	common.AddLoggingFlags()
 	flag.Parse()
 
-	log.Printf("port: %s\n", *port)
+	if err := common.SetupLogging(os.Stderr); err != nil {
+		log.Fatalf("Failed to set up logging: %v\n", err)
+	}
+
+	for _, dir := range []string{accountRoot, stateDir()} {
+		if err := os.MkdirAll(dir, os.FileMode(0744)); err != nil {
+			fatal("failed to create storage directory", err)
+		}
+	}
+	if rel, err := filepath.Rel(accountRoot, stateDir()); err == nil && rel != ".." && strings.HasPrefix(rel, "../") == false {
+		fatal("invalid state directory", fmt.Errorf("%s is inside the root %s", stateDir(), accountRoot))
+	}
+
+	requestLimits = newRateLimiter(requestRate, requestBurst)
+	byteLimits = newRateLimiter(byteRate, byteBurst)
 
 	// create address
 	address := ":" + *port
 
 	server, err := initServer(address)
 	if err != nil {
-		log.Fatalf("Failed to create server: %v\n", err)
+		fatal("failed to create server", err)
 	}
 
-	log.Printf("listening for connections on %s...\n", address)
-	// listen for incoming connections
-	for {
-		connection, err := server.listener.Accept()
+	if auditEnabled == true {
+		if auditPath == "" {
+			auditPath = defaultAuditPath()
+		}
+		auditTrail, err = openAuditLog(auditPath, auditMaxSize, auditMaxFiles)
 		if err != nil {
-			log.Fatalf("Failed to accept connection: %v\n", err)
+			fatal("failed to open audit log", err)
+		}
+	}
+
+	if gcInterval > 0 {
+		go runGarbageCollector()
+	}
+
+	handleSignals(server)
+	server.endpoints, err = serveEndpoints(server)
+	if err != nil {
+		fatal("failed to serve HTTP endpoints", err)
+	}
+	if ftpAddress != "" {
+		if err := serveFTP(server); err != nil {
+			fatal("failed to listen for FTP clients", err)
 		}
+	}
+	if rpcAddress != "" {
+		if err := serveRPC(server); err != nil {
+			fatal("failed to listen for JSON-RPC clients", err)
+		}
+	}
 
-		log.Printf("Received connection from %s\n",
-			connection.RemoteAddr().String())
-		// spawn a go routine to handle the connection
-		server.handleChan <- connection
+	slog.Info("listening for connections", "address", server.listener.Addr().String())
+	if err := acceptConnections(server); errors.Is(err, net.ErrClosed) == false {
+		fatal("failed to accept connections", err)
 	}
+
+	if err := shutdownServer(server, shutdownTimeout); err != nil {
+		fatal("failed to shut down cleanly", err)
+	}
+	if auditTrail != nil {
+		if err := auditTrail.close(); err != nil {
+			fatal("failed to close audit log", err)
+		}
+	}
+	slog.Info("shutdown complete")
+}
+
+// Log an error the server cannot recover from and exit
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
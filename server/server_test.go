@@ -2,14 +2,31 @@ package main
 
 import (
 	"container/list"
+	"errors"
 	"io/ioutil"
+	"log"
+	"net/url"
 	"os"
 	"path"
+	"strings"
 	"testing"
 
 	"github.com/teirm/go_ftp/common"
 )
 
+func TestMain(m *testing.M) {
+	root, err := ioutil.TempDir("", "go_ftp_test")
+	if err != nil {
+		log.Fatalf("unable to create test root: %v", err)
+	}
+	accountRoot = path.Join(root, "accounts")
+	stateRoot = path.Join(root, "state")
+	os.Mkdir(accountRoot, os.FileMode(0744))
+	code := m.Run()
+	os.RemoveAll(root)
+	os.Exit(code)
+}
+
 func createTestAccount(accountName string, t *testing.T) string {
 	// create an account for testing purposes
 	_, err := createAccount(accountName, nil)
@@ -82,13 +99,13 @@ func TestDeleteFile(t *testing.T) {
 	}
 	defer fileHandle.Close()
 
-	resp, err := deleteFile(accountName, fileName, nil)
+	resp, err := deleteFile(accountName, fileName, nil, nil)
 	if err != nil {
 		t.Errorf("deleteFile(%s, %s, nil) = %v, %v, expected err == nil",
 			accountName, fileName, resp, err)
 	}
 
-	resp, err = deleteFile(accountName, fileName, nil)
+	resp, err = deleteFile(accountName, fileName, nil, nil)
 	if os.IsNotExist(err) == false {
 		t.Errorf("repeat deleteFile(%s, %s, nil) = %v, %v, expected err == ENOENT",
 			accountName, fileName, resp, err)
@@ -112,7 +129,7 @@ func TestListFiles(t *testing.T) {
 		fileMap[baseFileName] = true
 	}
 
-	resp, err := listFiles(accountName, nil)
+	resp, err := listFiles(accountName, "", nil, nil)
 	if err != nil {
 		t.Errorf("unable to list files: %v", err)
 	}
@@ -120,7 +137,7 @@ func TestListFiles(t *testing.T) {
 	for iter := dataList.Front(); iter != nil; iter = iter.Next() {
 		switch x := iter.Value.(type) {
 		case common.Data:
-			listName := string(common.Data(x).Buffer)
+			listName := strings.TrimSuffix(string(common.Data(x).Buffer), "\n")
 			if _, ok := fileMap[listName]; !ok {
 				t.Errorf("unexpected list entry: %s", listName)
 			}
@@ -151,7 +168,7 @@ func TestReadFile(t *testing.T) {
 		}
 		defer os.Remove(filePath)
 
-		resp, err := readFile(accountName, test.fileName, nil)
+		resp, err := readFile(accountName, test.fileName, nil, nil)
 		if err != nil {
 			t.Errorf("unable to read test file: %v", err)
 		}
@@ -188,11 +205,11 @@ func TestWriteFile(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		data := common.Data{len(test.message), test.message}
+		data := common.Data{Size: len(test.message), Buffer: test.message}
 		dataList := list.New()
 		dataList.PushBack(data)
 
-		_, err := writeFile(accountName, test.fileName, dataList, nil)
+		_, err := writeFile(accountName, test.fileName, nil, dataList, nil)
 		if err != nil {
 			t.Errorf("unable to write file: %v", err)
 		}
@@ -211,3 +228,46 @@ func TestWriteFile(t *testing.T) {
 	}
 
 }
+
+func TestCheckWrite(t *testing.T) {
+	defer func(q quota, size int64) {
+		defaultQuota = q
+		maxBodySize = size
+	}(defaultQuota, maxBodySize)
+	maxBodySize = 1 << 20
+
+	quotaAccount := "check_write"
+	quotaPath := createTestAccount(quotaAccount, t)
+	defer os.RemoveAll(quotaPath)
+	writeTestFile(quotaAccount, "kept.txt", "0123456789", t)
+	setQuota(quotaAccount, url.Values{common.ParamMaxBytes: {"100"}}, nil)
+
+	freeAccount := "check_write_free"
+	freePath := createTestAccount(freeAccount, t)
+	defer os.RemoveAll(freePath)
+
+	truncate := url.Values{common.ParamTruncate: {"true"}}
+	var tests = []struct {
+		header common.Header
+		err    error
+	}{
+		{common.Header{Operation: "WRITE", Info: quotaAccount, FileName: "new.txt", Size: 90}, nil},
+		{common.Header{Operation: "WRITE", Info: quotaAccount, FileName: "new.txt", Size: 91}, errQuotaExceeded},
+		{common.Header{Operation: "WRITE", Info: quotaAccount, FileName: "kept.txt", Size: 100, Params: truncate}, nil},
+		{common.Header{Operation: "WRITE", Info: quotaAccount, FileName: "kept.txt", Size: 1 << 40, Params: truncate}, errQuotaExceeded},
+		{common.Header{Operation: "WRITE", Info: quotaAccount, FileName: "new.txt", Size: 1 << 40, Params: truncate}, errQuotaExceeded},
+		{common.Header{Operation: "WRITE", Info: freeAccount, FileName: "new.txt", Size: 1 << 20}, nil},
+		{common.Header{Operation: "WRITE", Info: freeAccount, FileName: "new.txt", Size: 1 << 40}, errTooLarge},
+		{common.Header{Operation: "WRITE", Info: freeAccount, FileName: "new.txt", Size: 1 << 40, Params: truncate}, errTooLarge},
+		{common.Header{Operation: "READ", Info: freeAccount, FileName: "new.txt"}, nil},
+		{common.Header{Operation: "READ", Info: freeAccount, FileName: "new.txt", Size: 1}, errTooLarge},
+	}
+
+	for _, test := range tests {
+		err := checkWrite(test.header)
+		if errors.Is(err, test.err) == false {
+			t.Errorf("checkWrite(%s %s %d %v) = %v, expected %v", test.header.Operation, test.header.FileName,
+				test.header.Size, test.header.Params, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Graceful shutdown on SIGINT and SIGTERM
+//
+// On a signal the listener is closed, the HTTP endpoints
+// finish the requests they are serving and the sessions of the
+// other front ends end after their current request. Then each
+// stage of the pipeline is drained in order: connections
+// already accepted are read, queued operations are performed
+// and responses are sent before the next stage's channel is
+// closed.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const defaultShutdownTimeout time.Duration = 30 * time.Second
+
+// time allowed for in-flight operations to finish on shutdown
+var shutdownTimeout time.Duration = defaultShutdownTimeout
+
+// Close the listener of the server on SIGINT or SIGTERM
+//
+// A second signal terminates the server immediately
+func handleSignals(svr Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		shuttingDown.Store(true)
+		slog.Info("shutting down", "signal", sig.String())
+		if err := svr.listener.Close(); err != nil {
+			slog.Error("unable to close listener", "err", err)
+		}
+	}()
+}
+
+// Drain the pipelines of a server whose listener is closed
+//
+// An error is returned if operations are still in flight
+// after the timeout
+func shutdownServer(svr Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		for _, endpoint := range svr.endpoints {
+			if err := endpoint.Shutdown(ctx); err != nil {
+				slog.Error("unable to shut down HTTP endpoints", "address", endpoint.Addr, "err", err)
+			}
+		}
+		sessions.close()
+		sessions.wait()
+
+		close(svr.handleChan)
+		svr.handlePool.wait()
+		close(svr.ioChan)
+		svr.ioPool.wait()
+		close(svr.respChan)
+		svr.respPool.wait()
+
+		// wait for a garbage collection in progress
+		storageLock.Lock()
+		storageLock.Unlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("operations still in flight after %v", timeout)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+func TestShutdownServer(t *testing.T) {
+	svr, err := initServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+
+	// a request accepted before the shutdown is answered
+	conn, err := net.Dial("tcp", svr.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("unable to connect: %v", err)
+	}
+	defer conn.Close()
+	server, err := svr.listener.Accept()
+	if err != nil {
+		t.Fatalf("unable to accept: %v", err)
+	}
+	admitConnection(server, svr)
+	header := common.Header{Operation: "CREATE", Info: "shutdown_account"}
+	defer func() {
+		for _, dir := range accountDirs(header.Info) {
+			os.RemoveAll(dir)
+		}
+	}()
+	if err := common.SendMessage(common.SerializeHeader(header), nil, conn); err != nil {
+		t.Fatalf("unable to send request: %v", err)
+	}
+
+	svr.listener.Close()
+	if err := shutdownServer(svr, 5*time.Second); err != nil {
+		t.Fatalf("shutdownServer() = %v", err)
+	}
+
+	response, err := common.ReadHeader(conn)
+	if err != nil || response.Operation != "CREATE" {
+		t.Errorf("response after shutdown = %v, %v", response, err)
+	}
+}
+
+func TestShutdownServerTimeout(t *testing.T) {
+	svr, err := initServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+
+	// a client that never sends its request stalls the shutdown
+	server, client := net.Pipe()
+	admitConnection(server, svr)
+
+	svr.listener.Close()
+	if err := shutdownServer(svr, 50*time.Millisecond); err == nil {
+		t.Errorf("shutdownServer() with a stalled client succeeded")
+	}
+	client.Close()
+}
+
+func TestShutdownEndpoints(t *testing.T) {
+	svr, err := initServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to start server: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen = %v", err)
+	}
+
+	// a request being served when the shutdown starts is finished
+	started := make(chan struct{})
+	endpoint := newHTTPServer(listener.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("finished"))
+	}))
+	svr.endpoints = []*http.Server{endpoint}
+	go endpoint.Serve(listener)
+
+	url := "http://" + listener.Addr().String() + "/"
+	type result struct {
+		body string
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		res, err := http.Get(url)
+		if err != nil {
+			results <- result{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		results <- result{string(body), err}
+	}()
+	<-started
+
+	svr.listener.Close()
+	if err := shutdownServer(svr, 5*time.Second); err != nil {
+		t.Fatalf("shutdownServer() = %v", err)
+	}
+	if res := <-results; res.err != nil || res.body != "finished" {
+		t.Errorf("request in flight during shutdown = %q, %v", res.body, res.err)
+	}
+	if res, err := http.Get(url); err == nil {
+		res.Body.Close()
+		t.Errorf("HTTP endpoint still served after shutdown")
+	}
+}
@@ -0,0 +1,351 @@
+// Point-in-time snapshots of whole accounts
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+// errReadOnly is returned when a request would modify a snapshot
+var errReadOnly = errors.New("snapshots are read-only")
+
+// Operations allowed to name a snapshot
+var snapshotOps = map[string]bool{
+	"READ":             true,
+	"LIST":             true,
+	"STAT":             true,
+	"SNAPSHOT":         true,
+	"RESTORE-SNAPSHOT": true,
+	"DELETE-SNAPSHOT":  true,
+}
+
+// Directory holding the snapshots of an account
+func snapshotsDir(account string) string {
+	return path.Join(stateDir(), "snapshots", account)
+}
+
+// Directory holding a snapshot of an account
+func snapshotDir(account string, name string) string {
+	return path.Join(snapshotsDir(account), name)
+}
+
+// Check that a snapshot name is usable as a directory name
+func checkSnapshotName(name string) error {
+	if name == "" || strings.HasPrefix(name, ".") || strings.Contains(name, "/") {
+		return fmt.Errorf("invalid snapshot name: %q", name)
+	}
+	return nil
+}
+
+// Reject requests naming a snapshot unless the operation
+// only reads it or manages snapshots
+func checkSnapshotAccess(op string, params url.Values) error {
+	if params.Get(common.ParamSnapshot) != "" && snapshotOps[op] == false {
+		return fmt.Errorf("%w: %s", errReadOnly, op)
+	}
+	return nil
+}
+
+// Path of a file in an account, or in the snapshot of the
+// account named by the snapshot parameter
+func browsePath(account string, fileName string, params url.Values) (string, error) {
+	name := params.Get(common.ParamSnapshot)
+	if name == "" {
+		return path.Join(accountRoot, account, fileName), nil
+	}
+	if err := checkSnapshotName(name); err != nil {
+		return "", err
+	}
+
+	dir := snapshotDir(account, name)
+	exists, err := checkExistence(dir)
+	if err != nil {
+		return "", err
+	}
+	if exists == false {
+		return "", fmt.Errorf("snapshot %s: %w", name, os.ErrNotExist)
+	}
+	return path.Join(dir, fileName), nil
+}
+
+// Copy every file under src into dst, creating directories
+// as needed
+func copyTree(src string, dst string) error {
+	return filepath.Walk(src, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, filePath)
+		if err != nil {
+			return err
+		}
+		target := path.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, os.FileMode(0744))
+		}
+		return copyFile(filePath, target)
+	})
+}
+
+// Capture the files of the given account in a snapshot
+//
+// The snapshot is named by the snapshot parameter, or by
+// the current time if none is given.
+//
+// A snapshot is a full copy of the account rather than a
+// record of changes, since files are written in place and
+// could not share storage with it. Without deduplication each
+// snapshot takes as much disk as the account itself; with it
+// only the references to the blobs are copied. Either way the
+// copy counts in full toward the account's quota
+func createSnapshot(account string, params url.Values, conn net.Conn) (common.ResponseData, error) {
+	name := params.Get(common.ParamSnapshot)
+	if name == "" {
+		name = time.Now().UTC().Format("20060102T150405.000000000Z")
+	}
+	if err := checkSnapshotName(name); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	dir := snapshotDir(account, name)
+	exists, err := checkExistence(dir)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	if exists == true {
+		return common.ResponseData{}, fmt.Errorf("snapshot %s: %w", name, os.ErrExist)
+	}
+
+	accountPath := path.Join(accountRoot, account)
+	added, err := treeUsage(accountPath)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	if err := checkQuotaUsage(account, added); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	if err := os.MkdirAll(snapshotsDir(account), os.FileMode(0744)); err != nil {
+		return common.ResponseData{}, err
+	}
+	if err := copyTree(accountPath, dir); err != nil {
+		os.RemoveAll(dir)
+		return common.ResponseData{}, err
+	}
+
+	resp := fmt.Sprintf("created snapshot %s", name)
+	res := createResponseData("SNAPSHOT", resp, "", 0, nil, conn)
+	res.Header.Params = url.Values{common.ParamSnapshot: {name}}
+	return res, nil
+}
+
+// List the snapshots of the given account
+//
+// Each snapshot is sent as a line of the form:
+//
+//	name files bytes created
+func listSnapshots(account string, conn net.Conn) (common.ResponseData, error) {
+	entries, err := ioutil.ReadDir(snapshotsDir(account))
+	if err != nil && os.IsNotExist(err) == false {
+		return common.ResponseData{}, err
+	}
+
+	var size int
+	dataList := list.New()
+	for _, entry := range entries {
+		if entry.IsDir() == false {
+			continue
+		}
+		var files, bytes int64
+		err := filepath.Walk(path.Join(snapshotsDir(account), entry.Name()),
+			func(filePath string, info os.FileInfo, err error) error {
+				if err != nil || info.Mode().IsRegular() == false {
+					return err
+				}
+				size, err := contentSize(filePath, info)
+				files++
+				bytes += size
+				return err
+			})
+		if err != nil {
+			return common.ResponseData{}, err
+		}
+
+		line := fmt.Sprintf("%s %d %d %s\n", entry.Name(), files, bytes,
+			entry.ModTime().UTC().Format(time.RFC3339))
+		dataList.PushBack(common.Data{Size: len(line), Buffer: []byte(line)})
+		size += len(line)
+	}
+
+	resp := fmt.Sprintf("%d snapshots", dataList.Len())
+	return createResponseData("LIST-SNAPSHOTS", resp, "", uint64(size), dataList, conn), nil
+}
+
+// Return the files of the given account to their state in
+// the snapshot named by the snapshot parameter
+//
+// Files changed since the snapshot are saved as previous
+// versions, and files and directories created since, at any
+// depth, are moved to the trash, so a restore can be undone.
+// The files brought back count toward the account's quota
+func restoreSnapshot(account string, params url.Values, conn net.Conn) (common.ResponseData, error) {
+	name := params.Get(common.ParamSnapshot)
+	if name == "" {
+		return common.ResponseData{}, fmt.Errorf("restore requires a snapshot")
+	}
+	src, err := browsePath(account, "", params)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+
+	added, err := restoreUsage(account, src)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	if err := checkQuotaUsage(account, added); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	accountPath := path.Join(accountRoot, account)
+	err = filepath.Walk(accountPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || filePath == accountPath {
+			return err
+		}
+		rel, err := filepath.Rel(accountPath, filePath)
+		if err != nil {
+			return err
+		}
+		saved, err := os.Lstat(path.Join(src, rel))
+		if err != nil && os.IsNotExist(err) == false {
+			return err
+		}
+		if err == nil && saved.IsDir() == info.IsDir() {
+			return nil
+		}
+		if err := lockedTrashFile(account, rel); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+
+	var restored int
+	err = filepath.Walk(src, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, filePath)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(path.Join(accountPath, rel), os.FileMode(0744))
+		}
+		changed, err := restoreSnapshotFile(account, rel, filePath)
+		if changed == true {
+			restored++
+		}
+		return err
+	})
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+
+	resp := fmt.Sprintf("restored %d files from snapshot %s", restored, name)
+	res := createResponseData("RESTORE-SNAPSHOT", resp, "", 0, nil, conn)
+	res.Header.Params = url.Values{common.ParamSnapshot: {name}}
+	return res, nil
+}
+
+// Bytes and files a restore from a snapshot adds to an
+// account: the files of the snapshot that differ from the
+// account's copies, whose contents are kept as versions
+func restoreUsage(account string, src string) (usage, error) {
+	var u usage
+	err := filepath.Walk(src, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil || info.Mode().IsRegular() == false {
+			return err
+		}
+		rel, err := filepath.Rel(src, filePath)
+		if err != nil {
+			return err
+		}
+		currentPath := path.Join(accountRoot, account, rel)
+		if current, err := os.Stat(currentPath); err == nil && current.IsDir() == false {
+			currentVersion, err := fileVersion(currentPath)
+			if err != nil {
+				return err
+			}
+			version, err := fileVersion(filePath)
+			if err != nil || currentVersion == version {
+				return err
+			}
+		}
+		size, err := contentSize(filePath, info)
+		u.bytes += size
+		u.files++
+		return err
+	})
+	return u, err
+}
+
+// Move a file to the trash while holding its lock
+func lockedTrashFile(account string, fileName string) error {
+	filePath := path.Join(accountRoot, account, fileName)
+	fileLocks.lock(filePath)
+	defer fileLocks.unlock(filePath)
+	return trashFile(account, fileName)
+}
+
+// Replace a file of an account with its copy in a snapshot
+// unless they already match
+func restoreSnapshotFile(account string, fileName string, src string) (bool, error) {
+	filePath := path.Join(accountRoot, account, fileName)
+	fileLocks.lock(filePath)
+	defer fileLocks.unlock(filePath)
+
+	current, err := fileVersion(filePath)
+	if err != nil {
+		return false, err
+	}
+	version, err := fileVersion(src)
+	if err != nil || current == version {
+		return false, err
+	}
+	return true, replaceFile(account, fileName, src)
+}
+
+// Remove the snapshot named by the snapshot parameter
+func deleteSnapshot(account string, params url.Values, conn net.Conn) (common.ResponseData, error) {
+	name := params.Get(common.ParamSnapshot)
+	if name == "" {
+		return common.ResponseData{}, fmt.Errorf("delete requires a snapshot")
+	}
+	dir, err := browsePath(account, "", params)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	resp := fmt.Sprintf("deleted snapshot %s", name)
+	return createResponseData("DELETE-SNAPSHOT", resp, "", 0, nil, conn), nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+func TestSnapshots(t *testing.T) {
+	accountName := "snapshot"
+	accountPath := createTestAccount(accountName, t)
+	defer os.RemoveAll(accountPath)
+	defer os.RemoveAll(snapshotsDir(accountName))
+	defer os.RemoveAll(trashDir(accountName))
+	defer os.RemoveAll(path.Join(stateDir(), "versions", accountName))
+
+	writeTestFile(accountName, "monday.txt", "rainy", t)
+	writeTestFile(accountName, "tuesday.txt", "sunny", t)
+
+	before := url.Values{common.ParamSnapshot: {"before"}}
+	if _, err := createSnapshot(accountName, before, nil); err != nil {
+		t.Fatalf("createSnapshot(%s, %v) = %v", accountName, before, err)
+	}
+	_, err := createSnapshot(accountName, before, nil)
+	if errors.Is(err, os.ErrExist) == false {
+		t.Errorf("repeat createSnapshot(%s, %v) = %v, expected exists", accountName, before, err)
+	}
+
+	writeTestFile(accountName, "monday.txt", " then sunny", t)
+	writeTestFile(accountName, "wednesday.txt", "windy", t)
+	if _, err := deleteFile(accountName, "tuesday.txt", nil, nil); err != nil {
+		t.Fatalf("deleteFile(%s, tuesday.txt) = %v", accountName, err)
+	}
+
+	resp, err := readFile(accountName, "monday.txt", before, nil)
+	if err != nil || string(common.JoinDataList(resp.DataList)) != "rainy" {
+		t.Errorf("readFile from snapshot = %v, %v", resp, err)
+	}
+	resp, err = listFiles(accountName, "", before, nil)
+	if err != nil || resp.DataList.Len() != 2 {
+		t.Errorf("listFiles of snapshot = %v, %v", resp, err)
+	}
+	if _, err := statFile(accountName, "wednesday.txt", before, nil); errors.Is(err, os.ErrNotExist) == false {
+		t.Errorf("statFile of file missing from snapshot = %v", err)
+	}
+	if err := checkSnapshotAccess("WRITE", before); errors.Is(err, errReadOnly) == false {
+		t.Errorf("checkSnapshotAccess(WRITE, %v) = %v, expected read-only", before, err)
+	}
+
+	resp, err = listSnapshots(accountName, nil)
+	if err != nil || strings.HasPrefix(string(common.JoinDataList(resp.DataList)), "before 2 10 ") == false {
+		t.Errorf("listSnapshots(%s) = %q, %v", accountName, common.JoinDataList(resp.DataList), err)
+	}
+
+	if _, err := restoreSnapshot(accountName, before, nil); err != nil {
+		t.Fatalf("restoreSnapshot(%s, %v) = %v", accountName, before, err)
+	}
+	for fileName, want := range map[string]string{"monday.txt": "rainy", "tuesday.txt": "sunny"} {
+		bytes, err := ioutil.ReadFile(path.Join(accountPath, fileName))
+		if err != nil || string(bytes) != want {
+			t.Errorf("restored %s = %q, %v, want %q", fileName, string(bytes), err, want)
+		}
+	}
+	if exists, _ := checkExistence(path.Join(accountPath, "wednesday.txt")); exists == true {
+		t.Errorf("file created after snapshot survived restore")
+	}
+	if _, err := findTrash(accountName, "wednesday.txt", ""); err != nil {
+		t.Errorf("file created after snapshot not in trash: %v", err)
+	}
+
+	if _, err := deleteSnapshot(accountName, before, nil); err != nil {
+		t.Errorf("deleteSnapshot(%s, %v) = %v", accountName, before, err)
+	}
+	if _, err := readFile(accountName, "monday.txt", before, nil); errors.Is(err, os.ErrNotExist) == false {
+		t.Errorf("readFile from deleted snapshot = %v, expected not found", err)
+	}
+}
+
+func TestSnapshotQuota(t *testing.T) {
+	accountName := "snapshot_quota"
+	accountPath := createTestAccount(accountName, t)
+	defer os.RemoveAll(accountPath)
+	defer os.RemoveAll(snapshotsDir(accountName))
+
+	writeTestFile(accountName, "large.txt", "0123456789", t)
+
+	defer func(q quota) { defaultQuota = q }(defaultQuota)
+	defaultQuota = quota{maxBytes: 15}
+
+	params := url.Values{common.ParamSnapshot: {"full"}}
+	if _, err := createSnapshot(accountName, params, nil); errors.Is(err, errQuotaExceeded) == false {
+		t.Errorf("createSnapshot beyond the quota = %v", err)
+	}
+	if exists, _ := checkExistence(snapshotDir(accountName, "full")); exists == true {
+		t.Errorf("snapshot beyond the quota was created")
+	}
+}
+
+func TestRestoreSnapshotNested(t *testing.T) {
+	accountName := "snapshot_nested"
+	accountPath := createTestAccount(accountName, t)
+	defer os.RemoveAll(accountPath)
+	defer os.RemoveAll(snapshotsDir(accountName))
+	defer os.RemoveAll(trashDir(accountName))
+	defer os.RemoveAll(versionDir(accountName, ""))
+
+	if _, err := makeDirectory(accountName, "notes", nil); err != nil {
+		t.Fatalf("makeDirectory(notes) = %v", err)
+	}
+	writeTestFile(accountName, "notes/kept.txt", "kept", t)
+	before := url.Values{common.ParamSnapshot: {"before"}}
+	if _, err := createSnapshot(accountName, before, nil); err != nil {
+		t.Fatalf("createSnapshot(%s, %v) = %v", accountName, before, err)
+	}
+
+	writeTestFile(accountName, "notes/added.txt", "added", t)
+	if _, err := makeDirectory(accountName, "notes/drafts", nil); err != nil {
+		t.Fatalf("makeDirectory(notes/drafts) = %v", err)
+	}
+	writeTestFile(accountName, "notes/drafts/draft.txt", "draft", t)
+
+	if _, err := restoreSnapshot(accountName, before, nil); err != nil {
+		t.Fatalf("restoreSnapshot(%s, %v) = %v", accountName, before, err)
+	}
+	for _, fileName := range []string{"notes/added.txt", "notes/drafts"} {
+		if exists, _ := checkExistence(path.Join(accountPath, fileName)); exists == true {
+			t.Errorf("%s created after snapshot survived restore", fileName)
+		}
+		if _, err := findTrash(accountName, fileName, ""); err != nil {
+			t.Errorf("%s created after snapshot not in trash: %v", fileName, err)
+		}
+	}
+	if bytes, err := ioutil.ReadFile(path.Join(accountPath, "notes/kept.txt")); err != nil || string(bytes) != "kept" {
+		t.Errorf("restored notes/kept.txt = %q, %v", bytes, err)
+	}
+
+	if _, err := purgeFile(accountName, "notes/drafts", nil, nil); err != nil {
+		t.Errorf("purgeFile(%s, notes/drafts) = %v", accountName, err)
+	}
+	defer func(expiry time.Duration) { trashExpiry = expiry }(trashExpiry)
+	trashExpiry = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if entries, err := listTrash(accountName); err != nil || len(entries) != 0 {
+		t.Errorf("listTrash(%s) after expiry = %v, %v", accountName, entries, err)
+	}
+}
+
+func TestRestoreSnapshotQuota(t *testing.T) {
+	accountName := "snapshot_restore_quota"
+	accountPath := createTestAccount(accountName, t)
+	defer os.RemoveAll(accountPath)
+	defer os.RemoveAll(snapshotsDir(accountName))
+	defer os.RemoveAll(trashDir(accountName))
+	defer os.RemoveAll(versionDir(accountName, ""))
+
+	writeTestFile(accountName, "journal.txt", "first draft", t)
+	before := url.Values{common.ParamSnapshot: {"before"}}
+	if _, err := createSnapshot(accountName, before, nil); err != nil {
+		t.Fatalf("createSnapshot(%s, %v) = %v", accountName, before, err)
+	}
+	if _, err := deleteFile(accountName, "journal.txt", nil, nil); err != nil {
+		t.Fatalf("deleteFile(%s, journal.txt) = %v", accountName, err)
+	}
+	writeTestFile(accountName, "journal.txt", "second draft", t)
+
+	u, err := accountUsage(accountName)
+	if err != nil {
+		t.Fatalf("accountUsage(%s) = %v", accountName, err)
+	}
+	defer func(q quota) { defaultQuota = q }(defaultQuota)
+	defaultQuota = quota{maxBytes: u.bytes + int64(len("first draft")) - 1}
+
+	_, err = restoreSnapshot(accountName, before, nil)
+	if errors.Is(err, errQuotaExceeded) == false {
+		t.Errorf("restoreSnapshot(%s, %v) over quota = %v", accountName, before, err)
+	}
+	if bytes, _ := ioutil.ReadFile(path.Join(accountPath, "journal.txt")); string(bytes) != "second draft" {
+		t.Errorf("journal.txt after refused restore = %q", bytes)
+	}
+
+	defaultQuota.maxBytes++
+	if _, err := restoreSnapshot(accountName, before, nil); err != nil {
+		t.Errorf("restoreSnapshot(%s, %v) = %v", accountName, before, err)
+	}
+}
@@ -0,0 +1,562 @@
+// File contents storage with optional content-addressed
+// deduplication
+//
+// In deduplicating mode the contents of a file are stored once
+// per distinct content in a blob named by its SHA-256 hash, and
+// the file itself holds a reference naming a record in the state
+// directory. The record gives the blob and its size, so contents
+// written by clients are never taken for references. Copies of a
+// file in the trash or version history share the same record.
+// Reference counts are taken by collectGarbage, which removes
+// records and blobs no longer referenced by any file.
+package main
+
+import (
+	"container/list"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+const (
+	// first word of a file referencing a blob
+	blobMagic string = "go_ftp-blob"
+	// files larger than this cannot be blob references
+	maxBlobRefSize int64 = 128
+	// bytes of random identifier naming a reference record
+	blobRefIDSize int = 16
+	// prefix of blobs still being written
+	incomingPrefix string = "incoming"
+	// most file versions held by fileVersions
+	maxCachedVersions int = 10000
+)
+
+var (
+	// store new contents in deduplicated blobs
+	dedup bool
+	// interval between garbage collections, zero disables them
+	gcInterval time.Duration
+
+	// held shared by every storage operation and exclusively
+	// while collecting garbage so that references cannot move
+	// or appear during a collection
+	storageLock sync.RWMutex
+)
+
+// A reference from a file to the blob holding its contents
+type blobRef struct {
+	// identifier of the record of the reference
+	id   string
+	hash string
+	size int64
+}
+
+// Version of a file computed from its contents and the info
+// of the file when it was computed
+type cachedVersion struct {
+	info    os.FileInfo
+	version string
+}
+
+// versionCache holds the versions computed for files so that
+// listings and conditional requests do not hash unchanged files
+type versionCache struct {
+	mu       sync.Mutex
+	versions map[string]cachedVersion
+}
+
+var fileVersions = versionCache{versions: make(map[string]cachedVersion)}
+
+// Find the version of a file if it is unchanged since the
+// version was computed
+func (c *versionCache) get(filePath string, info os.FileInfo) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cached, ok := c.versions[filePath]
+	if ok == false || os.SameFile(cached.info, info) == false ||
+		cached.info.Size() != info.Size() || cached.info.ModTime().Equal(info.ModTime()) == false {
+		return "", false
+	}
+	return cached.version, true
+}
+
+// Remember the version of a file computed while it had the
+// given info, dropping another version if the cache is full
+func (c *versionCache) put(filePath string, info os.FileInfo, version string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.versions[filePath]; ok == false && len(c.versions) >= maxCachedVersions {
+		for dropped := range c.versions {
+			delete(c.versions, dropped)
+			break
+		}
+	}
+	c.versions[filePath] = cachedVersion{info, version}
+}
+
+// Results of a garbage collection
+type gcStats struct {
+	blobs      int
+	references int
+	removed    int
+	freed      int64
+	skipped    int
+}
+
+// Directory holding all blobs
+func blobDir() string {
+	return path.Join(stateDir(), "blobs")
+}
+
+// Path of the blob with the given hash
+func blobPath(hash string) string {
+	return path.Join(blobDir(), hash[:2], hash)
+}
+
+// Directory holding the records of blob references
+func blobRefDir() string {
+	return path.Join(stateDir(), "refs")
+}
+
+// Path of the record of the reference with the given identifier
+func blobRefPath(id string) string {
+	return path.Join(blobRefDir(), id[:2], id)
+}
+
+// Contents of a file holding the reference
+func (ref blobRef) String() string {
+	return fmt.Sprintf("%s %s\n", blobMagic, ref.id)
+}
+
+// Record a new reference to a blob, returning it with its
+// identifier
+func recordBlobRef(hash string, size int64) (blobRef, error) {
+	id := make([]byte, blobRefIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return blobRef{}, err
+	}
+	ref := blobRef{hex.EncodeToString(id), hash, size}
+	recordPath := blobRefPath(ref.id)
+	if err := os.MkdirAll(path.Dir(recordPath), os.FileMode(0744)); err != nil {
+		return blobRef{}, err
+	}
+	record := fmt.Sprintf("%s %d\n", ref.hash, ref.size)
+	return ref, ioutil.WriteFile(recordPath, []byte(record), defaultPerms)
+}
+
+// Read the blob reference held by a file
+//
+// ok is false if the file holds its contents directly, which
+// includes files resembling a reference that has no record
+func readBlobRef(filePath string, info os.FileInfo) (ref blobRef, ok bool, err error) {
+	if info.Size() > maxBlobRefSize || info.Mode().IsRegular() == false {
+		return blobRef{}, false, nil
+	}
+
+	contents, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return blobRef{}, false, err
+	}
+	fields := strings.Fields(string(contents))
+	if len(fields) != 2 || fields[0] != blobMagic || len(fields[1]) != blobRefIDSize*2 {
+		return blobRef{}, false, nil
+	}
+	if _, err := hex.DecodeString(fields[1]); err != nil {
+		return blobRef{}, false, nil
+	}
+	ref.id = fields[1]
+	if ref.String() != string(contents) {
+		return blobRef{}, false, nil
+	}
+
+	record, err := ioutil.ReadFile(blobRefPath(ref.id))
+	if os.IsNotExist(err) == true {
+		return blobRef{}, false, nil
+	}
+	if err != nil {
+		return blobRef{}, false, err
+	}
+	fields = strings.Fields(string(record))
+	if len(fields) != 2 || len(fields[0]) != sha256.Size*2 {
+		return blobRef{}, false, fmt.Errorf("invalid blob reference record %s", ref.id)
+	}
+	if ref.size, err = strconv.ParseInt(fields[1], 10, 64); err != nil {
+		return blobRef{}, false, fmt.Errorf("invalid blob reference record %s", ref.id)
+	}
+	ref.hash = fields[0]
+	return ref, true, nil
+}
+
+// Resolve the path holding the contents of a file
+func contentPath(filePath string) (string, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", err
+	}
+	ref, ok, err := readBlobRef(filePath, info)
+	if err != nil || ok == false {
+		return filePath, err
+	}
+	return blobPath(ref.hash), nil
+}
+
+// Size of the contents of a file
+func contentSize(filePath string, info os.FileInfo) (int64, error) {
+	ref, ok, err := readBlobRef(filePath, info)
+	if err != nil || ok == false {
+		return info.Size(), err
+	}
+	return ref.size, nil
+}
+
+// Compute the version of a file from its contents
+//
+// An empty version and no error is returned if the
+// file does not exist. Versions are cached by the size and
+// modification time of the file, so a file is only hashed
+// again once it changes
+func fileVersion(filePath string) (string, error) {
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) == true {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	ref, ok, err := readBlobRef(filePath, info)
+	if err != nil {
+		return "", err
+	}
+	if ok == true {
+		return ref.hash, nil
+	}
+	if version, ok := fileVersions.get(filePath, info); ok == true {
+		return version, nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	version := hex.EncodeToString(hash.Sum(nil))
+	fileVersions.put(filePath, info, version)
+	return version, nil
+}
+
+// Read the contents of a file into a Data list
+func readContents(filePath string, dataList *list.List) (uint64, error) {
+	readPath, err := contentPath(filePath)
+	if err != nil {
+		return 0, err
+	}
+	return common.ReadFile(readPath, os.O_RDONLY, defaultPerms, dataList)
+}
+
+// Replace the reference held by a file with a copy of the
+// contents of its blob
+//
+// Nothing is done if the file does not exist or holds its
+// contents directly
+func inlineContents(filePath string) error {
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) == true {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ref, ok, err := readBlobRef(filePath, info)
+	if err != nil || ok == false {
+		return err
+	}
+
+	blob, err := os.Open(blobPath(ref.hash))
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	file, err := os.OpenFile(filePath, os.O_TRUNC|os.O_WRONLY, defaultPerms)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, blob); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Append a Data list to the contents of a file, or replace
+// the contents with it if truncate is set
+//
+// Without deduplication a file holding a blob reference gets
+// its contents back before it is appended to
+func writeContents(filePath string, dataList *list.List, truncate bool) error {
+	if dedup == false {
+		if truncate == false {
+			if err := inlineContents(filePath); err != nil {
+				return err
+			}
+		}
+		openFlags := os.O_APPEND | os.O_CREATE | os.O_WRONLY
+		if truncate == true {
+			openFlags = os.O_TRUNC | os.O_CREATE | os.O_WRONLY
+		}
+		return common.WriteFile(filePath, openFlags, defaultPerms, dataList)
+	}
+
+	if err := os.MkdirAll(blobDir(), os.FileMode(0744)); err != nil {
+		return err
+	}
+	incoming, err := ioutil.TempFile(blobDir(), incomingPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(incoming.Name())
+
+	ref, err := copyToBlob(incoming, filePath, dataList, truncate)
+	if closeErr := incoming.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	dst := blobPath(ref.hash)
+	if err := os.MkdirAll(path.Dir(dst), os.FileMode(0744)); err != nil {
+		return err
+	}
+	exists, err := checkExistence(dst)
+	if err != nil {
+		return err
+	}
+	if exists == false {
+		if err := os.Rename(incoming.Name(), dst); err != nil {
+			return err
+		}
+	}
+
+	if ref, err = recordBlobRef(ref.hash, ref.size); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filePath, []byte(ref.String()), defaultPerms)
+}
+
+// Write the current contents of a file, unless truncate is
+// set, followed by a Data list to an incoming blob and
+// compute its reference
+func copyToBlob(incoming io.Writer, filePath string, dataList *list.List, truncate bool) (blobRef, error) {
+	hash := sha256.New()
+	writer := io.MultiWriter(incoming, hash)
+
+	var size int64
+	srcPath, err := contentPath(filePath)
+	if truncate == true {
+		err = nil
+	} else if err == nil {
+		src, err := os.Open(srcPath)
+		if err != nil {
+			return blobRef{}, err
+		}
+		size, err = io.Copy(writer, src)
+		src.Close()
+		if err != nil {
+			return blobRef{}, err
+		}
+	} else if os.IsNotExist(err) == false {
+		return blobRef{}, err
+	}
+
+	for iter := dataList.Front(); iter != nil; iter = iter.Next() {
+		data := iter.Value.(common.Data)
+		if _, err := writer.Write(data.Buffer[:data.Size]); err != nil {
+			return blobRef{}, err
+		}
+		size += int64(data.Size)
+	}
+	return blobRef{hash: hex.EncodeToString(hash.Sum(nil)), size: size}, nil
+}
+
+// References found by a garbage collection
+type blobRefs struct {
+	// files referencing each blob
+	blobs map[string]int
+	// records referenced by some file
+	records map[string]bool
+	// files that could not be read
+	skipped int
+}
+
+// Directories that may hold files referencing blobs: those of
+// the accounts and their trash, versions and snapshots
+func blobRefRoots() ([]string, error) {
+	entries, err := ioutil.ReadDir(accountRoot)
+	if err != nil {
+		return nil, err
+	}
+	var roots []string
+	for _, entry := range entries {
+		if entry.IsDir() && checkAccountName(entry.Name()) == nil {
+			roots = append(roots, path.Join(accountRoot, entry.Name()))
+		}
+	}
+	for _, dir := range []string{"versions", "trash", "snapshots"} {
+		roots = append(roots, path.Join(stateDir(), dir))
+	}
+	return roots, nil
+}
+
+// Count the references to each blob from files of the
+// accounts
+//
+// Files that cannot be read are logged and counted as skipped
+func countBlobRefs() (blobRefs, error) {
+	refs := blobRefs{blobs: make(map[string]int), records: make(map[string]bool)}
+	roots, err := blobRefRoots()
+	if err != nil {
+		return blobRefs{}, err
+	}
+	for _, root := range roots {
+		filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) == true && filePath == root {
+				return filepath.SkipDir
+			}
+			var ref blobRef
+			var ok bool
+			if err == nil {
+				ref, ok, err = readBlobRef(filePath, info)
+			}
+			if err != nil {
+				slog.Warn("skipped unreadable file counting blob references", "path", filePath, "err", err)
+				refs.skipped++
+				return nil
+			}
+			if ok == true {
+				refs.blobs[ref.hash]++
+				refs.records[ref.id] = true
+			}
+			return nil
+		})
+	}
+	return refs, nil
+}
+
+// Remove the files of a directory tree that are not kept,
+// returning the number kept and the files removed
+func pruneTree(dir string, keep func(name string) bool) (int, []os.FileInfo, error) {
+	var kept int
+	var removed []os.FileInfo
+	err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) == true && filePath == dir {
+			return filepath.SkipDir
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if keep(info.Name()) == true {
+			kept++
+			return nil
+		}
+		if err := os.Remove(filePath); err != nil {
+			return err
+		}
+		removed = append(removed, info)
+		return nil
+	})
+	return kept, removed, err
+}
+
+// Remove reference records and blobs no longer referenced by
+// any file
+//
+// Nothing is removed if any file could not be checked
+// for references. The caller must hold storageLock
+// exclusively
+func collectGarbage() (gcStats, error) {
+	var stats gcStats
+
+	refs, err := countBlobRefs()
+	if err != nil {
+		return stats, fmt.Errorf("unable to count blob references: %v", err)
+	}
+	for _, count := range refs.blobs {
+		stats.references += count
+	}
+	stats.skipped = refs.skipped
+	keepAll := refs.skipped > 0
+	if keepAll == true {
+		slog.Warn("keeping all blobs after skipping unreadable files", "skipped", refs.skipped)
+	}
+
+	_, records, err := pruneTree(blobRefDir(), func(name string) bool { return keepAll || refs.records[name] })
+	if err != nil {
+		return stats, err
+	}
+	slog.Debug("removed blob reference records", "records", len(records))
+
+	kept, blobs, err := pruneTree(blobDir(), func(name string) bool { return keepAll || refs.blobs[name] > 0 })
+	stats.blobs = kept
+	for _, info := range blobs {
+		slog.Debug("removed blob", "blob", info.Name())
+		stats.removed++
+		stats.freed += info.Size()
+	}
+	return stats, err
+}
+
+// Collect garbage every gcInterval
+func runGarbageCollector() {
+	for range time.Tick(gcInterval) {
+		storageLock.Lock()
+		stats, err := collectGarbage()
+		storageLock.Unlock()
+		if err != nil {
+			slog.Error("garbage collection failed", "err", err)
+			continue
+		}
+		slog.Debug("collected garbage", "removed", stats.removed, "freed", stats.freed, "skipped", stats.skipped)
+	}
+}
+
+// Collect unreferenced blobs and report the results
+func garbageCollect(conn net.Conn) (common.ResponseData, error) {
+	stats, err := collectGarbage()
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+
+	params := url.Values{}
+	params.Set(common.ParamBlobs, strconv.Itoa(stats.blobs))
+	params.Set(common.ParamReferences, strconv.Itoa(stats.references))
+	params.Set(common.ParamRemoved, strconv.Itoa(stats.removed))
+	params.Set(common.ParamFreed, strconv.FormatInt(stats.freed, 10))
+
+	resp := fmt.Sprintf("removed %d blobs", stats.removed)
+	if stats.skipped > 0 {
+		resp += fmt.Sprintf(", kept all after skipping %d unreadable files", stats.skipped)
+	}
+	res := createResponseData("GC", resp, "", 0, nil, conn)
+	res.Header.Params = params
+	return res, nil
+}
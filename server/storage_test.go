@@ -0,0 +1,212 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+// count the blobs held by the server
+func countBlobs(t *testing.T) int {
+	matches, err := filepath.Glob(path.Join(blobDir(), "*", "*"))
+	if err != nil {
+		t.Fatalf("unable to list blobs: %v", err)
+	}
+	return len(matches)
+}
+
+// build a data list holding contents
+func testDataList(contents string) *list.List {
+	dataList := list.New()
+	dataList.PushBack(common.Data{Size: len(contents), Buffer: []byte(contents)})
+	return dataList
+}
+
+func TestDedupStorage(t *testing.T) {
+	defer func(enabled bool) { dedup = enabled }(dedup)
+	dedup = true
+	defer os.RemoveAll(blobDir())
+
+	accounts := []string{"dedup_a", "dedup_b"}
+	for _, account := range accounts {
+		accountPath := createTestAccount(account, t)
+		defer os.RemoveAll(accountPath)
+		defer os.RemoveAll(trashDir(account))
+		defer os.RemoveAll(path.Join(stateDir(), "versions", account))
+	}
+
+	fileName := "attachment.bin"
+	message := "the same attachment"
+	sum := sha256.Sum256([]byte(message))
+	for _, account := range accounts {
+		if version := writeTestFile(account, fileName, message, t); version != hex.EncodeToString(sum[:]) {
+			t.Errorf("dedup write version = %s, want content hash", version)
+		}
+	}
+	if count := countBlobs(t); count != 1 {
+		t.Fatalf("stored %d blobs for identical contents, want 1", count)
+	}
+
+	writeTestFile(accounts[0], fileName, " with a note", t)
+	resp, err := readFile(accounts[0], fileName, nil, nil)
+	if err != nil {
+		t.Fatalf("readFile(%s, %s) = %v", accounts[0], fileName, err)
+	}
+	if got := string(common.JoinDataList(resp.DataList)); got != message+" with a note" {
+		t.Errorf("appended dedup contents = %q", got)
+	}
+	stat, err := statFile(accounts[0], fileName, nil, nil)
+	if err != nil || stat.Header.Params.Get(common.ParamSize) != "31" {
+		t.Errorf("statFile of dedup file = %v, %v", stat.Header.Params, err)
+	}
+
+	// references outside the account directories are not counted
+	stray := path.Join(accountRoot, ".stray")
+	if err := os.Mkdir(stray, os.FileMode(0744)); err != nil {
+		t.Fatalf("unable to create stray dir: %v", err)
+	}
+	defer os.RemoveAll(stray)
+	ref, err := ioutil.ReadFile(path.Join(accountRoot, accounts[1], fileName))
+	if err != nil {
+		t.Fatalf("unable to read reference: %v", err)
+	}
+	ioutil.WriteFile(path.Join(stray, fileName), ref, 0644)
+
+	stats, err := collectGarbage()
+	if err != nil {
+		t.Fatalf("collectGarbage() = %v", err)
+	}
+	if stats.removed != 0 || stats.blobs != 2 || stats.references != 3 {
+		t.Errorf("collectGarbage() with live references = %+v", stats)
+	}
+
+	for _, account := range accounts {
+		os.RemoveAll(path.Join(accountRoot, account, fileName))
+		os.RemoveAll(path.Join(stateDir(), "versions", account))
+	}
+	stats, err = collectGarbage()
+	if err != nil || stats.removed != 2 || stats.blobs != 0 {
+		t.Errorf("collectGarbage() without references = %+v, %v", stats, err)
+	}
+}
+
+func TestReadBlobRef(t *testing.T) {
+	defer func(enabled bool) { dedup = enabled }(dedup)
+	dedup = true
+	dir, err := ioutil.TempDir("", "blob_ref")
+	if err != nil {
+		t.Fatalf("unable to create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	stored := path.Join(dir, "stored")
+	if err := writeContents(stored, testDataList("stored contents"), true); err != nil {
+		t.Fatalf("writeContents(%s) = %v", stored, err)
+	}
+	contents, err := ioutil.ReadFile(stored)
+	if err != nil {
+		t.Fatalf("unable to read reference: %v", err)
+	}
+	sum := sha256.Sum256([]byte("stored contents"))
+	hash := hex.EncodeToString(sum[:])
+	unrecorded := blobRef{id: hex.EncodeToString(make([]byte, blobRefIDSize))}
+
+	var tests = []struct {
+		contents string
+		ok       bool
+	}{
+		{string(contents), true},
+		{string(contents) + "trailing", false},
+		{unrecorded.String(), false},
+		{blobMagic + " " + hash + " 15\n", false},
+		{"plain contents", false},
+	}
+
+	for _, test := range tests {
+		filePath := path.Join(dir, "file")
+		if err := ioutil.WriteFile(filePath, []byte(test.contents), 0644); err != nil {
+			t.Fatalf("unable to write test file: %v", err)
+		}
+		info, err := os.Stat(filePath)
+		if err != nil {
+			t.Fatalf("unable to stat test file: %v", err)
+		}
+		ref, ok, err := readBlobRef(filePath, info)
+		if err != nil || ok != test.ok || (ok && (ref.size != 15 || ref.hash != hash)) {
+			t.Errorf("readBlobRef(%q) = %v, %v, %v", test.contents, ref, ok, err)
+		}
+	}
+}
+
+func TestInlineContents(t *testing.T) {
+	defer func(enabled bool) { dedup = enabled }(dedup)
+	dir, err := ioutil.TempDir("", "blob_inline")
+	if err != nil {
+		t.Fatalf("unable to create test dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filePath := path.Join(dir, "file")
+	dedup = true
+	if err := writeContents(filePath, testDataList("kept "), true); err != nil {
+		t.Fatalf("dedup writeContents = %v", err)
+	}
+	dedup = false
+	if err := writeContents(filePath, testDataList("and appended"), false); err != nil {
+		t.Fatalf("writeContents after dedup = %v", err)
+	}
+	if contents, err := ioutil.ReadFile(filePath); err != nil || string(contents) != "kept and appended" {
+		t.Errorf("append to a blob reference without dedup = %q, %v", contents, err)
+	}
+}
+
+func TestFileVersionCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go_ftp_version")
+	if err != nil {
+		t.Fatalf("unable to create directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	filePath := path.Join(dir, "journal.txt")
+	hash := func(contents string) string {
+		digest := sha256.Sum256([]byte(contents))
+		return hex.EncodeToString(digest[:])
+	}
+	written := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write := func(contents string, modTime time.Time) {
+		if err := ioutil.WriteFile(filePath, []byte(contents), defaultPerms); err != nil {
+			t.Fatalf("unable to write %s: %v", filePath, err)
+		}
+		if err := os.Chtimes(filePath, modTime, modTime); err != nil {
+			t.Fatalf("unable to set times of %s: %v", filePath, err)
+		}
+	}
+
+	var tests = []struct {
+		contents string
+		modTime  time.Time
+		version  string
+	}{
+		{"first draft", written, hash("first draft")},
+		// unchanged size and time are taken to be unchanged contents
+		{"final draft", written, hash("first draft")},
+		{"final draft", written.Add(time.Second), hash("final draft")},
+		{"final", written.Add(time.Second), hash("final")},
+	}
+
+	for _, test := range tests {
+		write(test.contents, test.modTime)
+		version, err := fileVersion(filePath)
+		if err != nil || version != test.version {
+			t.Errorf("fileVersion(%q at %v) = %s, %v, expected %s", test.contents, test.modTime, version, err, test.version)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Per-account trash holding deleted files and directories
+// until they expire
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+const defaultTrashExpiry time.Duration = 7 * 24 * time.Hour
+
+// age after which trashed files are purged,
+// zero keeps them until explicitly purged
+var trashExpiry time.Duration = defaultTrashExpiry
+
+// A deleted file or directory held in the trash
+//
+// The size and files of a directory are the totals of
+// the tree under it
+type trashEntry struct {
+	path     string
+	id       string
+	fileName string
+	dir      bool
+	size     int64
+	files    int64
+	deleted  time.Time
+}
+
+// Directory holding the trash of an account
+func trashDir(account string) string {
+	return path.Join(stateDir(), "trash", account)
+}
+
+// Move a file or directory into the trash of its account
+func trashFile(account string, fileName string) error {
+	dir := trashDir(account)
+	if err := os.MkdirAll(dir, os.FileMode(0744)); err != nil {
+		return err
+	}
+
+	id := strconv.FormatInt(time.Now().UnixNano(), 10)
+	name := id + "-" + url.PathEscape(fileName)
+	return os.Rename(path.Join(accountRoot, account, fileName), path.Join(dir, name))
+}
+
+// List the trash of an account, most recently deleted first
+//
+// Entries older than trashExpiry are purged
+func listTrash(account string) ([]trashEntry, error) {
+	dir := trashDir(account)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) == true {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []trashEntry
+	for _, file := range files {
+		fields := strings.SplitN(file.Name(), "-", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		nanos, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		fileName, err := url.PathUnescape(fields[1])
+		if err != nil {
+			continue
+		}
+
+		entry := trashEntry{
+			path:     path.Join(dir, file.Name()),
+			id:       fields[0],
+			fileName: fileName,
+			dir:      file.IsDir(),
+			deleted:  time.Unix(0, nanos),
+		}
+		if trashExpiry > 0 && time.Since(entry.deleted) > trashExpiry {
+			if err := os.RemoveAll(entry.path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if entry.dir == true {
+			u, err := treeUsage(entry.path)
+			if err != nil {
+				return nil, err
+			}
+			entry.size, entry.files = u.bytes, u.files
+		} else {
+			size, err := contentSize(entry.path, file)
+			if err != nil {
+				return nil, err
+			}
+			entry.size, entry.files = size, 1
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].deleted.After(entries[j].deleted)
+	})
+	return entries, nil
+}
+
+// Find the trash entries of a file
+//
+// All entries are returned if no id is given, otherwise only
+// the entry with the matching id
+func findTrash(account string, fileName string, id string) ([]trashEntry, error) {
+	entries, err := listTrash(account)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []trashEntry
+	for _, entry := range entries {
+		if entry.fileName == fileName && (id == "" || entry.id == id) {
+			found = append(found, entry)
+		}
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("%s in trash: %w", fileName, os.ErrNotExist)
+	}
+	return found, nil
+}
+
+// List the trash of the given account
+//
+// Each entry is sent as a line of the form:
+//
+//	id size deleted name
+//
+// where the name of a directory ends with a slash
+func listTrashFiles(account string, conn net.Conn) (common.ResponseData, error) {
+	entries, err := listTrash(account)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+
+	var size int
+	dataList := list.New()
+	for _, entry := range entries {
+		name := entry.fileName
+		if entry.dir == true {
+			name += "/"
+		}
+		line := fmt.Sprintf("%s %d %s %s\n", entry.id, entry.size,
+			entry.deleted.UTC().Format(time.RFC3339), name)
+		dataList.PushBack(common.Data{Size: len(line), Buffer: []byte(line)})
+		size += len(line)
+	}
+
+	resp := fmt.Sprintf("%d files in trash", len(entries))
+	return createResponseData("TRASH", resp, "", uint64(size), dataList, conn), nil
+}
+
+// Move a file or directory from the trash back under the
+// given account
+//
+// The most recently deleted copy is restored unless the
+// trash-id parameter selects another one. Undelete will
+// fail if the file exists or the account's quota would
+// be exceeded
+func undeleteFile(account string, fileName string, params url.Values, conn net.Conn) (common.ResponseData, error) {
+	filePath := path.Join(accountRoot, account, fileName)
+
+	fileLocks.lock(filePath)
+	defer fileLocks.unlock(filePath)
+
+	exists, err := checkExistence(filePath)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	if exists == true {
+		return common.ResponseData{}, fmt.Errorf("%s: %w", fileName, os.ErrExist)
+	}
+
+	entries, err := findTrash(account, fileName, params.Get(common.ParamTrashID))
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	entry := entries[0]
+	if err := checkQuotaUsage(account, usage{bytes: entry.size, files: entry.files}); err != nil {
+		return common.ResponseData{}, err
+	}
+	if err := os.Rename(entry.path, filePath); err != nil {
+		return common.ResponseData{}, err
+	}
+
+	resp := fmt.Sprintf("undeleted %s", fileName)
+	res := createResponseData("UNDELETE", resp, "", 0, nil, conn)
+	if entry.dir == true {
+		return res, nil
+	}
+	version, err := fileVersion(filePath)
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+	res.Header.Params = versionParams(version)
+	return res, nil
+}
+
+// Permanently remove files from the trash of the given account
+//
+// Every trashed copy of the file is removed unless the trash-id
+// parameter selects one. The whole trash is emptied if no file
+// name is given
+func purgeFile(account string, fileName string, params url.Values, conn net.Conn) (common.ResponseData, error) {
+	var entries []trashEntry
+	var err error
+	if fileName == "" {
+		entries, err = listTrash(account)
+	} else {
+		entries, err = findTrash(account, fileName, params.Get(common.ParamTrashID))
+	}
+	if err != nil {
+		return common.ResponseData{}, err
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(entry.path); err != nil {
+			return common.ResponseData{}, err
+		}
+	}
+
+	resp := fmt.Sprintf("purged %d files", len(entries))
+	return createResponseData("PURGE", resp, "", 0, nil, conn), nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+func TestTrash(t *testing.T) {
+	accountName := "trash"
+	accountPath := createTestAccount(accountName, t)
+	defer os.RemoveAll(accountPath)
+	defer os.RemoveAll(trashDir(accountName))
+
+	fileName := "journal.txt"
+	writeTestFile(accountName, fileName, "first draft", t)
+	if _, err := deleteFile(accountName, fileName, nil, nil); err != nil {
+		t.Fatalf("deleteFile(%s, %s) = %v", accountName, fileName, err)
+	}
+	writeTestFile(accountName, fileName, "second draft", t)
+	if _, err := deleteFile(accountName, fileName, nil, nil); err != nil {
+		t.Fatalf("deleteFile(%s, %s) = %v", accountName, fileName, err)
+	}
+
+	resp, err := listTrashFiles(accountName, nil)
+	if err != nil || resp.DataList.Len() != 2 {
+		t.Fatalf("listTrashFiles(%s) = %v, %v, want 2 entries", accountName, resp, err)
+	}
+
+	entries, err := listTrash(accountName)
+	if err != nil {
+		t.Fatalf("listTrash(%s) = %v", accountName, err)
+	}
+	oldest := url.Values{common.ParamTrashID: {entries[1].id}}
+	if _, err := undeleteFile(accountName, fileName, oldest, nil); err != nil {
+		t.Fatalf("undeleteFile(%s, %s, %v) = %v", accountName, fileName, oldest, err)
+	}
+	bytes, err := ioutil.ReadFile(path.Join(accountPath, fileName))
+	if err != nil || string(bytes) != "first draft" {
+		t.Errorf("undeleted contents = %q, %v", string(bytes), err)
+	}
+
+	_, err = undeleteFile(accountName, fileName, nil, nil)
+	if errors.Is(err, os.ErrExist) == false {
+		t.Errorf("undeleteFile over an existing file = %v, expected exists", err)
+	}
+
+	if _, err := purgeFile(accountName, fileName, nil, nil); err != nil {
+		t.Errorf("purgeFile(%s, %s) = %v", accountName, fileName, err)
+	}
+	_, err = purgeFile(accountName, fileName, nil, nil)
+	if errors.Is(err, os.ErrNotExist) == false {
+		t.Errorf("repeat purgeFile(%s, %s) = %v, expected not found", accountName, fileName, err)
+	}
+}
+
+func TestTrashExpiry(t *testing.T) {
+	accountName := "expiry"
+	accountPath := createTestAccount(accountName, t)
+	defer os.RemoveAll(accountPath)
+	defer os.RemoveAll(trashDir(accountName))
+
+	fileName := "journal.txt"
+	writeTestFile(accountName, fileName, "ephemeral", t)
+	if _, err := deleteFile(accountName, fileName, nil, nil); err != nil {
+		t.Fatalf("deleteFile(%s, %s) = %v", accountName, fileName, err)
+	}
+
+	defer func(expiry time.Duration) { trashExpiry = expiry }(trashExpiry)
+	trashExpiry = time.Nanosecond
+	time.Sleep(time.Millisecond)
+
+	entries, err := listTrash(accountName)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("listTrash(%s) after expiry = %v, %v", accountName, entries, err)
+	}
+}
+
+func TestTrashDirectory(t *testing.T) {
+	accountName := "trash_directory"
+	accountPath := createTestAccount(accountName, t)
+	defer os.RemoveAll(accountPath)
+	defer os.RemoveAll(trashDir(accountName))
+
+	deleteTree := func() {
+		for _, dirName := range []string{"notes", "notes/drafts"} {
+			if _, err := makeDirectory(accountName, dirName, nil); err != nil {
+				t.Fatalf("makeDirectory(%s, %s) = %v", accountName, dirName, err)
+			}
+		}
+		writeTestFile(accountName, "notes/kept.txt", "kept", t)
+		writeTestFile(accountName, "notes/drafts/draft.txt", "draft", t)
+		if _, err := deleteFile(accountName, "notes", nil, nil); err != nil {
+			t.Fatalf("deleteFile(%s, notes) = %v", accountName, err)
+		}
+	}
+
+	deleteTree()
+	entries, err := listTrash(accountName)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("listTrash(%s) = %v, %v, want 1 entry", accountName, entries, err)
+	}
+	if entries[0].dir == false || entries[0].size != 9 || entries[0].files != 2 {
+		t.Errorf("trashed directory = %+v, want 9 bytes in 2 files", entries[0])
+	}
+	if _, err := undeleteFile(accountName, "notes", nil, nil); err != nil {
+		t.Fatalf("undeleteFile(%s, notes) = %v", accountName, err)
+	}
+	if exists, _ := checkExistence(path.Join(accountPath, "notes/drafts/draft.txt")); exists == false {
+		t.Errorf("undeleted directory lost notes/drafts/draft.txt")
+	}
+	if _, err := deleteFile(accountName, "notes", nil, nil); err != nil {
+		t.Fatalf("deleteFile(%s, notes) = %v", accountName, err)
+	}
+	if _, err := purgeFile(accountName, "notes", nil, nil); err != nil {
+		t.Errorf("purgeFile(%s, notes) = %v", accountName, err)
+	}
+
+	deleteTree()
+	defer func(expiry time.Duration) { trashExpiry = expiry }(trashExpiry)
+	trashExpiry = time.Nanosecond
+	time.Sleep(time.Millisecond)
+
+	entries, err = listTrash(accountName)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("listTrash(%s) after expiry = %v, %v", accountName, entries, err)
+	}
+	files, err := ioutil.ReadDir(trashDir(accountName))
+	if err != nil || len(files) != 0 {
+		t.Errorf("trash of %s after expiry holds %d entries, %v", accountName, len(files), err)
+	}
+}
@@ -0,0 +1,89 @@
+// File versions and conditional operations
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+// errPreconditionFailed is returned when a conditional
+// request does not match the current file version
+var errPreconditionFailed = errors.New("precondition failed")
+
+// pathLock is a mutex shared by all users of a path
+type pathLock struct {
+	mu    sync.Mutex
+	users int
+}
+
+// pathLocks serializes operations on the same path so a
+// precondition check and the following change are atomic
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+var fileLocks = pathLocks{locks: make(map[string]*pathLock)}
+
+// Lock the given path
+func (p *pathLocks) lock(path string) {
+	p.mu.Lock()
+	l, ok := p.locks[path]
+	if !ok {
+		l = &pathLock{}
+		p.locks[path] = l
+	}
+	l.users++
+	p.mu.Unlock()
+
+	l.mu.Lock()
+}
+
+// Unlock the given path
+func (p *pathLocks) unlock(path string) {
+	p.mu.Lock()
+	l := p.locks[path]
+	l.users--
+	if l.users == 0 {
+		delete(p.locks, path)
+	}
+	p.mu.Unlock()
+
+	l.mu.Unlock()
+}
+
+// Check the if-match and if-none-match parameters of a
+// request against the current version of a file
+func checkPrecondition(filePath string, params url.Values) error {
+	ifMatch := params.Get(common.ParamIfMatch)
+	ifNoneMatch := params.Get(common.ParamIfNoneMatch)
+	if ifMatch == "" && ifNoneMatch == "" {
+		return nil
+	}
+
+	version, err := fileVersion(filePath)
+	if err != nil {
+		return err
+	}
+
+	if ifMatch != "" {
+		if version == "" || (ifMatch != "*" && ifMatch != version) {
+			return fmt.Errorf("%w: version is %q, want %q", errPreconditionFailed, version, ifMatch)
+		}
+	}
+	if ifNoneMatch != "" {
+		if version != "" && (ifNoneMatch == "*" || ifNoneMatch == version) {
+			return fmt.Errorf("%w: version is %q", errPreconditionFailed, version)
+		}
+	}
+	return nil
+}
+
+// Create parameters reporting the version of a file
+func versionParams(version string) url.Values {
+	return url.Values{common.ParamVersion: {version}}
+}
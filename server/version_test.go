@@ -0,0 +1,113 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+func TestCheckPrecondition(t *testing.T) {
+	accountName := "test"
+	accountPath := createTestAccount(accountName, t)
+	defer os.Remove(accountPath)
+
+	filePath := path.Join(accountPath, "test_file.txt")
+	if err := ioutil.WriteFile(filePath, []byte("fish sticks"), 0644); err != nil {
+		t.Fatalf("unable to write test file: %v", err)
+	}
+	defer os.Remove(filePath)
+
+	version, err := fileVersion(filePath)
+	if err != nil || version == "" {
+		t.Fatalf("fileVersion(%s) = %q, %v", filePath, version, err)
+	}
+
+	var tests = []struct {
+		filePath string
+		params   url.Values
+		fail     bool
+	}{
+		{filePath, nil, false},
+		{filePath, url.Values{common.ParamIfMatch: {version}}, false},
+		{filePath, url.Values{common.ParamIfMatch: {"*"}}, false},
+		{filePath, url.Values{common.ParamIfMatch: {"stale"}}, true},
+		{filePath, url.Values{common.ParamIfNoneMatch: {"*"}}, true},
+		{filePath, url.Values{common.ParamIfNoneMatch: {version}}, true},
+		{filePath, url.Values{common.ParamIfNoneMatch: {"stale"}}, false},
+		{path.Join(accountPath, "missing"), url.Values{common.ParamIfMatch: {"*"}}, true},
+		{path.Join(accountPath, "missing"), url.Values{common.ParamIfNoneMatch: {"*"}}, false},
+	}
+
+	for _, test := range tests {
+		err := checkPrecondition(test.filePath, test.params)
+		if test.fail != errors.Is(err, errPreconditionFailed) {
+			t.Errorf("checkPrecondition(%s, %v) = %v", test.filePath, test.params, err)
+		}
+	}
+}
+
+func TestConditionalWrite(t *testing.T) {
+	accountName := "test"
+	accountPath := createTestAccount(accountName, t)
+	defer os.Remove(accountPath)
+
+	fileName := "test_file.txt"
+	defer os.Remove(path.Join(accountPath, fileName))
+
+	message := []byte("fish sticks and custard")
+	dataList := list.New()
+	dataList.PushBack(common.Data{Size: len(message), Buffer: message})
+
+	create := url.Values{common.ParamIfNoneMatch: {"*"}}
+	resp, err := writeFile(accountName, fileName, create, dataList, nil)
+	if err != nil {
+		t.Fatalf("writeFile(%s, %s, %v) = %v", accountName, fileName, create, err)
+	}
+	version := resp.Header.Params.Get(common.ParamVersion)
+
+	_, err = writeFile(accountName, fileName, create, dataList, nil)
+	if errors.Is(err, errPreconditionFailed) == false {
+		t.Errorf("repeat writeFile(%s, %s, %v) = %v, expected precondition failure",
+			accountName, fileName, create, err)
+	}
+
+	stat, err := statFile(accountName, fileName, nil, nil)
+	if err != nil {
+		t.Fatalf("statFile(%s, %s) = %v", accountName, fileName, err)
+	}
+	if stat.Header.Params.Get(common.ParamVersion) != version {
+		t.Errorf("stat version %s != write version %s", stat.Header.Params.Get(common.ParamVersion), version)
+	}
+	if stat.Header.Params.Get(common.ParamSize) != "23" {
+		t.Errorf("stat size = %s, want 23", stat.Header.Params.Get(common.ParamSize))
+	}
+
+	read, err := readFile(accountName, fileName, nil, nil)
+	if err != nil {
+		t.Fatalf("readFile(%s, %s) = %v", accountName, fileName, err)
+	}
+	if read.Header.Params.Get(common.ParamVersion) != version {
+		t.Errorf("read version %s != write version %s", read.Header.Params.Get(common.ParamVersion), version)
+	}
+
+	update := url.Values{common.ParamIfMatch: {version}}
+	if _, err := writeFile(accountName, fileName, update, dataList, nil); err != nil {
+		t.Errorf("writeFile(%s, %s, %v) = %v", accountName, fileName, update, err)
+	}
+
+	_, err = deleteFile(accountName, fileName, update, nil)
+	if errors.Is(err, errPreconditionFailed) == false {
+		t.Errorf("deleteFile with stale version = %v, expected precondition failure", err)
+	}
+
+	res := createErrorResponse(err, nil)
+	if res.Header.Params.Get(common.ParamCode) != common.CodePreconditionFailed {
+		t.Errorf("createErrorResponse(%v) code = %s", err, res.Header.Params.Get(common.ParamCode))
+	}
+}
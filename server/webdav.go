@@ -0,0 +1,859 @@
+// WebDAV front end for mounting accounts
+//
+// Each account is a collection at /dav/{account}/ that
+// desktop clients can mount. Requests are made on behalf of
+// an account as with the HTTP gateway and are performed with
+// dispatch, so they share authorization, quotas, storage,
+// metrics and the audit log with the other front ends:
+//
+//	GET, HEAD  READ and STAT
+//	PUT        WRITE replacing the file
+//	DELETE     DELETE
+//	MKCOL      MKDIR
+//	MOVE, COPY MOVE and COPY, deleting the destination first
+//	           unless the Overwrite header is F
+//	PROPFIND   STAT of the resource and, with depth 1, LIST and
+//	           STAT of its members
+//	LOCK       exclusive write locks held in memory
+//
+// PROPFIND always reports every supported property. Locks
+// only guard requests made through WebDAV.
+package main
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/teirm/go_ftp/common"
+)
+
+const (
+	davPrefix  string = "/dav/"
+	davMethods string = "OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, MOVE, COPY, PROPFIND, LOCK, UNLOCK"
+
+	defaultDAVLockTimeout time.Duration = 10 * time.Minute
+	maxDAVLockTimeout     time.Duration = time.Hour
+
+	// largest lockinfo body read by LOCK
+	maxDAVLockInfoSize int64 = 64 * 1024
+
+	// HTTP status of a request on a locked resource
+	statusLocked int = 423
+)
+
+// address serving WebDAV, empty disables it
+var davAddress string
+
+// errLocked is returned for requests changing a resource
+// locked by a token they did not submit
+var errLocked = errors.New("locked")
+
+// An exclusive write lock on a resource
+type davLock struct {
+	token    string
+	root     string
+	infinite bool
+	owner    string
+	timeout  time.Duration
+	expires  time.Time
+}
+
+// Locks held on resources, by token
+type davLocks struct {
+	mu    sync.Mutex
+	locks map[string]*davLock
+}
+
+var webdavLocks = davLocks{locks: make(map[string]*davLock)}
+
+// Key of a resource in an account
+func davKey(account string, fileName string) string {
+	return path.Join(account, fileName)
+}
+
+// Whether a lock applies to a resource, or to anything
+// inside the resource if descendants is set
+func (l *davLock) covers(key string, descendants bool) bool {
+	if key == l.root || (l.infinite == true && strings.HasPrefix(key, l.root+"/")) {
+		return true
+	}
+	return descendants == true && strings.HasPrefix(l.root, key+"/")
+}
+
+// Drop expired locks
+func (d *davLocks) purge(now time.Time) {
+	for token, lock := range d.locks {
+		if now.After(lock.expires) {
+			delete(d.locks, token)
+		}
+	}
+}
+
+// Check that every lock on a resource, or on anything inside
+// it if descendants is set, has its token submitted
+func (d *davLocks) check(key string, descendants bool, tokens []string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.purge(time.Now())
+
+	for token, lock := range d.locks {
+		if lock.covers(key, descendants) == true && containsToken(tokens, token) == false {
+			return fmt.Errorf("%w: %s", errLocked, lock.root)
+		}
+	}
+	return nil
+}
+
+// Lock a resource, and everything inside it if infinite is
+// set, unless it is already locked
+func (d *davLocks) create(key string, infinite bool, owner string, timeout time.Duration) (davLock, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	d.purge(now)
+
+	for _, lock := range d.locks {
+		if lock.covers(key, infinite) == true {
+			return davLock{}, fmt.Errorf("%w: %s", errLocked, lock.root)
+		}
+	}
+	lock := &davLock{newLockToken(), key, infinite, owner, timeout, now.Add(timeout)}
+	d.locks[lock.token] = lock
+	return *lock, nil
+}
+
+// Extend a lock on a resource by one of the given tokens
+func (d *davLocks) refresh(key string, tokens []string, timeout time.Duration) (davLock, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	d.purge(now)
+
+	for _, token := range tokens {
+		if lock, ok := d.locks[token]; ok == true && lock.covers(key, false) == true {
+			lock.timeout = timeout
+			lock.expires = now.Add(timeout)
+			return *lock, nil
+		}
+	}
+	return davLock{}, fmt.Errorf("%w: no lock on %s to refresh", errPreconditionFailed, key)
+}
+
+// Remove the lock with a token from a resource it covers
+func (d *davLocks) remove(key string, token string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	lock, ok := d.locks[token]
+	if ok == false || lock.covers(key, false) == false {
+		return fmt.Errorf("%s does not lock %s", token, key)
+	}
+	delete(d.locks, token)
+	return nil
+}
+
+// Remove every lock on a resource or inside it, once it
+// has been deleted or moved
+func (d *davLocks) release(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for token, lock := range d.locks {
+		if lock.root == key || strings.HasPrefix(lock.root, key+"/") {
+			delete(d.locks, token)
+		}
+	}
+}
+
+// Locks applying to a resource
+func (d *davLocks) find(key string) []davLock {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.purge(time.Now())
+
+	var found []davLock
+	for _, lock := range d.locks {
+		if lock.covers(key, false) == true {
+			found = append(found, *lock)
+		}
+	}
+	return found
+}
+
+// Generate a lock token
+func newLockToken() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	s := hex.EncodeToString(id)
+	return fmt.Sprintf("opaquelocktoken:%s-%s-%s-%s-%s", s[:8], s[8:12], s[12:16], s[16:20], s[20:])
+}
+
+func containsToken(tokens []string, token string) bool {
+	for _, t := range tokens {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
+
+// Lock tokens submitted in a header as <token>, such as
+// the If and Lock-Token headers
+func submittedTokens(value string) []string {
+	var tokens []string
+	for {
+		start := strings.Index(value, "<")
+		if start < 0 {
+			return tokens
+		}
+		end := strings.Index(value[start:], ">")
+		if end < 0 {
+			return tokens
+		}
+		token := value[start+1 : start+end]
+		if strings.HasPrefix(token, "opaquelocktoken:") {
+			tokens = append(tokens, token)
+		}
+		value = value[start+end+1:]
+	}
+}
+
+// Lock timeout requested by the Timeout header
+func lockTimeout(value string) time.Duration {
+	first, _, _ := strings.Cut(value, ",")
+	first = strings.TrimSpace(first)
+	if first == "Infinite" {
+		return maxDAVLockTimeout
+	}
+	if seconds, ok := strings.CutPrefix(first, "Second-"); ok == true {
+		if n, err := strconv.ParseInt(seconds, 10, 64); err == nil && n > 0 {
+			return min(time.Duration(n)*time.Second, maxDAVLockTimeout)
+		}
+	}
+	return defaultDAVLockTimeout
+}
+
+// Owner of a lock, kept as the XML sent by the client
+type davOwner struct {
+	InnerXML string `xml:",innerxml"`
+}
+
+// Body of a LOCK request
+type davLockInfo struct {
+	XMLName   xml.Name `xml:"DAV: lockinfo"`
+	LockScope struct {
+		Exclusive *struct{} `xml:"DAV: exclusive"`
+		Shared    *struct{} `xml:"DAV: shared"`
+	} `xml:"DAV: lockscope"`
+	Owner *davOwner `xml:"DAV: owner"`
+}
+
+type davHref struct {
+	Href string `xml:"D:href"`
+}
+
+type davLockType struct {
+	Write struct{} `xml:"D:write"`
+}
+
+type davLockScope struct {
+	Exclusive struct{} `xml:"D:exclusive"`
+}
+
+type davActiveLock struct {
+	LockType  davLockType  `xml:"D:locktype"`
+	LockScope davLockScope `xml:"D:lockscope"`
+	Depth     string       `xml:"D:depth"`
+	Owner     *davOwner    `xml:"D:owner"`
+	Timeout   string       `xml:"D:timeout"`
+	LockToken davHref      `xml:"D:locktoken"`
+	LockRoot  davHref      `xml:"D:lockroot"`
+}
+
+type davLockEntry struct {
+	LockScope davLockScope `xml:"D:lockscope"`
+	LockType  davLockType  `xml:"D:locktype"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+// Properties reported by PROPFIND
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength string          `xml:"D:getcontentlength,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified,omitempty"`
+	ETag          string          `xml:"D:getetag,omitempty"`
+	SupportedLock []davLockEntry  `xml:"D:supportedlock>D:lockentry"`
+	LockDiscovery []davActiveLock `xml:"D:lockdiscovery>D:activelock"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+// Body of a PROPFIND response
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	Namespace string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+// Body of a LOCK response
+type davLockDiscovery struct {
+	XMLName   xml.Name        `xml:"D:prop"`
+	Namespace string          `xml:"xmlns:D,attr"`
+	Locks     []davActiveLock `xml:"D:lockdiscovery>D:activelock"`
+}
+
+// Error with the HTTP status to answer a WebDAV request with
+type davError struct {
+	status int
+	err    error
+}
+
+func (e *davError) Error() string {
+	return e.err.Error()
+}
+
+func (e *davError) Unwrap() error {
+	return e.err
+}
+
+// Answer an error with a status other than the one it maps to
+func withStatus(status int, err error) error {
+	return &davError{status, err}
+}
+
+// Map an error to the HTTP status of a WebDAV response
+func davStatus(err error) int {
+	var e *davError
+	if errors.As(err, &e) == true {
+		return e.status
+	}
+	if errors.Is(err, errLocked) {
+		return statusLocked
+	}
+	return httpStatus(err)
+}
+
+// URL path of a resource
+func davURL(account string, fileName string, collection bool) string {
+	href := (&url.URL{Path: path.Join(davPrefix, account, fileName)}).EscapedPath()
+	if collection == true {
+		href += "/"
+	}
+	return href
+}
+
+// Split a WebDAV URL path into an account and file name
+func davPath(urlPath string) (string, string, error) {
+	rest, ok := strings.CutPrefix(urlPath, davPrefix)
+	if ok == false {
+		return "", "", fmt.Errorf("%s: %w", urlPath, os.ErrNotExist)
+	}
+	account, fileName, _ := strings.Cut(strings.Trim(rest, "/"), "/")
+	if checkAccountName(account) != nil {
+		return "", "", fmt.Errorf("%s: %w", urlPath, os.ErrNotExist)
+	}
+	return account, fileName, nil
+}
+
+// A WebDAV request on a resource of an account
+type davRequest struct {
+	w        http.ResponseWriter
+	r        *http.Request
+	conn     net.Conn
+	svr      Server
+	account  string
+	fileName string
+	tokens   []string
+}
+
+// Header of an operation on a resource made for the request
+func (d *davRequest) header(op string, fileName string) common.Header {
+	header := common.Header{Operation: op, FileName: fileName, Params: url.Values{}}
+	setRequestIdentity(&header, d.r, d.account)
+	return header
+}
+
+// Perform an operation on a resource of the account
+func (d *davRequest) perform(header common.Header, body []byte) (common.ResponseData, error) {
+	data := common.ClientData{Header: header, DataList: list.New(), Conn: d.conn}
+	if body != nil {
+		data.DataList.PushBack(common.Data{Size: len(body), Buffer: body})
+		data.Header.Size = uint64(len(body))
+	}
+	return dispatch(data, d.svr)
+}
+
+// Key of the resource of the request
+func (d *davRequest) key() string {
+	return davKey(d.account, d.fileName)
+}
+
+// Whether a file or directory exists in the account
+func (d *davRequest) exists(fileName string) (bool, error) {
+	return checkExistence(path.Join(accountRoot, d.account, fileName))
+}
+
+// Serve WebDAV requests
+func davHandler(svr Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			w.Header().Set("DAV", "1, 2")
+			w.Header().Set("MS-Author-Via", "DAV")
+			w.Header().Set("Allow", davMethods)
+			return
+		}
+
+		start := time.Now()
+		conn := trackConnection(&httpConn{remote: httpAddr(r.RemoteAddr)})
+		annotateConn(conn, "method", r.Method, "path", r.URL.Path)
+		fail := func(err error) {
+			status := davStatus(err)
+			connLogger(conn).Warn("request failed", "err", err, "status", status, "duration", time.Since(start))
+			http.Error(w, err.Error(), status)
+		}
+
+		d, err := readDAVRequest(w, r, conn, svr)
+		if err != nil {
+			requestMetrics.observe(r.Method, err, time.Since(start))
+			fail(err)
+			return
+		}
+		status, err := d.serve()
+		if err != nil {
+			fail(err)
+			return
+		}
+		connLogger(conn).Info("handled request", "status", status, "duration", time.Since(start))
+	}
+}
+
+// Find the resource of a WebDAV request, checking the same
+// limits as handleConnection
+func readDAVRequest(w http.ResponseWriter, r *http.Request, conn net.Conn, svr Server) (d *davRequest, err error) {
+	limited := common.Header{Operation: r.Method, FileName: r.URL.Path}
+	defer func() {
+		if err != nil {
+			recordRejection(limited, conn, err)
+		}
+	}()
+
+	account, fileName, err := davPath(r.URL.Path)
+	if err != nil {
+		return nil, err
+	}
+	d = &davRequest{w, r, conn, svr, account, fileName, submittedTokens(r.Header.Get("If"))}
+
+	limited = d.header(r.Method, fileName)
+	if shuttingDown.Load() == true {
+		return nil, fmt.Errorf("%w: shutting down", errServerBusy)
+	}
+	if r.Method == http.MethodPut {
+		limited.Operation = "WRITE"
+		limited.Size = uint64(max(r.ContentLength, 0))
+	}
+	if err := checkRateLimits(limited, conn); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Serve a WebDAV request, returning the status sent or the
+// error to answer with
+func (d *davRequest) serve() (int, error) {
+	switch d.r.Method {
+	case http.MethodGet, http.MethodHead:
+		return d.get()
+	case http.MethodPut:
+		return d.put()
+	case http.MethodDelete:
+		return d.delete()
+	case "MKCOL":
+		return d.mkcol()
+	case "MOVE", "COPY":
+		return d.transfer(d.r.Method)
+	case "PROPFIND":
+		return d.propfind()
+	case "LOCK":
+		return d.lock()
+	case "UNLOCK":
+		return d.unlock()
+	default:
+		d.w.Header().Set("Allow", davMethods)
+		return 0, fmt.Errorf("%w: %s", errMethodNotAllowed, d.r.Method)
+	}
+}
+
+// Send a file, or its headers for HEAD
+func (d *davRequest) get() (int, error) {
+	op := "READ"
+	if d.r.Method == http.MethodHead {
+		op = "STAT"
+	}
+	res, err := d.perform(d.header(op, d.fileName), nil)
+	if err != nil {
+		if errorCode(err) == "" {
+			if info, statErr := os.Stat(path.Join(accountRoot, d.account, d.fileName)); statErr == nil && info.IsDir() {
+				return 0, fmt.Errorf("%w: GET of collection %s", errMethodNotAllowed, d.fileName)
+			}
+		}
+		return 0, err
+	}
+
+	params := res.Header.Params
+	if params.Get(common.ParamType) == common.TypeDirectory {
+		d.w.WriteHeader(http.StatusOK)
+		return http.StatusOK, nil
+	}
+	if version := params.Get(common.ParamVersion); version != "" {
+		d.w.Header().Set("ETag", `"`+version+`"`)
+	}
+	d.w.Header().Set("Content-Type", contentType(d.fileName))
+	if op == "STAT" {
+		d.w.Header().Set("Content-Length", params.Get(common.ParamSize))
+		d.w.WriteHeader(http.StatusOK)
+		return http.StatusOK, nil
+	}
+	d.w.Header().Set("Content-Length", strconv.FormatUint(res.Header.Size, 10))
+	d.w.WriteHeader(http.StatusOK)
+	d.w.Write(common.JoinDataList(res.DataList))
+	bytesSent.Add(int64(res.Header.Size))
+	return http.StatusOK, nil
+}
+
+// Replace the contents of a file
+func (d *davRequest) put() (int, error) {
+	if err := webdavLocks.check(d.key(), false, d.tokens); err != nil {
+		return 0, err
+	}
+	existed, err := d.exists(d.fileName)
+	if err != nil {
+		return 0, err
+	}
+
+	header := d.header("WRITE", d.fileName)
+	header.Params.Set(common.ParamTruncate, "true")
+	header.Size = uint64(max(d.r.ContentLength, 0))
+	if err := checkWrite(header); err != nil {
+		recordRejection(header, d.conn, err)
+		return 0, err
+	}
+	body, err := readWriteBody(header, d.r.Body)
+	if err != nil {
+		recordRejection(header, d.conn, err)
+		return 0, err
+	}
+	bytesReceived.Add(int64(len(body)))
+
+	res, err := d.perform(header, body)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, withStatus(http.StatusConflict, err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if version := res.Header.Params.Get(common.ParamVersion); version != "" {
+		d.w.Header().Set("ETag", `"`+version+`"`)
+	}
+	status := http.StatusCreated
+	if existed == true {
+		status = http.StatusNoContent
+	}
+	d.w.WriteHeader(status)
+	return status, nil
+}
+
+// Delete a file or collection
+func (d *davRequest) delete() (int, error) {
+	if err := webdavLocks.check(d.key(), true, d.tokens); err != nil {
+		return 0, err
+	}
+	if _, err := d.perform(d.header("DELETE", d.fileName), nil); err != nil {
+		return 0, err
+	}
+	webdavLocks.release(d.key())
+	d.w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
+
+// Create a collection
+func (d *davRequest) mkcol() (int, error) {
+	if d.r.ContentLength > 0 {
+		return 0, withStatus(http.StatusUnsupportedMediaType, fmt.Errorf("MKCOL with a body"))
+	}
+	if err := webdavLocks.check(d.key(), false, d.tokens); err != nil {
+		return 0, err
+	}
+	_, err := d.perform(d.header("MKDIR", d.fileName), nil)
+	switch {
+	case errors.Is(err, os.ErrExist):
+		return 0, withStatus(http.StatusMethodNotAllowed, err)
+	case errors.Is(err, os.ErrNotExist):
+		return 0, withStatus(http.StatusConflict, err)
+	case err != nil:
+		return 0, err
+	}
+	d.w.WriteHeader(http.StatusCreated)
+	return http.StatusCreated, nil
+}
+
+// Move or copy a resource to the Destination header,
+// replacing it unless the Overwrite header is F
+func (d *davRequest) transfer(op string) (int, error) {
+	target, err := url.Parse(d.r.Header.Get("Destination"))
+	if err != nil {
+		return 0, withStatus(http.StatusBadRequest, err)
+	}
+	account, dest, err := davPath(target.Path)
+	if err != nil {
+		return 0, withStatus(http.StatusBadRequest, err)
+	}
+	if account != d.account {
+		return 0, fmt.Errorf("%w: %s to another account", errPermissionDenied, op)
+	}
+	destKey := davKey(account, dest)
+
+	if op == "MOVE" {
+		if err := webdavLocks.check(d.key(), true, d.tokens); err != nil {
+			return 0, err
+		}
+	}
+	if err := webdavLocks.check(destKey, true, d.tokens); err != nil {
+		return 0, err
+	}
+	if exists, err := d.exists(d.fileName); err != nil || exists == false {
+		if err == nil {
+			err = fmt.Errorf("%s: %w", d.fileName, os.ErrNotExist)
+		}
+		return 0, err
+	}
+
+	existed, err := d.exists(dest)
+	if err != nil {
+		return 0, err
+	}
+	if existed == true {
+		if d.r.Header.Get("Overwrite") == "F" {
+			return 0, fmt.Errorf("%w: %s exists", errPreconditionFailed, dest)
+		}
+		if _, err := d.perform(d.header("DELETE", dest), nil); err != nil {
+			return 0, err
+		}
+		webdavLocks.release(destKey)
+	}
+
+	header := d.header(op, d.fileName)
+	header.Params.Set(common.ParamDestination, dest)
+	_, err = d.perform(header, nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, withStatus(http.StatusConflict, err)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if op == "MOVE" {
+		webdavLocks.release(d.key())
+	}
+
+	status := http.StatusCreated
+	if existed == true {
+		status = http.StatusNoContent
+	}
+	d.w.WriteHeader(status)
+	return status, nil
+}
+
+// Report the properties of a resource and, for a collection
+// with depth 1, of its members
+func (d *davRequest) propfind() (int, error) {
+	depth := d.r.Header.Get("Depth")
+	if depth != "0" && depth != "1" {
+		return 0, withStatus(http.StatusForbidden, fmt.Errorf("PROPFIND depth %q is not supported", depth))
+	}
+
+	res, err := d.perform(d.header("STAT", d.fileName), nil)
+	if err != nil {
+		return 0, err
+	}
+	status := davMultistatus{Namespace: "DAV:"}
+	status.Responses = append(status.Responses, d.propResponse(d.fileName, res.Header.Params))
+
+	if depth == "1" && res.Header.Params.Get(common.ParamType) == common.TypeDirectory {
+		list, err := d.perform(d.header("LIST", d.fileName), nil)
+		if err != nil {
+			return 0, err
+		}
+		storageLock.RLock()
+		defer storageLock.RUnlock()
+		for iter := list.DataList.Front(); iter != nil; iter = iter.Next() {
+			data := iter.Value.(common.Data)
+			member := path.Join(d.fileName, strings.TrimSuffix(string(data.Buffer[:data.Size]), "\n"))
+			stat, err := statFile(d.account, member, url.Values{}, d.conn)
+			if err != nil {
+				continue
+			}
+			status.Responses = append(status.Responses, d.propResponse(member, stat.Header.Params))
+		}
+	}
+
+	d.w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	d.w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(d.w, xml.Header)
+	xml.NewEncoder(d.w).Encode(status)
+	return http.StatusMultiStatus, nil
+}
+
+// Properties of a resource from its STAT response
+func (d *davRequest) propResponse(fileName string, params url.Values) davResponse {
+	collection := params.Get(common.ParamType) == common.TypeDirectory
+	prop := davProp{
+		DisplayName:   path.Base("/" + path.Join(d.account, fileName)),
+		SupportedLock: []davLockEntry{{}},
+	}
+	if mtime, err := time.Parse(time.RFC3339, params.Get(common.ParamModTime)); err == nil {
+		prop.LastModified = mtime.Format(http.TimeFormat)
+	}
+	if collection == true {
+		prop.ResourceType.Collection = &struct{}{}
+	} else {
+		prop.ContentLength = params.Get(common.ParamSize)
+		prop.ContentType = contentType(fileName)
+		if version := params.Get(common.ParamVersion); version != "" {
+			prop.ETag = `"` + version + `"`
+		}
+	}
+	for _, lock := range webdavLocks.find(davKey(d.account, fileName)) {
+		prop.LockDiscovery = append(prop.LockDiscovery, activeLock(lock))
+	}
+	return davResponse{
+		Href:     davURL(d.account, fileName, collection),
+		Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"},
+	}
+}
+
+// Report a lock as in a lockdiscovery property
+func activeLock(lock davLock) davActiveLock {
+	account, fileName, _ := strings.Cut(lock.root, "/")
+	depth := "0"
+	if lock.infinite == true {
+		depth = "infinity"
+	}
+	active := davActiveLock{
+		Depth:     depth,
+		Timeout:   fmt.Sprintf("Second-%d", int64(lock.timeout.Seconds())),
+		LockToken: davHref{lock.token},
+		LockRoot:  davHref{davURL(account, fileName, false)},
+	}
+	if lock.owner != "" {
+		active.Owner = &davOwner{lock.owner}
+	}
+	return active
+}
+
+// Lock a resource, creating an empty file if it does not
+// exist, or refresh a lock submitted in the If header
+func (d *davRequest) lock() (int, error) {
+	timeout := lockTimeout(d.r.Header.Get("Timeout"))
+	body, err := ioutil.ReadAll(io.LimitReader(d.r.Body, maxDAVLockInfoSize+1))
+	if err != nil {
+		return 0, err
+	}
+	if int64(len(body)) > maxDAVLockInfoSize {
+		return 0, fmt.Errorf("%w: lockinfo of more than %d bytes", errTooLarge, maxDAVLockInfoSize)
+	}
+
+	var lock davLock
+	status := http.StatusOK
+	if len(body) == 0 {
+		if lock, err = webdavLocks.refresh(d.key(), d.tokens, timeout); err != nil {
+			return 0, err
+		}
+	} else {
+		var info davLockInfo
+		if err := xml.Unmarshal(body, &info); err != nil {
+			return 0, withStatus(http.StatusBadRequest, fmt.Errorf("invalid lockinfo: %w", err))
+		}
+		if info.LockScope.Exclusive == nil {
+			return 0, withStatus(http.StatusNotImplemented, fmt.Errorf("only exclusive locks are supported"))
+		}
+		owner := ""
+		if info.Owner != nil {
+			owner = info.Owner.InnerXML
+		}
+		infinite := d.r.Header.Get("Depth") != "0"
+		if lock, err = webdavLocks.create(d.key(), infinite, owner, timeout); err != nil {
+			return 0, err
+		}
+
+		exists, err := d.exists(d.fileName)
+		if err == nil && exists == false {
+			header := d.header("WRITE", d.fileName)
+			header.Params.Set(common.ParamIfNoneMatch, "*")
+			_, err = d.perform(header, []byte{})
+			status = http.StatusCreated
+		}
+		if err != nil {
+			webdavLocks.remove(d.key(), lock.token)
+			if errors.Is(err, os.ErrNotExist) {
+				err = withStatus(http.StatusConflict, err)
+			}
+			return 0, err
+		}
+		d.w.Header().Set("Lock-Token", "<"+lock.token+">")
+	}
+
+	d.w.Header().Set("Content-Type", `application/xml; charset="utf-8"`)
+	d.w.WriteHeader(status)
+	io.WriteString(d.w, xml.Header)
+	xml.NewEncoder(d.w).Encode(davLockDiscovery{Namespace: "DAV:", Locks: []davActiveLock{activeLock(lock)}})
+	return status, nil
+}
+
+// Remove the lock named by the Lock-Token header
+func (d *davRequest) unlock() (int, error) {
+	tokens := submittedTokens(d.r.Header.Get("Lock-Token"))
+	if len(tokens) != 1 {
+		return 0, withStatus(http.StatusBadRequest, fmt.Errorf("missing Lock-Token"))
+	}
+	if err := webdavLocks.remove(d.key(), tokens[0]); err != nil {
+		return 0, withStatus(http.StatusConflict, err)
+	}
+	d.w.WriteHeader(http.StatusNoContent)
+	return http.StatusNoContent, nil
+}
+
+// Content type of a file from its extension
+func contentType(fileName string) string {
+	if t := mime.TypeByExtension(path.Ext(fileName)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
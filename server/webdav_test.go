@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// PROPFIND response as read by a client
+type testMultistatus struct {
+	Responses []struct {
+		Href string `xml:"DAV: href"`
+		Prop struct {
+			ResourceType struct {
+				Collection *struct{} `xml:"DAV: collection"`
+			} `xml:"DAV: resourcetype"`
+			ContentLength string   `xml:"DAV: getcontentlength"`
+			ETag          string   `xml:"DAV: getetag"`
+			LockTokens    []string `xml:"DAV: lockdiscovery>activelock>locktoken>href"`
+		} `xml:"DAV: propstat>prop"`
+	} `xml:"DAV: response"`
+}
+
+func TestWebDAV(t *testing.T) {
+	accountName := "webdav"
+	createTestAccount(accountName, t)
+	defer func() {
+		for _, dir := range accountDirs(accountName) {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	server := httptest.NewServer(davHandler(Server{}))
+	defer server.Close()
+	base := server.URL + "/dav/webdav/"
+
+	do := func(method string, target string, body string, headers ...string) (*http.Response, string) {
+		r, err := http.NewRequest(method, base+target, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("NewRequest(%s %s) = %v", method, target, err)
+		}
+		r.SetBasicAuth(accountName, "")
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Fatalf("%s %s = %v", method, target, err)
+		}
+		defer res.Body.Close()
+		contents, _ := ioutil.ReadAll(res.Body)
+		return res, string(contents)
+	}
+	expect := func(method string, target string, body string, status int, headers ...string) (*http.Response, string) {
+		res, contents := do(method, target, body, headers...)
+		if res.StatusCode != status {
+			t.Errorf("%s %s = %d %q, expected %d", method, target, res.StatusCode, contents, status)
+		}
+		return res, contents
+	}
+
+	res, _ := expect("OPTIONS", "", "", http.StatusOK)
+	if strings.Contains(res.Header.Get("DAV"), "2") == false {
+		t.Errorf("OPTIONS DAV header = %q, expected class 2", res.Header.Get("DAV"))
+	}
+
+	expect("MKCOL", "journal", "", http.StatusCreated)
+	expect("MKCOL", "journal", "", http.StatusMethodNotAllowed)
+	expect("MKCOL", "missing/journal", "", http.StatusConflict)
+	expect("PUT", "journal/monday.txt", "dear diary", http.StatusCreated)
+	expect("PUT", "journal/monday.txt", "dear diary, again", http.StatusNoContent)
+	expect("PUT", "missing/monday.txt", "lost", http.StatusConflict)
+	if _, body := expect("GET", "journal/monday.txt", "", http.StatusOK); body != "dear diary, again" {
+		t.Errorf("GET after PUT = %q", body)
+	}
+	expect("GET", "journal", "", http.StatusMethodNotAllowed)
+
+	expect("COPY", "journal/monday.txt", "", http.StatusCreated, "Destination", base+"journal/tuesday.txt")
+	expect("COPY", "journal/monday.txt", "", http.StatusPreconditionFailed, "Destination", base+"journal/tuesday.txt", "Overwrite", "F")
+	expect("MOVE", "journal", "", http.StatusCreated, "Destination", base+"diary")
+	expect("COPY", "diary", "", http.StatusForbidden, "Destination", server.URL+"/dav/other/diary")
+	expect("GET", "journal/monday.txt", "", http.StatusNotFound)
+	if _, body := expect("GET", "diary/tuesday.txt", "", http.StatusOK); body != "dear diary, again" {
+		t.Errorf("GET after COPY and MOVE = %q", body)
+	}
+
+	expect("PROPFIND", "diary", "", http.StatusForbidden, "Depth", "infinity")
+	_, body := expect("PROPFIND", "diary", "", http.StatusMultiStatus, "Depth", "1")
+	var status testMultistatus
+	if err := xml.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatalf("PROPFIND body %q: %v", body, err)
+	}
+	var hrefs []string
+	for _, response := range status.Responses {
+		hrefs = append(hrefs, response.Href)
+		collection := response.Prop.ResourceType.Collection != nil
+		if collection != strings.HasSuffix(response.Href, "/") {
+			t.Errorf("PROPFIND %s collection = %v", response.Href, collection)
+		}
+		if collection == false && (response.Prop.ContentLength != "17" || response.Prop.ETag == "") {
+			t.Errorf("PROPFIND %s length %s etag %q", response.Href, response.Prop.ContentLength, response.Prop.ETag)
+		}
+	}
+	sort.Strings(hrefs)
+	if strings.Join(hrefs, ",") != "/dav/webdav/diary/,/dav/webdav/diary/monday.txt,/dav/webdav/diary/tuesday.txt" {
+		t.Errorf("PROPFIND hrefs = %v", hrefs)
+	}
+
+	lockInfo := `<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope>` +
+		`<D:locktype><D:write/></D:locktype><D:owner><D:href>editor</D:href></D:owner></D:lockinfo>`
+	res, _ = expect("LOCK", "diary/wednesday.txt", lockInfo, http.StatusCreated, "Timeout", "Second-60")
+	token := res.Header.Get("Lock-Token")
+	if strings.HasPrefix(token, "<opaquelocktoken:") == false {
+		t.Fatalf("LOCK token = %q", token)
+	}
+	expect("LOCK", "diary/wednesday.txt", lockInfo, statusLocked)
+	expect("PUT", "diary/wednesday.txt", "locked out", statusLocked)
+	expect("DELETE", "diary", "", statusLocked)
+	expect("PUT", "diary/wednesday.txt", "locked in", http.StatusNoContent, "If", "("+token+")")
+	expect("LOCK", "diary/wednesday.txt", "", http.StatusOK, "If", "("+token+")")
+
+	_, body = expect("PROPFIND", "diary/wednesday.txt", "", http.StatusMultiStatus, "Depth", "0")
+	status = testMultistatus{}
+	if err := xml.Unmarshal([]byte(body), &status); err != nil || len(status.Responses) != 1 ||
+		len(status.Responses[0].Prop.LockTokens) != 1 || "<"+status.Responses[0].Prop.LockTokens[0]+">" != token {
+		t.Errorf("PROPFIND of locked file = %q, %v", body, err)
+	}
+
+	expect("UNLOCK", "diary/wednesday.txt", "", http.StatusConflict, "Lock-Token", "<opaquelocktoken:other>")
+	expect("UNLOCK", "diary/wednesday.txt", "", http.StatusNoContent, "Lock-Token", token)
+	expect("DELETE", "diary", "", http.StatusNoContent)
+	expect("PROPFIND", "diary", "", http.StatusNotFound, "Depth", "0")
+}
+
+func TestSubmittedTokens(t *testing.T) {
+	header := `<http://host/dav/a/x> (<opaquelocktoken:1> ["etag"]) (Not <opaquelocktoken:2>)`
+	tokens := submittedTokens(header)
+	if strings.Join(tokens, ",") != "opaquelocktoken:1,opaquelocktoken:2" {
+		t.Errorf("submittedTokens(%q) = %v", header, tokens)
+	}
+	if timeout := lockTimeout("Second-30, Infinite"); timeout.Seconds() != 30 {
+		t.Errorf("lockTimeout(Second-30) = %v", timeout)
+	}
+	if timeout := lockTimeout("Infinite"); timeout != maxDAVLockTimeout {
+		t.Errorf("lockTimeout(Infinite) = %v", timeout)
+	}
+}
+
+func TestWebDAVBodyLimit(t *testing.T) {
+	accountName := "webdav_limit"
+	createTestAccount(accountName, t)
+	defer func() {
+		for _, dir := range accountDirs(accountName) {
+			os.RemoveAll(dir)
+		}
+	}()
+	defer func(q quota) { defaultQuota = q }(defaultQuota)
+	defaultQuota = quota{maxBytes: 10}
+
+	handler := davHandler(Server{})
+	do := func(method string, body string) int {
+		// a reader of unknown length is sent without a Content-Length
+		r := httptest.NewRequest(method, "/dav/webdav_limit/big.txt", io.MultiReader(strings.NewReader(body)))
+		r.SetBasicAuth(accountName, "")
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, r)
+		return res.Code
+	}
+
+	if code := do("PUT", "0123456789a"); code != http.StatusInsufficientStorage {
+		t.Errorf("PUT beyond the quota = %d, expected %d", code, http.StatusInsufficientStorage)
+	}
+	if code := do("LOCK", strings.Repeat(" ", int(maxDAVLockInfoSize)+1)); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("LOCK with an oversized body = %d, expected %d", code, http.StatusRequestEntityTooLarge)
+	}
+}